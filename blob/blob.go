@@ -0,0 +1,31 @@
+package blob
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrNotFound is returned when a blob cannot be found
+	// in the store.
+	ErrNotFound = errors.New("blob: blob not found")
+
+	// ErrKeyInvalid is returned when a key is empty or tries
+	// to escape the store, e.g. using "..".
+	ErrKeyInvalid = errors.New("blob: key is not valid")
+)
+
+// BlobStore is used to store binary files such as product images.
+// Keys are slash separated paths like "products/1/abc.jpg".
+type BlobStore interface {
+	// Put stores the content read from r under the key,
+	// replacing any previous blob with the same key
+	Put(key string, r io.Reader, contentType string) error
+	// Get returns the content of the blob. The caller must close it.
+	// It returns ErrNotFound if the blob doesn't exist.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the blob. Deleting a missing blob is not an error.
+	Delete(key string) error
+	// URL returns the public URL of the blob
+	URL(key string) string
+}
@@ -0,0 +1,95 @@
+package blob
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// NewLocalStore creates a store that saves the blobs as files
+// under dir. baseURL is the URL where dir is served, e.g.
+// "http://localhost:3000/images".
+func NewLocalStore(dir, baseURL string) *LocalStore {
+	return &LocalStore{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+var _ BlobStore = &LocalStore{}
+
+// LocalStore is a BlobStore backed by the local filesystem.
+// It is meant for development and tests.
+type LocalStore struct {
+	dir     string
+	baseURL string
+}
+
+// Dir returns the directory where the blobs are saved
+func (ls *LocalStore) Dir() string {
+	return ls.dir
+}
+
+func (ls *LocalStore) Put(key string, r io.Reader, contentType string) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// Write to a temp file first so readers never see half a blob
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (ls *LocalStore) Get(key string) (io.ReadCloser, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (ls *LocalStore) Delete(key string) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (ls *LocalStore) URL(key string) string {
+	return ls.baseURL + "/" + key
+}
+
+// path maps the key to a file under the store directory
+func (ls *LocalStore) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if key == "" || clean == "/" || clean != "/"+key {
+		return "", ErrKeyInvalid
+	}
+	return filepath.Join(ls.dir, filepath.FromSlash(clean)), nil
+}
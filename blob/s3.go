@@ -0,0 +1,99 @@
+package blob
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3Config configures an S3 compatible store. Endpoint is only
+// needed for services other than AWS, such as MinIO, and turns on
+// path style addressing. When BaseURL is empty the URLs point to
+// the bucket endpoint.
+type S3Config struct {
+	Bucket   string
+	Region   string
+	Endpoint string
+	BaseURL  string
+}
+
+// NewS3Store creates a store that saves the blobs in an S3 bucket.
+// The credentials are read from the environment like the rest of
+// the AWS services.
+func NewS3Store(cfg S3Config) *S3Store {
+	awsCfg := aws.NewConfig().WithRegion(cfg.Region)
+	baseURL := cfg.BaseURL
+	if cfg.Endpoint != "" {
+		awsCfg = awsCfg.WithEndpoint(cfg.Endpoint).WithS3ForcePathStyle(true)
+		if baseURL == "" {
+			baseURL = strings.TrimSuffix(cfg.Endpoint, "/") + "/" + cfg.Bucket
+		}
+	}
+	if baseURL == "" {
+		baseURL = "https://" + cfg.Bucket + ".s3." + cfg.Region + ".amazonaws.com"
+	}
+	return &S3Store{
+		client:  s3.New(session.New(), awsCfg),
+		bucket:  cfg.Bucket,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+var _ BlobStore = &S3Store{}
+
+// S3Store is a BlobStore backed by an S3 compatible service
+type S3Store struct {
+	client  *s3.S3
+	bucket  string
+	baseURL string
+}
+
+func (ss *S3Store) Put(key string, r io.Reader, contentType string) error {
+	if key == "" {
+		return ErrKeyInvalid
+	}
+	// PutObject needs a seekable body
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	_, err = ss.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(ss.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (ss *S3Store) Get(key string) (io.ReadCloser, error) {
+	out, err := ss.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (ss *S3Store) Delete(key string) error {
+	_, err := ss.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (ss *S3Store) URL(key string) string {
+	return ss.baseURL + "/" + key
+}
@@ -0,0 +1,293 @@
+package catalog
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jcamilom/ecommerce/models"
+)
+
+// Formats supported to import and export the catalog
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+var (
+	// ErrFormatInvalid is returned when the format is not
+	// FormatCSV nor FormatJSON.
+	ErrFormatInvalid = errors.New("catalog: format must be csv or json")
+
+	// ErrHeaderInvalid is returned when a CSV file lacks
+	// the id or name columns.
+	ErrHeaderInvalid = errors.New("catalog: csv header must have at least the id and name columns")
+)
+
+// MaxFileSize is the max size in bytes of a file to import
+const MaxFileSize = 32 << 20
+
+// Columns of the CSV files, in the order they are exported.
+//
+// Tags are separated by "|". Attributes are written as
+// "name=value" or "name:type=value" and separated by "|".
+// Variants are written as a JSON array.
+var Columns = []string{"id", "name", "price", "quantity", "category_id", "tags", "attributes", "variants"}
+
+// Read parses the products in the provided format. The error is only
+// set if the file can't be read at all, errors in single rows are
+// set on the rows so they can be reported.
+func Read(format string, r io.Reader) ([]models.ImportRow, error) {
+	switch format {
+	case FormatCSV:
+		return ReadCSV(r)
+	case FormatJSON:
+		return ReadJSON(r)
+	default:
+		return nil, ErrFormatInvalid
+	}
+}
+
+// Write writes the products in the provided format
+func Write(format string, w io.Writer, products []models.Product) error {
+	switch format {
+	case FormatCSV:
+		return WriteCSV(w, products)
+	case FormatJSON:
+		return WriteJSON(w, products)
+	default:
+		return ErrFormatInvalid
+	}
+}
+
+// ReadJSON parses a JSON array of products. Lines are the position
+// of the product in the array, starting at 1. Only the fields of
+// Columns present in a product, and not null, are imported.
+func ReadJSON(r io.Reader) ([]models.ImportRow, error) {
+	raw := []json.RawMessage{}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("catalog: invalid json file: %w", err)
+	}
+	rows := make([]models.ImportRow, 0, len(raw))
+	for i, item := range raw {
+		row := models.ImportRow{Line: i + 1}
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(item, &fields); err != nil {
+			row.Err = fmt.Errorf("catalog: invalid product: %v", err)
+		} else if err := json.Unmarshal(item, &row.Product); err != nil {
+			row.Err = fmt.Errorf("catalog: invalid product: %v", err)
+		}
+		present := map[string]bool{}
+		for name, value := range fields {
+			if string(value) != "null" {
+				present[strings.ToLower(name)] = true
+			}
+		}
+		row.Columns = knownColumns(present)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// WriteJSON writes the products as an indented JSON array
+func WriteJSON(w io.Writer, products []models.Product) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(products)
+}
+
+// ReadCSV parses a CSV file with a header row naming the columns.
+// The columns may be in any order and only id and name are required,
+// an empty id creates a new product. The missing columns are kept as
+// they are when a product is updated, and so are the price and
+// quantity of the rows where they are blank, since a blank number
+// would set them to 0. Lines are the line numbers in the file, the
+// header being line 1.
+func ReadCSV(r io.Reader) ([]models.ImportRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("catalog: invalid csv file: %w", err)
+	}
+	index := map[string]int{}
+	present := map[string]bool{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		index[name] = i
+		present[name] = true
+	}
+	columns := knownColumns(present)
+	if _, ok := index["id"]; !ok {
+		return nil, ErrHeaderInvalid
+	}
+	if _, ok := index["name"]; !ok {
+		return nil, ErrHeaderInvalid
+	}
+
+	rows := []models.ImportRow{}
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		row := models.ImportRow{
+			Line:    line,
+			Columns: columns,
+		}
+		if _, ok := err.(*csv.ParseError); err != nil && !ok {
+			// The file can't be read any further
+			return nil, fmt.Errorf("catalog: unable to read the csv file: %w", err)
+		}
+		if err != nil {
+			row.Err = fmt.Errorf("catalog: invalid csv line: %v", err)
+		} else {
+			row.Product, row.Err = parseRecord(record, index)
+			row.Columns = recordColumns(columns, record, index)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func parseRecord(record []string, index map[string]int) (models.Product, error) {
+	get := func(column string) string {
+		i, ok := index[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	p := models.Product{
+		ID:         get("id"),
+		Name:       get("name"),
+		CategoryID: get("category_id"),
+		Tags:       splitList(get("tags")),
+		Attributes: []models.Attribute{},
+		Variants:   []models.Variant{},
+	}
+	var err error
+	if p.Price, err = parseInt(get("price")); err != nil {
+		return p, fmt.Errorf("catalog: price must be a number")
+	}
+	if p.Quantity, err = parseInt(get("quantity")); err != nil {
+		return p, fmt.Errorf("catalog: quantity must be a number")
+	}
+	for _, a := range splitList(get("attributes")) {
+		attribute, err := parseAttribute(a)
+		if err != nil {
+			return p, err
+		}
+		p.Attributes = append(p.Attributes, attribute)
+	}
+	if v := get("variants"); v != "" {
+		if err := json.Unmarshal([]byte(v), &p.Variants); err != nil {
+			return p, fmt.Errorf("catalog: variants must be a json array: %v", err)
+		}
+	}
+	return p, nil
+}
+
+// parseAttribute parses "name=value" or "name:type=value"
+func parseAttribute(s string) (models.Attribute, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return models.Attribute{}, fmt.Errorf("catalog: attribute '%v' must be name=value or name:type=value", s)
+	}
+	a := models.Attribute{
+		Name:  parts[0],
+		Value: parts[1],
+	}
+	if i := strings.Index(a.Name, ":"); i >= 0 {
+		a.Name, a.Type = a.Name[:i], a.Name[i+1:]
+	}
+	return a, nil
+}
+
+// WriteCSV writes the products with a header row using Columns
+func WriteCSV(w io.Writer, products []models.Product) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(Columns); err != nil {
+		return err
+	}
+	for _, p := range products {
+		attributes := []string{}
+		for _, a := range p.Attributes {
+			if a.Type == "" {
+				attributes = append(attributes, fmt.Sprintf("%v=%v", a.Name, a.Value))
+				continue
+			}
+			attributes = append(attributes, fmt.Sprintf("%v:%v=%v", a.Name, a.Type, a.Value))
+		}
+		variants := ""
+		if len(p.Variants) > 0 {
+			b, err := json.Marshal(p.Variants)
+			if err != nil {
+				return err
+			}
+			variants = string(b)
+		}
+		record := []string{
+			p.ID,
+			p.Name,
+			strconv.Itoa(p.Price),
+			strconv.Itoa(p.Quantity),
+			p.CategoryID,
+			strings.Join(p.Tags, "|"),
+			strings.Join(attributes, "|"),
+			variants,
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// recordColumns returns the columns without the number columns that
+// are blank in the record
+func recordColumns(columns []string, record []string, index map[string]int) []string {
+	filled := []string{}
+	for _, c := range columns {
+		if c == "price" || c == "quantity" {
+			if i := index[c]; i >= len(record) || strings.TrimSpace(record[i]) == "" {
+				continue
+			}
+		}
+		filled = append(filled, c)
+	}
+	return filled
+}
+
+// knownColumns returns the Columns that are present, in their order
+func knownColumns(present map[string]bool) []string {
+	columns := []string{}
+	for _, c := range Columns {
+		if present[c] {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, "|") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseInt(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
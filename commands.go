@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jcamilom/ecommerce/catalog"
+	"github.com/jcamilom/ecommerce/models"
+)
+
+const usage = `Usage:
+  go run . [command] [flags]
+
+Without a command the API server is started.
+
+Commands:
+  import [-format csv|json] [-dry-run] <file>
+        create or update the products of the file
+  export [-format csv|json] [-o file]
+        write the whole catalog to the file or the standard output
+  role <email> <customer|support|admin>
+        change the role of a user
+`
+
+// runCommand runs a command line command and returns the exit code
+func runCommand(args []string) int {
+	var err error
+	switch args[0] {
+	case "import":
+		err = importCommand(args[1:])
+	case "export":
+		err = exportCommand(args[1:])
+	case "role":
+		err = roleCommand(args[1:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "file format, csv or json (default: from the file extension)")
+	dryRun := fs.Bool("dry-run", false, "only validate the rows, don't write anything")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("import: a file is required\n\n%v", usage)
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(path), ".")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rows, err := catalog.Read(*format, f)
+	if err != nil {
+		return err
+	}
+	ps, ns := newCatalogProductsService()
+	report, err := ps.Import(rows, *dryRun)
+	// The favorites are notified in the background
+	ns.Wait()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if report.Failed > 0 {
+		return fmt.Errorf("import: %d rows failed", report.Failed)
+	}
+	return nil
+}
+
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", catalog.FormatJSON, "file format, csv or json")
+	output := fs.String("o", "", "output file (default: standard output)")
+	fs.Parse(args)
+	ps, _ := newCatalogProductsService()
+	products, err := ps.All()
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return catalog.Write(*format, w, products)
+}
+
+func roleCommand(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("role: an email and a role are required\n\n%v", usage)
+	}
+	us := models.NewUserService(models.NewPurchaseService(), models.NewWishlistService(), newNotifier(), baseURL(), newSessionKeys(), newPasswordHasher(), newPasswordPolicy())
+	user, err := us.ByEmail(args[0])
+	if err != nil {
+		return err
+	}
+	if err := us.SetRole(user, args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("User %v is now %v\n", user.Email, user.Role)
+	return nil
+}
+
+// newCatalogProductsService creates the products service of the
+// commands. The notification service is returned so the commands
+// can wait for the notifications before exiting.
+func newCatalogProductsService() (models.ProductsService, models.NotificationService) {
+	notifier := newNotifier()
+	us := models.NewUserService(models.NewPurchaseService(), models.NewWishlistService(), notifier, baseURL(), newSessionKeys(), newPasswordHasher(), newPasswordPolicy())
+	ns := models.NewNotificationService(us, notifier)
+	return models.NewProductsService(models.NewCategoryService(), newBlobStore(), ns), ns
+}
@@ -7,7 +7,9 @@ import (
 )
 
 const (
-	userKey privateKey = "user"
+	userKey    privateKey = "user"
+	sessionKey privateKey = "session"
+	apiKeyKey  privateKey = "api_key"
 )
 
 type privateKey string
@@ -24,3 +26,31 @@ func User(ctx context.Context) *models.User {
 	}
 	return nil
 }
+
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+func Session(ctx context.Context) *models.Session {
+	if temp := ctx.Value(sessionKey); temp != nil {
+		if session, ok := temp.(*models.Session); ok {
+			return session
+		}
+	}
+	return nil
+}
+
+func WithAPIKey(ctx context.Context, key *models.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyKey, key)
+}
+
+// APIKey returns the API key of the request, nil if the user sent
+// an access token
+func APIKey(ctx context.Context) *models.APIKey {
+	if temp := ctx.Value(apiKeyKey); temp != nil {
+		if key, ok := temp.(*models.APIKey); ok {
+			return key
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jcamilom/ecommerce/models"
+)
+
+// NewCategories is used to create a new Categories controller
+func NewCategories(cs models.CategoryService) *Categories {
+	return &Categories{
+		cs: cs,
+	}
+}
+
+type Categories struct {
+	cs models.CategoryService
+}
+
+// Tree returns the category tree of the catalog
+//
+// GET /categories
+func (c *Categories) Tree(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	tree, err := c.cs.Tree()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(tree)
+}
+
+// Create creates a category of the catalog
+//
+// POST /admin/categories
+func (c *Categories) Create(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	category := new(models.Category)
+	err := json.NewDecoder(r.Body).Decode(category)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	err = c.cs.Create(category)
+	if err != nil {
+		c.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(category)
+}
+
+// Update renames a category or moves it under another parent
+//
+// PUT /admin/categories/{id}
+func (c *Categories) Update(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	category := new(models.Category)
+	err := json.NewDecoder(r.Body).Decode(category)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	category.ID = mux.Vars(r)["id"]
+	err = c.cs.Update(category)
+	if err != nil {
+		c.writeError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(category)
+}
+
+// Delete deletes a category without subcategories
+//
+// DELETE /admin/categories/{id}
+func (c *Categories) Delete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := c.cs.Delete(mux.Vars(r)["id"])
+	if err != nil {
+		c.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Categories) writeError(w http.ResponseWriter, err error) {
+	switch err {
+	case models.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: "Category not found",
+		})
+	case models.ErrCategoryIDRequired, models.ErrCategoryNameRequired, models.ErrCategoryParentInvalid:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: err.Error(),
+		})
+	case models.ErrCategoryExists, models.ErrCategoryNotEmpty:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: err.Error(),
+		})
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
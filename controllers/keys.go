@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jcamilom/ecommerce/session"
+)
+
+// NewKeys is used to create a new Keys controller. The keys may be
+// nil if the tokens are signed with an HMAC secret.
+func NewKeys(keys *session.KeySet) *Keys {
+	return &Keys{
+		keys: keys,
+	}
+}
+
+type Keys struct {
+	keys *session.KeySet
+}
+
+// JWKS returns the public keys the access tokens are signed with,
+// so other services can verify them
+//
+// GET /.well-known/jwks.json
+func (k *Keys) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	jwks := &session.JWKS{
+		Keys: []session.JWK{},
+	}
+	if k.keys != nil {
+		jwks = k.keys.JWKS()
+	}
+	json.NewEncoder(w).Encode(jwks)
+}
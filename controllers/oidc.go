@@ -0,0 +1,147 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jcamilom/ecommerce/middleware"
+	"github.com/jcamilom/ecommerce/models"
+	"github.com/jcamilom/ecommerce/oidc"
+)
+
+// Name of the cookie that binds a login with a provider to the
+// browser that started it
+const oidcStateCookie = "oidc_state"
+
+// NewOIDC is used to create a new OIDC controller. The state cookie
+// is only sent over HTTPS if secureCookies is set.
+func NewOIDC(os models.OIDCService, us models.UserService, secureCookies bool) *OIDC {
+	return &OIDC{
+		os:            os,
+		us:            us,
+		secureCookies: secureCookies,
+	}
+}
+
+// OIDC logs the users in with OpenID Connect providers
+type OIDC struct {
+	os            models.OIDCService
+	us            models.UserService
+	secureCookies bool
+}
+
+// Providers returns the names of the providers the users can log in
+// with
+//
+// GET /auth/providers
+func (o *OIDC) Providers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o.os.Providers())
+}
+
+// Login sends the user to the provider
+//
+// GET /auth/{provider}/login
+func (o *OIDC) Login(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	provider := mux.Vars(r)["provider"]
+	url, binding, err := o.os.AuthURL(provider)
+	if err != nil {
+		switch err {
+		case models.ErrProviderNotFound:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	o.setStateCookie(w, provider, binding, int(models.OIDCLoginExpireTime.Seconds()))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// Callback is where the provider sends the user back. The user is
+// logged in like with a password.
+//
+// GET /auth/{provider}/callback
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: "The provider denied the login: " + e,
+		})
+		return
+	}
+	provider := mux.Vars(r)["provider"]
+	var binding string
+	if cookie, err := r.Cookie(oidcStateCookie); err == nil {
+		binding = cookie.Value
+	}
+	// The state is spent either way
+	o.setStateCookie(w, provider, "", -1)
+	user, err := o.os.Login(provider, query.Get("state"), binding, query.Get("code"))
+	if err != nil {
+		switch err {
+		case models.ErrProviderNotFound:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		case models.ErrOIDCStateInvalid:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		case oidc.ErrIDTokenInvalid:
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		case models.ErrIdentityEmailNotVerified, models.ErrIdentityAccountNotVerified:
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	if requireMFA(w, o.us, user) {
+		return
+	}
+	tokens, err := o.us.StartSession(user, r.UserAgent(), middleware.ClientIP(r))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(&loginResponse{
+		messageResponse{Message: fmt.Sprintf("User %v authenticated successfully!", user.Name)},
+		tokens,
+	})
+}
+
+// setStateCookie keeps the binding of the login with the provider in
+// the browser, only for its callback. A negative maxAge deletes it.
+func (o *OIDC) setStateCookie(w http.ResponseWriter, provider, binding string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    binding,
+		Path:     "/auth/" + provider + "/callback",
+		MaxAge:   maxAge,
+		Secure:   o.secureCookies,
+		HttpOnly: true,
+		// Lax still sends it on the redirect back from the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -2,11 +2,16 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/jcamilom/ecommerce/catalog"
 	"github.com/jcamilom/ecommerce/context"
 	"github.com/jcamilom/ecommerce/models"
 )
@@ -24,24 +29,316 @@ type Products struct {
 	us models.UserService
 }
 
+// GetProduct returns a single product of the catalog
+//
+// GET /products/{id}
 func (p *Products) GetProduct(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	user := context.User(r.Context())
-	if user == nil {
-		log.Println("Error while fetching the user from the context")
-		w.WriteHeader(http.StatusInternalServerError)
+	vars := mux.Vars(r)
+	product, err := p.ps.ByID(vars["id"])
+	if err != nil {
+		if err == models.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	} else {
+		json.NewEncoder(w).Encode(product)
+	}
+}
+
+// List returns a page of the catalog. The products can be sorted
+// and filtered using the query parameters page, per_page,
+// sort (name, -name, price, -price, newest), min_price, max_price,
+// in_stock, category, tag (repeatable) and attr.<name>=<value>
+//
+// GET /products
+func (p *Products) List(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params, err := parseProductListParams(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+	p.list(w, params)
+}
+
+// ListByCategory returns a page of the products of the category
+// and its subcategories. It accepts the same query parameters
+// as List.
+//
+// GET /categories/{id}/products
+func (p *Products) ListByCategory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params, err := parseProductListParams(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: err.Error(),
+		})
 		return
 	}
+	params.Category = mux.Vars(r)["id"]
+	p.list(w, params)
+}
+
+func (p *Products) list(w http.ResponseWriter, params *models.ProductListParams) {
+	page, err := p.ps.List(params)
+	if err != nil {
+		switch err {
+		case models.ErrSortInvalid, models.ErrPriceRangeInvalid, models.ErrPageInvalid:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		case models.ErrNotFound:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: "Category not found",
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// Facets returns the number of products for every category, tag
+// and attribute value among the products matching the filters.
+// It accepts the same filter query parameters as List.
+//
+// GET /products/facets
+func (p *Products) Facets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params, err := parseProductListParams(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+	facets, err := p.ps.Facets(params)
+	if err != nil {
+		switch err {
+		case models.ErrPriceRangeInvalid:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		case models.ErrNotFound:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: "Category not found",
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(facets)
+}
+
+// Search returns the products matching the text query, the most
+// relevant first. The optional limit query parameter sets the max
+// number of products returned.
+//
+// GET /products/search?q=
+func (p *Products) Search(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	var limit int
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: "controllers: query parameter 'limit' must be a number",
+			})
+			return
+		}
+		limit = n
+	}
+	products, err := p.ps.Search(query.Get("q"), limit)
+	if err != nil {
+		switch err {
+		case models.ErrQueryRequired:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(products)
+}
+
+// AddImage uploads an image for the product. The image is sent in
+// the "image" field of a multipart form.
+//
+// POST /products/{id}/images
+func (p *Products) AddImage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	product, err := p.ps.ByID(mux.Vars(r)["id"])
+	if err != nil {
+		if err == models.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	// Leave some room for the rest of the multipart form
+	r.Body = http.MaxBytesReader(w, r.Body, models.MaxImageSize+1<<20)
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: "An image file is required in the 'image' field",
+		})
+		return
+	}
+	defer file.Close()
+	image, err := p.ps.AddImage(product, file)
+	if err != nil {
+		switch err {
+		case models.ErrImageInvalid, models.ErrImageTooLarge:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(image)
+}
+
+// RemoveImage deletes an image of the product
+//
+// DELETE /products/{id}/images/{imageID}
+func (p *Products) RemoveImage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 	vars := mux.Vars(r)
 	product, err := p.ps.ByID(vars["id"])
 	if err != nil {
 		if err == models.ErrNotFound {
 			w.WriteHeader(http.StatusNotFound)
 		} else {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	err = p.ps.RemoveImage(product, vars["imageID"])
+	if err != nil {
+		switch err {
+		case models.ErrImageNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Import creates or updates products from a CSV or JSON file sent
+// as the request body. The format is read from the format query
+// parameter or the Content-Type header. With dry_run=true the rows
+// are only validated. The response reports the result of every row.
+//
+// POST /admin/products/import
+func (p *Products) Import(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = formatFromContentType(r.Header.Get("Content-Type"))
+	}
+	var dryRun bool
+	if v := query.Get("dry_run"); v != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: "controllers: query parameter 'dry_run' must be a boolean",
+			})
+			return
+		}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, catalog.MaxFileSize)
+	rows, err := catalog.Read(format, r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: fmt.Sprintf("The file must be at most %v MB", catalog.MaxFileSize>>20),
+			})
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+	report, err := p.ps.Import(rows, dryRun)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Export downloads the whole catalog as CSV or JSON, depending
+// on the format query parameter. JSON is the default.
+//
+// GET /admin/products/export
+func (p *Products) Export(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = catalog.FormatJSON
+	}
+	if format != catalog.FormatCSV && format != catalog.FormatJSON {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: catalog.ErrFormatInvalid.Error(),
+		})
+		return
+	}
+	products, err := p.ps.All()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if format == catalog.FormatCSV {
+		w.Header().Set("Content-Type", "text/csv")
 	} else {
-		json.NewEncoder(w).Encode(product)
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=products.%v", format))
+	if err := catalog.Write(format, w, products); err != nil {
+		log.Println(err)
 	}
 }
 
@@ -100,6 +397,151 @@ func (p *Products) AddFavorite(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// parseProductListParams reads the listing options from the query
+// string. Missing values are left empty so the defaults are applied
+// by the products service.
+func parseProductListParams(query url.Values) (*models.ProductListParams, error) {
+	params := &models.ProductListParams{
+		Sort:       query.Get("sort"),
+		Category:   query.Get("category"),
+		Tags:       query["tag"],
+		Attributes: map[string]string{},
+	}
+	for key := range query {
+		if strings.HasPrefix(key, "attr.") {
+			params.Attributes[strings.TrimPrefix(key, "attr.")] = query.Get(key)
+		}
+	}
+	ints := []struct {
+		name string
+		dst  *int
+	}{
+		{"page", &params.Page},
+		{"per_page", &params.PerPage},
+		{"min_price", &params.MinPrice},
+		{"max_price", &params.MaxPrice},
+	}
+	for _, i := range ints {
+		v := query.Get(i.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("controllers: query parameter '%v' must be a number", i.name)
+		}
+		*i.dst = n
+	}
+	if v := query.Get("in_stock"); v != "" {
+		inStock, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("controllers: query parameter 'in_stock' must be a boolean")
+		}
+		params.InStock = inStock
+	}
+	return params, nil
+}
+
+func formatFromContentType(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "text/csv"):
+		return catalog.FormatCSV
+	case strings.HasPrefix(contentType, "application/json"):
+		return catalog.FormatJSON
+	default:
+		return ""
+	}
+}
+
+// GetFavorites is used to fetch the user favorite products along
+// with their current price and stock
+//
+// GET /users/favorites
+func (p *Products) GetFavorites(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	views, err := p.ps.FavoriteViews(user.Favorites)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(views)
+}
+
+// RemoveFavorite is used to remove a product from the user's
+// favorites list
+//
+// DELETE /users/favorites/{id}
+func (p *Products) RemoveFavorite(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err := p.us.RemoveFavorite(user, mux.Vars(r)["id"])
+	if err != nil {
+		switch err {
+		case models.ErrFavoriteNotFound:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReorderFavorites is used to change the order of the user's
+// favorites list. The body lists the product IDs in the new order.
+//
+// PUT /users/favorites/order
+func (p *Products) ReorderFavorites(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	fr := new(reorderFavoritesRequest)
+	err := json.NewDecoder(r.Body).Decode(fr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	err = p.us.ReorderFavorites(user, fr.IDs)
+	if err != nil {
+		switch err {
+		case models.ErrFavoritesOrderInvalid:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 type addFavoriteRequest struct {
 	ID string `json:"id"`
 }
+
+type reorderFavoritesRequest struct {
+	IDs []string `json:"ids"`
+}
@@ -5,23 +5,31 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/gorilla/mux"
 	"github.com/jcamilom/ecommerce/context"
+	"github.com/jcamilom/ecommerce/middleware"
 	"github.com/jcamilom/ecommerce/models"
 )
 
-// NewPurchases is used to create a new Purchases controller
-func NewPurchases(pus models.PurchaseService, ps models.ProductsService, us models.UserService) *Purchases {
+// NewPurchases is used to create a new Purchases controller. The
+// purchases above the stepUpAmount need a two-factor code if the
+// user has two-factor authentication.
+func NewPurchases(pus models.PurchaseService, ps models.ProductsService, us models.UserService, ws models.WishlistService, stepUpAmount int) *Purchases {
 	return &Purchases{
-		pus: pus,
-		ps:  ps,
-		us:  us,
+		pus:          pus,
+		ps:           ps,
+		us:           us,
+		ws:           ws,
+		stepUpAmount: stepUpAmount,
 	}
 }
 
 type Purchases struct {
-	pus models.PurchaseService
-	ps  models.ProductsService
-	us  models.UserService
+	pus          models.PurchaseService
+	ps           models.ProductsService
+	us           models.UserService
+	ws           models.WishlistService
+	stepUpAmount int
 }
 
 // Create registers a new purchase
@@ -45,6 +53,109 @@ func (p *Purchases) Create(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	purchase := &models.Purchase{
+		Email: user.Email,
+	}
+	if ok, _ := p.buy(w, r, user, pr, purchase); ok {
+		w.WriteHeader(http.StatusCreated)
+		log.Println("Purchase created")
+	}
+}
+
+// CreateGift registers the purchase of an item of a public wishlist
+// as a gift for the wishlist owner
+//
+// POST /wishlists/{slug}/purchases
+func (p *Purchases) CreateGift(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	pr := new(createPurchaseRequest)
+	err := json.NewDecoder(r.Body).Decode(pr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	if pr.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	wishlist, err := p.ws.BySlug(mux.Vars(r)["slug"])
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	if wishlist.Email == user.Email {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: "Items of your own wishlists can't be bought as gifts",
+		})
+		return
+	}
+	// The item is marked before paying so two buyers can't both
+	// pay for it
+	err = p.ws.MarkPurchased(wishlist, pr.ID, pr.SKU)
+	if err != nil {
+		switch err {
+		case models.ErrNotInWishlist:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		case models.ErrWishlistItemPurchased:
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	purchase := &models.Purchase{
+		Email:      user.Email,
+		Recipient:  wishlist.Email,
+		WishlistID: wishlist.ID,
+	}
+	ok, paid := p.buy(w, r, user, pr, purchase)
+	if !ok {
+		// Once paid the item stays marked, even if the purchase
+		// couldn't be registered
+		if paid {
+			return
+		}
+		if err := p.ws.UnmarkPurchased(wishlist, pr.ID, pr.SKU); err != nil {
+			log.Println("Unable to unmark the wishlist item as purchased:", err)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	log.Println("Gift purchase created")
+}
+
+// buy pays the product requested by the user and registers the
+// purchase, filling the item of the provided purchase. It returns
+// false if something fails, in which case the error response has
+// already been written, and whether the payment was made anyway.
+func (p *Purchases) buy(w http.ResponseWriter, r *http.Request, user *models.User, pr *createPurchaseRequest, purchase *models.Purchase) (ok, paid bool) {
+	if user.VerificationPending {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: models.ErrEmailNotVerified.Error(),
+		})
+		return false, false
+	}
 	product, err := p.ps.ByID(pr.ID)
 	if err != nil {
 		switch err {
@@ -57,43 +168,109 @@ func (p *Purchases) Create(w http.ResponseWriter, r *http.Request) {
 			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
-		return
+		return false, false
+	}
+	variant, err := product.Variant(pr.SKU)
+	if err != nil {
+		switch err {
+		case models.ErrVariantNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: err.Error(),
+		})
+		return false, false
+	}
+	if product.StockOf(variant) < 1 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: models.ErrOutOfStock.Error(),
+		})
+		return false, false
+	}
+	price := product.PriceOf(variant)
+	if user.TOTPEnabled && price > p.stepUpAmount {
+		err := p.us.StepUp(user, pr.TOTPCode, middleware.ClientIP(r))
+		if err != nil {
+			if lerr, ok := err.(*models.LockoutError); ok {
+				lockedOut(w, lerr)
+				return false, false
+			}
+			switch err {
+			case models.ErrTOTPCodeRequired, models.ErrTOTPCodeInvalid:
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(&mfaResponse{
+					messageResponse: messageResponse{Message: err.Error()},
+					MFARequired:     true,
+				})
+			default:
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			return false, false
+		}
 	}
 	balance, err := p.us.GetBalance(user)
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return false, false
 	}
-	if float64(product.Price) > balance {
+	if float64(price) > balance {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(&messageResponse{
 			Message: "Balance is not enough to execute the payment",
 		})
-		return
+		return false, false
+	}
+	// The item is taken from the stock before paying so two users
+	// can't pay for the last one
+	err = p.ps.AdjustStock(product, pr.SKU, -1)
+	if err != nil {
+		switch err {
+		case models.ErrOutOfStock:
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return false, false
 	}
-	err = p.us.ExecutePayment(user, product.Price)
+	err = p.us.ExecutePayment(user, price)
 	if err != nil {
 		log.Println(err)
+		if err := p.ps.AdjustStock(product, pr.SKU, 1); err != nil {
+			log.Println("Unable to return the item to the stock:", err)
+		}
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return false, false
 	}
-	purchase := &models.Purchase{
-		Email: user.Email,
-		ItemP: models.PurchaseItem{
-			ID:    product.ID,
-			NameP: product.Name,
-			Price: product.Price,
-		},
+	item := models.PurchaseItem{
+		ID:         product.ID,
+		NameP:      product.Name,
+		Price:      price,
+		Attributes: product.Attributes,
+	}
+	if variant != nil {
+		item.SKU = variant.SKU
+		item.Variant = variant.Name
+		item.Attributes = append(append([]models.Attribute{}, product.Attributes...), variant.Attributes...)
 	}
+	purchase.ItemP = item
 	err = p.pus.Create(purchase)
 	if err != nil {
-		log.Println(err)
+		// The lumens were already moved, log the purchase so it
+		// can be registered by hand
+		log.Printf("Unable to register the paid purchase %+v: %v\n", purchase, err)
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return false, true
 	}
-	w.WriteHeader(http.StatusCreated)
-	log.Println("Purchase created")
+	return true, true
 }
 
 // Get fetchs the purchases for a specific user
@@ -117,5 +294,9 @@ func (p *Purchases) Get(w http.ResponseWriter, r *http.Request) {
 }
 
 type createPurchaseRequest struct {
-	ID string `json:"id"`
+	ID  string `json:"id"`
+	SKU string `json:"sku"`
+	// TOTPCode is required above the step-up amount for the users
+	// with two-factor authentication
+	TOTPCode string `json:"totp_code"`
 }
@@ -1,12 +1,20 @@
 package controllers
 
 import (
+	"archive/zip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/jcamilom/ecommerce/context"
+	"github.com/jcamilom/ecommerce/middleware"
 	"github.com/jcamilom/ecommerce/models"
 )
 
@@ -41,65 +49,764 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		Password: ur.Password,
 	}
 	err = u.us.Register(&user)
+	if perr, ok := err.(*models.PasswordPolicyError); ok {
+		passwordRejected(w, perr, "password")
+		return
+	}
+	if err != nil {
+		switch err {
+		case models.ErrEmailRequired, models.ErrEmailInvalid, models.ErrEmailTaken, models.ErrPasswordRequired, models.ErrNameRequired:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	tokens := u.startSession(w, r, &user)
+	if tokens == nil {
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&loginResponse{
+		messageResponse{Message: fmt.Sprintf("User %v created!", user.Name)},
+		tokens,
+	})
+}
+
+// Login is used to verify the provided email address and
+// password and in the db.
+//
+// POST /login
+func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ur := new(loginUserRequest)
+	err := json.NewDecoder(r.Body).Decode(ur)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	if ur.Email == "" || ur.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	user, err := u.us.Authenticate(ur.Email, ur.Password, middleware.ClientIP(r))
+	if lerr, ok := err.(*models.LockoutError); ok {
+		lockedOut(w, lerr)
+		return
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound, models.ErrPasswordIncorrect:
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: "Wrong email - password combination",
+			})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	if requireMFA(w, u.us, user) {
+		return
+	}
+	tokens := u.startSession(w, r, user)
+	if tokens == nil {
+		return
+	}
+	json.NewEncoder(w).Encode(&loginResponse{
+		messageResponse{Message: fmt.Sprintf("User %v authenticated successfully!", user.Name)},
+		tokens,
+	})
+}
+
+// LoginMFA is the second login step of the users with two-factor
+// authentication. The token of the first step is sent with a code
+// of the authenticator app or a recovery code.
+//
+// POST /login/2fa
+func (u *Users) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	mr := new(loginMFARequest)
+	err := json.NewDecoder(r.Body).Decode(mr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	user, err := u.us.CompleteMFA(mr.MFAToken, mr.Code, middleware.ClientIP(r))
+	if lerr, ok := err.(*models.LockoutError); ok {
+		lockedOut(w, lerr)
+		return
+	}
+	if err != nil {
+		switch err {
+		case models.ErrMFATokenInvalid, models.ErrTOTPCodeRequired, models.ErrTOTPCodeInvalid:
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	tokens := u.startSession(w, r, user)
+	if tokens == nil {
+		return
+	}
+	json.NewEncoder(w).Encode(&loginResponse{
+		messageResponse{Message: fmt.Sprintf("User %v authenticated successfully!", user.Name)},
+		tokens,
+	})
+}
+
+// lockedOut answers a login that has to wait after too many failed
+// logins
+func lockedOut(w http.ResponseWriter, err *models.LockoutError) {
+	wait := int(math.Ceil(time.Until(err.Until).Seconds()))
+	if wait < 1 {
+		wait = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(wait))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(&messageResponse{
+		Message: err.Error(),
+	})
+}
+
+// passwordRejected answers a request with a password that doesn't
+// meet the password policy, listing the problems of the field
+func passwordRejected(w http.ResponseWriter, err *models.PasswordPolicyError, field string) {
+	errs := make([]fieldError, len(err.Problems))
+	for i, p := range err.Problems {
+		errs[i] = fieldError{
+			Field:   field,
+			Code:    p.Code,
+			Message: p.Message,
+		}
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(&validationResponse{
+		messageResponse: messageResponse{Message: "The password doesn't meet the password policy"},
+		Errors:          errs,
+	})
+}
+
+// requireMFA answers with the token of the second login step if the
+// user has two-factor authentication, in which case true is
+// returned and the session must not start yet.
+func requireMFA(w http.ResponseWriter, us models.UserService, user *models.User) bool {
+	if !user.TOTPEnabled {
+		return false
+	}
+	token, err := us.StartMFA(user)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	json.NewEncoder(w).Encode(&mfaResponse{
+		messageResponse: messageResponse{Message: "Two-factor code required, send it to /login/2fa"},
+		MFARequired:     true,
+		MFAToken:        token,
+	})
+	return true
+}
+
+// Refresh returns a new access token for the refresh token. The
+// refresh token is replaced, the old one can't be used again.
+//
+// POST /token/refresh
+func (u *Users) Refresh(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rr := new(refreshRequest)
+	err := json.NewDecoder(r.Body).Decode(rr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	tokens, err := u.us.Refresh(rr.RefreshToken)
+	if err != nil {
+		switch err {
+		case models.ErrRefreshTokenInvalid:
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(&loginResponse{
+		messageResponse{Message: "Token refreshed"},
+		tokens,
+	})
+}
+
+// Logout revokes the token of the request and ends its session.
+// With all=true the user is logged out of every device.
+//
+// POST /logout
+func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	everywhere := r.URL.Query().Get("all") == "true"
+	err := u.us.Logout(middleware.BearerToken(r), everywhere)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetSessions returns the devices where the user is logged in
+//
+// GET /users/me/sessions
+func (u *Users) GetSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	current := context.Session(r.Context())
+	if user == nil || current == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sessions, err := u.us.Sessions(user)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := []sessionResponse{}
+	for _, s := range sessions {
+		resp = append(resp, sessionResponse{
+			ID:         s.ID,
+			Device:     s.Device,
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt,
+			LastUsedAt: s.LastUsedAt,
+			Current:    s.ID == current.ID,
+		})
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// RevokeSession logs the user out of a device
+//
+// DELETE /users/me/sessions/{id}
+func (u *Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err := u.us.RevokeSession(user, mux.Vars(r)["id"])
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeSessions logs the user out of every device but the one
+// of the request
+//
+// DELETE /users/me/sessions
+func (u *Users) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	current := context.Session(r.Context())
+	if user == nil || current == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err := u.us.RevokeSessions(user, current.ID)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetAPIKeys returns the API keys of the user, without the secrets
+//
+// GET /users/me/api-keys
+func (u *Users) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	keys, err := u.us.APIKeys(user)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := []apiKeyResponse{}
+	for i := range keys {
+		resp = append(resp, newAPIKeyResponse(&keys[i]))
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// CreateAPIKey creates an API key for the user. The key is only
+// returned this time.
+//
+// POST /users/me/api-keys
+func (u *Users) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	kr := new(apiKeyRequest)
+	err := json.NewDecoder(r.Body).Decode(kr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	key, secret, err := u.us.CreateAPIKey(user, kr.Name, kr.Scopes, kr.ExpiresAt)
+	if err != nil {
+		switch err {
+		case models.ErrAPIKeyNameRequired, models.ErrAPIKeyScopeInvalid, models.ErrAPIKeyExpiryInvalid:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	resp := createAPIKeyResponse{
+		apiKeyResponse: newAPIKeyResponse(key),
+		Key:            secret,
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// RevokeAPIKey deletes an API key of the user
+//
+// DELETE /users/me/api-keys/{id}
+func (u *Users) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err := u.us.RevokeAPIKey(user, mux.Vars(r)["id"])
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EnrollTOTP starts the two-factor enrollment. The secret is
+// returned with a QR code for the authenticator app, as a base64 PNG.
+//
+// POST /users/me/2fa
+func (u *Users) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	enrollment, err := u.us.EnrollTOTP(user)
+	if err != nil {
+		switch err {
+		case models.ErrTOTPAlreadyEnabled:
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+// ConfirmTOTP enables two-factor authentication with the first code
+// of the authenticator app. The recovery codes are only returned
+// this time.
+//
+// POST /users/me/2fa/confirm
+func (u *Users) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	tr := new(twoFactorRequest)
+	err := json.NewDecoder(r.Body).Decode(tr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	codes, err := u.us.ConfirmTOTP(user, tr.Code)
+	if err != nil {
+		switch err {
+		case models.ErrTOTPAlreadyEnabled:
+			w.WriteHeader(http.StatusConflict)
+		case models.ErrTOTPNotEnrolled, models.ErrTOTPCodeInvalid:
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(&recoveryCodesResponse{
+		messageResponse: messageResponse{Message: "Two-factor authentication enabled"},
+		RecoveryCodes:   codes,
+	})
+}
+
+// DisableTOTP turns two-factor authentication off. The password and
+// a code are required.
+//
+// DELETE /users/me/2fa
+func (u *Users) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	tr := new(twoFactorRequest)
+	err := json.NewDecoder(r.Body).Decode(tr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	err = u.us.DisableTOTP(user, tr.Password, tr.Code, middleware.ClientIP(r))
+	if err != nil {
+		if lerr, ok := err.(*models.LockoutError); ok {
+			lockedOut(w, lerr)
+			return
+		}
+		switch err {
+		case models.ErrTOTPNotEnabled:
+			w.WriteHeader(http.StatusConflict)
+		case models.ErrPasswordIncorrect, models.ErrTOTPCodeRequired, models.ErrTOTPCodeInvalid:
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user.
+// A code is required.
+//
+// POST /users/me/2fa/recovery-codes
+func (u *Users) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	tr := new(twoFactorRequest)
+	err := json.NewDecoder(r.Body).Decode(tr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	codes, err := u.us.RegenerateRecoveryCodes(user, tr.Code, middleware.ClientIP(r))
+	if err != nil {
+		if lerr, ok := err.(*models.LockoutError); ok {
+			lockedOut(w, lerr)
+			return
+		}
+		switch err {
+		case models.ErrTOTPNotEnabled:
+			w.WriteHeader(http.StatusConflict)
+		case models.ErrTOTPCodeRequired, models.ErrTOTPCodeInvalid:
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(&recoveryCodesResponse{
+		messageResponse: messageResponse{Message: "Recovery codes replaced"},
+		RecoveryCodes:   codes,
+	})
+}
+
+// startSession starts a session for the user on the device of the
+// request. If it fails the error response is written and nil is
+// returned.
+func (u *Users) startSession(w http.ResponseWriter, r *http.Request, user *models.User) *models.Tokens {
+	tokens, err := u.us.StartSession(user, r.UserAgent(), middleware.ClientIP(r))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	return tokens
+}
+
+// DeleteAccount deletes the user. The lumens of the wallet are sent
+// to the address of the request, or to the store if it is empty.
+//
+// DELETE /users/me
+func (u *Users) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	dr := new(deleteAccountRequest)
+	err := json.NewDecoder(r.Body).Decode(dr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	err = u.us.DeleteAccount(user, dr.Password, dr.Address, middleware.ClientIP(r))
+	if err != nil {
+		if lerr, ok := err.(*models.LockoutError); ok {
+			lockedOut(w, lerr)
+			return
+		}
+		switch err {
+		case models.ErrAddressInvalid:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		case models.ErrPasswordIncorrect:
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Export returns every data stored about the user as a JSON file,
+// or as a zip with a JSON file per section with format=zip.
+//
+// GET /users/me/export
+func (u *Users) Export(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	export, err := u.us.Export(user)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="export.json"`)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(export)
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="export.zip"`)
+		if err := writeExportZip(w, export); err != nil {
+			log.Println(err)
+		}
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: "Format must be json or zip",
+		})
+	}
+}
+
+// writeExportZip writes the export as a zip with the profile,
+// favorites, purchases, wishlists and identities in separate files
+func writeExportZip(w io.Writer, export *models.UserExport) error {
+	zw := zip.NewWriter(w)
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", &exportProfile{
+			ID:                export.ID,
+			Name:              export.Name,
+			Email:             export.Email,
+			Verified:          export.Verified,
+			Address:           export.Address,
+			NotificationPrefs: export.NotificationPrefs,
+			ExportedAt:        export.ExportedAt,
+		}},
+		{"favorites.json", export.Favorites},
+		{"purchases.json", export.Purchases},
+		{"wishlists.json", export.Wishlists},
+		{"identities.json", export.Identities},
+	}
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// VerifyEmail confirms the email of a user with the token of the
+// link sent by email
+//
+// GET /users/verify?token=
+func (u *Users) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user, err := u.us.VerifyEmail(r.URL.Query().Get("token"))
 	if err != nil {
 		switch err {
-		case models.ErrEmailRequired, models.ErrEmailInvalid, models.ErrEmailTaken, models.ErrPasswordRequired, models.ErrPasswordTooShort, models.ErrNameRequired:
+		case models.ErrVerificationTokenInvalid:
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(&messageResponse{
 				Message: err.Error(),
 			})
 		default:
+			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(&loginResponse{
-		messageResponse{Message: fmt.Sprintf("User %v created!", user.Name)},
-		user.AccessToken,
+	json.NewEncoder(w).Encode(&messageResponse{
+		Message: fmt.Sprintf("Email %v verified", user.Email),
 	})
 }
 
-// Login is used to verify the provided email address and
-// password and in the db.
+// ConfirmEmailChange changes the email of a user with the token of
+// the link sent to the new email. The user has to log in again.
 //
-// POST /login
-func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
+// GET /users/email/confirm?token=
+func (u *Users) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	ur := new(loginUserRequest)
-	err := json.NewDecoder(r.Body).Decode(ur)
+	user, err := u.us.ConfirmEmailChange(r.URL.Query().Get("token"))
 	if err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return
-	}
-	if ur.Email == "" || ur.Password == "" {
-		w.WriteHeader(http.StatusBadRequest)
+		switch err {
+		case models.ErrEmailChangeTokenInvalid:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		case models.ErrEmailTaken:
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 		return
 	}
+	json.NewEncoder(w).Encode(&messageResponse{
+		Message: fmt.Sprintf("Email changed to %v, log in again", user.Email),
+	})
+}
 
-	user, err := u.us.Authenticate(ur.Email, ur.Password)
+// Unlock forgets the failed logins of a user with the token of the
+// link sent by email when the account was locked
+//
+// GET /users/unlock?token=
+func (u *Users) Unlock(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user, err := u.us.UnlockAccount(r.URL.Query().Get("token"))
 	if err != nil {
 		switch err {
-		case models.ErrNotFound, models.ErrPasswordIncorrect:
-			w.WriteHeader(http.StatusUnauthorized)
+		case models.ErrUnlockTokenInvalid:
+			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(&messageResponse{
-				Message: "Wrong email - password combination",
+				Message: err.Error(),
 			})
 		default:
+			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 		return
 	}
-	json.NewEncoder(w).Encode(&loginResponse{
-		messageResponse{Message: fmt.Sprintf("User %v authenticated successfully!", user.Name)},
-		user.AccessToken,
+	json.NewEncoder(w).Encode(&messageResponse{
+		Message: fmt.Sprintf("Account %v unlocked", user.Email),
 	})
 }
 
-// GetFavorites is used to fetch the user favorite products
+// ResendVerification sends the verification email again
 //
-// GET /users/favorites
-func (u *Users) GetFavorites(w http.ResponseWriter, r *http.Request) {
+// POST /users/me/verification
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	user := context.User(r.Context())
 	if user == nil {
@@ -107,7 +814,92 @@ func (u *Users) GetFavorites(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(user.Favorites)
+	err := u.us.ResendVerification(user)
+	if err != nil {
+		switch err {
+		case models.ErrEmailAlreadyVerified:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		case models.ErrVerificationTooSoon:
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(&messageResponse{
+		Message: fmt.Sprintf("Verification email sent to %v", user.Email),
+	})
+}
+
+// ForgotPassword emails a password reset token to the user. The
+// response is the same whether the email is registered or not.
+//
+// POST /password/forgot
+func (u *Users) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fr := new(forgotPasswordRequest)
+	err := json.NewDecoder(r.Body).Decode(fr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	if fr.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = u.us.ForgotPassword(fr.Email)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(&messageResponse{
+		Message: "If the email is registered a reset token was sent to it",
+	})
+}
+
+// ResetPassword sets a new password with a reset token. The user
+// must log in again afterwards.
+//
+// POST /password/reset
+func (u *Users) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rr := new(resetPasswordRequest)
+	err := json.NewDecoder(r.Body).Decode(rr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	err = u.us.ResetPassword(rr.Token, rr.Password)
+	if perr, ok := err.(*models.PasswordPolicyError); ok {
+		passwordRejected(w, perr, "password")
+		return
+	}
+	if err != nil {
+		switch err {
+		case models.ErrResetTokenInvalid, models.ErrPasswordRequired:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(&messageResponse{
+		Message: "Password changed, log in again",
+	})
 }
 
 // GetBalance returns the users wallet balance
@@ -131,6 +923,177 @@ func (u *Users) GetBalance(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// GetProfile returns the profile of the user
+//
+// GET /users/me
+func (u *Users) GetProfile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(newProfileResponse(user))
+}
+
+// UpdateProfile changes the name or the email of the user. The
+// current password is required to change the email, which only
+// changes once the link sent to the new email is opened.
+//
+// PATCH /users/me
+func (u *Users) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	pr := new(updateProfileRequest)
+	err := json.NewDecoder(r.Body).Decode(pr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	if pr.Name != nil {
+		err = u.us.UpdateName(user, *pr.Name)
+	}
+	if err == nil && pr.Email != nil {
+		err = u.us.ChangeEmail(user, *pr.Email, pr.Password, middleware.ClientIP(r))
+	}
+	if err != nil {
+		if lerr, ok := err.(*models.LockoutError); ok {
+			lockedOut(w, lerr)
+			return
+		}
+		switch err {
+		case models.ErrNameRequired, models.ErrEmailRequired, models.ErrEmailInvalid, models.ErrEmailTaken:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		case models.ErrPasswordIncorrect:
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	resp := newProfileResponse(user)
+	resp.EmailChangePending = pr.Email != nil && !strings.EqualFold(strings.TrimSpace(*pr.Email), user.Email)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ChangePassword sets a new password for the user. The current
+// password is required and a new token is returned.
+//
+// POST /users/me/password
+func (u *Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	pr := new(changePasswordRequest)
+	err := json.NewDecoder(r.Body).Decode(pr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	err = u.us.ChangePassword(user, pr.CurrentPassword, pr.NewPassword, middleware.ClientIP(r))
+	if perr, ok := err.(*models.PasswordPolicyError); ok {
+		passwordRejected(w, perr, "new_password")
+		return
+	}
+	if lerr, ok := err.(*models.LockoutError); ok {
+		lockedOut(w, lerr)
+		return
+	}
+	if err != nil {
+		switch err {
+		case models.ErrPasswordRequired:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		case models.ErrPasswordIncorrect:
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	// Every session was revoked
+	tokens := u.startSession(w, r, user)
+	if tokens == nil {
+		return
+	}
+	json.NewEncoder(w).Encode(&loginResponse{
+		messageResponse{Message: "Password changed"},
+		tokens,
+	})
+}
+
+// GetNotificationPrefs returns the notifications the user gets
+// about the favorites
+//
+// GET /users/notifications
+func (u *Users) GetNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(user.NotificationPrefsOrDefault())
+}
+
+// UpdateNotificationPrefs changes the notifications the user gets
+// about the favorites. Fields left out keep their value.
+//
+// PUT /users/notifications
+func (u *Users) UpdateNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	nr := new(notificationPrefsRequest)
+	err := json.NewDecoder(r.Body).Decode(nr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	prefs := user.NotificationPrefsOrDefault()
+	if nr.PriceDrop != nil {
+		prefs.PriceDrop = *nr.PriceDrop
+	}
+	if nr.BackInStock != nil {
+		prefs.BackInStock = *nr.BackInStock
+	}
+	err = u.us.UpdateNotificationPrefs(user, prefs)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(user.NotificationPrefsOrDefault())
+}
+
 // GetStoreBalance returns the balance of the e-commerce in the
 // stellar network
 //
@@ -163,11 +1126,171 @@ type loginUserRequest struct {
 	Password string `json:"password"`
 }
 
+// updateProfileRequest is used to update the profile. Fields
+// left out keep their value.
+type updateProfileRequest struct {
+	Name     *string `json:"name"`
+	Email    *string `json:"email"`
+	Password string  `json:"password"`
+}
+
+type deleteAccountRequest struct {
+	Password string `json:"password"`
+	// Stellar address to send the lumens to
+	Address string `json:"address"`
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// profileResponse is the user without the secrets
+type profileResponse struct {
+	ID                string                   `json:"id"`
+	Name              string                   `json:"name"`
+	Email             string                   `json:"email"`
+	Role              string                   `json:"role"`
+	Address           string                   `json:"address"`
+	Favorites         []models.Favorite        `json:"favorites"`
+	NotificationPrefs models.NotificationPrefs `json:"notification_prefs"`
+	Verified          bool                     `json:"verified"`
+	TwoFactorEnabled  bool                     `json:"two_factor_enabled"`
+	// EmailChangePending is set when a link to confirm a new email
+	// was just sent
+	EmailChangePending bool `json:"email_change_pending,omitempty"`
+}
+
+func newProfileResponse(user *models.User) *profileResponse {
+	return &profileResponse{
+		ID:                user.ID,
+		Name:              user.Name,
+		Email:             user.Email,
+		Role:              user.RoleOrDefault(),
+		Address:           user.Wallet.Address,
+		Favorites:         user.Favorites,
+		NotificationPrefs: user.NotificationPrefsOrDefault(),
+		Verified:          !user.VerificationPending,
+		TwoFactorEnabled:  user.TOTPEnabled,
+	}
+}
+
+// exportProfile is the profile file of the zip exports
+type exportProfile struct {
+	ID                string                   `json:"id"`
+	Name              string                   `json:"name"`
+	Email             string                   `json:"email"`
+	Verified          bool                     `json:"verified"`
+	Address           string                   `json:"address"`
+	NotificationPrefs models.NotificationPrefs `json:"notification_prefs"`
+	ExportedAt        time.Time                `json:"exported_at"`
+}
+
+type notificationPrefsRequest struct {
+	PriceDrop   *bool `json:"price_drop"`
+	BackInStock *bool `json:"back_in_stock"`
+}
+
 type messageResponse struct {
 	Message string `json:"message"`
 }
 
+type validationResponse struct {
+	messageResponse
+	Errors []fieldError `json:"errors"`
+}
+
+// fieldError is a problem of a field of the request
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type loginMFARequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+type mfaResponse struct {
+	messageResponse
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token,omitempty"`
+}
+
+type twoFactorRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type recoveryCodesResponse struct {
+	messageResponse
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
 type loginResponse struct {
 	messageResponse
-	Token string `json:"token"`
+	*models.Tokens
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type apiKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresAt is optional, the key never expires without it
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type apiKeyResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// newAPIKeyResponse leaves the times that weren't set as null
+func newAPIKeyResponse(key *models.APIKey) apiKeyResponse {
+	resp := apiKeyResponse{
+		ID:        key.ID,
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt,
+	}
+	if !key.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &key.ExpiresAt
+	}
+	if !key.LastUsedAt.IsZero() {
+		resp.LastUsedAt = &key.LastUsedAt
+	}
+	return resp
+}
+
+type createAPIKeyResponse struct {
+	apiKeyResponse
+	Key string `json:"key"`
+}
+
+type sessionResponse struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Current    bool      `json:"current"`
 }
@@ -0,0 +1,319 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jcamilom/ecommerce/context"
+	"github.com/jcamilom/ecommerce/models"
+)
+
+// NewWishlists is used to create a new Wishlists controller
+func NewWishlists(ws models.WishlistService, ps models.ProductsService) *Wishlists {
+	return &Wishlists{
+		ws: ws,
+		ps: ps,
+	}
+}
+
+type Wishlists struct {
+	ws models.WishlistService
+	ps models.ProductsService
+}
+
+// List returns the wishlists of the user
+//
+// GET /users/wishlists
+func (wc *Wishlists) List(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	wishlists, err := wc.ws.ByEmail(user.Email)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(wishlists)
+}
+
+// Create creates a new wishlist for the user
+//
+// POST /users/wishlists
+func (wc *Wishlists) Create(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	wr := new(wishlistRequest)
+	err := json.NewDecoder(r.Body).Decode(wr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	wishlist := &models.Wishlist{
+		Email: user.Email,
+	}
+	if wr.Name != nil {
+		wishlist.Name = *wr.Name
+	}
+	if wr.Public != nil {
+		wishlist.Public = *wr.Public
+	}
+	err = wc.ws.Create(wishlist)
+	if err != nil {
+		switch err {
+		case models.ErrWishlistNameRequired:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(wishlist)
+}
+
+// Get returns a wishlist of the user
+//
+// GET /users/wishlists/{id}
+func (wc *Wishlists) Get(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	wishlist := wc.wishlistOf(w, r)
+	if wishlist == nil {
+		return
+	}
+	json.NewEncoder(w).Encode(wishlist)
+}
+
+// Update renames the wishlist or changes its visibility. The share
+// slug is created the first time the wishlist is made public.
+//
+// PATCH /users/wishlists/{id}
+func (wc *Wishlists) Update(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	wishlist := wc.wishlistOf(w, r)
+	if wishlist == nil {
+		return
+	}
+	wr := new(wishlistRequest)
+	err := json.NewDecoder(r.Body).Decode(wr)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	if wr.Name != nil {
+		wishlist.Name = *wr.Name
+	}
+	if wr.Public != nil {
+		wishlist.Public = *wr.Public
+	}
+	err = wc.ws.Update(wishlist)
+	if err != nil {
+		switch err {
+		case models.ErrWishlistNameRequired:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		case models.ErrNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(wishlist)
+}
+
+// Delete deletes a wishlist of the user
+//
+// DELETE /users/wishlists/{id}
+func (wc *Wishlists) Delete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	wishlist := wc.wishlistOf(w, r)
+	if wishlist == nil {
+		return
+	}
+	err := wc.ws.Delete(wishlist.Email, wishlist.ID)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AddItem adds a product, or a variant of it, to the wishlist
+//
+// POST /users/wishlists/{id}/items
+func (wc *Wishlists) AddItem(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	wishlist := wc.wishlistOf(w, r)
+	if wishlist == nil {
+		return
+	}
+	ir := new(createPurchaseRequest)
+	err := json.NewDecoder(r.Body).Decode(ir)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	if ir.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	product, err := wc.ps.ByID(ir.ID)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: "Product not found at the store's stock",
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	variant, err := product.Variant(ir.SKU)
+	if err != nil {
+		switch err {
+		case models.ErrVariantNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: err.Error(),
+		})
+		return
+	}
+	item := models.WishlistItem{
+		ID:    product.ID,
+		Name:  product.Name,
+		Price: product.PriceOf(variant),
+	}
+	if variant != nil {
+		item.SKU = variant.SKU
+		item.Name = product.Name + " - " + variant.Name
+	}
+	err = wc.ws.AddItem(wishlist, item)
+	if err != nil {
+		switch err {
+		case models.ErrIsInWishlist:
+			w.WriteHeader(http.StatusNotModified)
+		case models.ErrNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(wishlist)
+}
+
+// RemoveItem removes a product from the wishlist. The variant is
+// chosen with the sku query parameter.
+//
+// DELETE /users/wishlists/{id}/items/{productID}
+func (wc *Wishlists) RemoveItem(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	wishlist := wc.wishlistOf(w, r)
+	if wishlist == nil {
+		return
+	}
+	err := wc.ws.RemoveItem(wishlist, mux.Vars(r)["productID"], r.URL.Query().Get("sku"))
+	if err != nil {
+		switch err {
+		case models.ErrNotInWishlist:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetShared returns a public wishlist by its share slug. The owner
+// email is not disclosed.
+//
+// GET /wishlists/{slug}
+func (wc *Wishlists) GetShared(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	wishlist, err := wc.ws.BySlug(mux.Vars(r)["slug"])
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(&sharedWishlistResponse{
+		Name:  wishlist.Name,
+		Slug:  wishlist.Slug,
+		Items: wishlist.Items,
+	})
+}
+
+// wishlistOf returns the wishlist of the {id} route variable owned by
+// the user of the context. If it can't be found the error response
+// is written and nil is returned.
+func (wc *Wishlists) wishlistOf(w http.ResponseWriter, r *http.Request) *models.Wishlist {
+	user := context.User(r.Context())
+	if user == nil {
+		log.Println("Error while fetching the user from the context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	wishlist, err := wc.ws.ByID(user.Email, mux.Vars(r)["id"])
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return nil
+	}
+	return wishlist
+}
+
+// wishlistRequest is used to create and update wishlists. Fields
+// left out of an update keep their value.
+type wishlistRequest struct {
+	Name   *string `json:"name"`
+	Public *bool   `json:"public"`
+}
+
+type sharedWishlistResponse struct {
+	Name  string                `json:"name"`
+	Slug  string                `json:"slug"`
+	Items []models.WishlistItem `json:"items"`
+}
@@ -1,10 +1,12 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 	"log"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
@@ -12,6 +14,10 @@ import (
 
 var _db = dynamodb.New(session.New(), aws.NewConfig().WithRegion("us-east-1"))
 
+// ErrConditionFailed is returned when the condition of a
+// conditional write is not met
+var ErrConditionFailed = errors.New("db: condition failed")
+
 // DB is the service to interact with the database
 type DB struct{}
 
@@ -63,8 +69,66 @@ func (db *DB) PutItem(tableName string, item interface{}) error {
 	return err
 }
 
+// ConditionalPutItem adds a new record to db only if the condition
+// expression is met. Otherwise ErrConditionFailed is returned.
+func (db *DB) ConditionalPutItem(tableName string, item interface{}, condExp string) error {
+	av, err := dynamodbattribute.MarshalMap(item)
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to DynamoDB marshal Record, %v", err))
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                av,
+		ConditionExpression: aws.String(condExp),
+	}
+	_, err = _db.PutItem(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrConditionFailed
+	}
+	return err
+}
+
 // UpdateItem update an specific item in the db
 func (db *DB) UpdateItem(tableName string, key interface{}, update interface{}, updateExp string) error {
+	return db.UpdateItemWithNames(tableName, key, update, updateExp, nil)
+}
+
+// UpdateItemWithNames update an specific item in the db. The attribute
+// names are needed when the update uses reserved words, like name.
+func (db *DB) UpdateItemWithNames(tableName string, key interface{}, update interface{}, updateExp string, expAttNames map[string]*string) error {
+	_key, err := dynamodbattribute.MarshalMap(key)
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to DynamoDB marshal update key, %v", err))
+		return err
+	}
+	_update, err := dynamodbattribute.MarshalMap(update)
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to DynamoDB marshal update value, %v", err))
+		return err
+	}
+	input := &dynamodb.UpdateItemInput{
+		Key:                       _key,
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          aws.String(updateExp),
+		ExpressionAttributeNames:  expAttNames,
+		ExpressionAttributeValues: _update,
+		ReturnValues:              aws.String("UPDATED_NEW"),
+	}
+
+	_, err = _db.UpdateItem(input)
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to DynamoDB update item, %v", err))
+		return err
+	}
+	return nil
+}
+
+// ConditionalUpdateItem update an specific item in the db only if the
+// condition expression is met. Otherwise ErrConditionFailed is returned.
+// The update values are used for both the update and the condition.
+func (db *DB) ConditionalUpdateItem(tableName string, key interface{}, update interface{}, updateExp string, condExp string) error {
 	_key, err := dynamodbattribute.MarshalMap(key)
 	if err != nil {
 		log.Println(fmt.Sprintf("failed to DynamoDB marshal update key, %v", err))
@@ -79,37 +143,217 @@ func (db *DB) UpdateItem(tableName string, key interface{}, update interface{},
 		Key:                       _key,
 		TableName:                 aws.String(tableName),
 		UpdateExpression:          aws.String(updateExp),
+		ConditionExpression:       aws.String(condExp),
 		ExpressionAttributeValues: _update,
 		ReturnValues:              aws.String("UPDATED_NEW"),
 	}
 
 	_, err = _db.UpdateItem(input)
 	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrConditionFailed
+		}
 		log.Println(fmt.Sprintf("failed to DynamoDB update item, %v", err))
 		return err
 	}
 	return nil
 }
 
+// UpdateItemReturning update an specific item in the db and reads the
+// item as it is after the update into dst. The condition expression
+// and attribute names are optional, ErrConditionFailed is returned if
+// the condition isn't met.
+func (db *DB) UpdateItemReturning(tableName string, key interface{}, update interface{}, updateExp string, condExp string, expAttNames map[string]*string, dst interface{}) error {
+	_key, err := dynamodbattribute.MarshalMap(key)
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to DynamoDB marshal update key, %v", err))
+		return err
+	}
+	_update, err := dynamodbattribute.MarshalMap(update)
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to DynamoDB marshal update value, %v", err))
+		return err
+	}
+	input := &dynamodb.UpdateItemInput{
+		Key:                       _key,
+		TableName:                 aws.String(tableName),
+		UpdateExpression:          aws.String(updateExp),
+		ExpressionAttributeNames:  expAttNames,
+		ExpressionAttributeValues: _update,
+		ReturnValues:              aws.String("ALL_NEW"),
+	}
+	if condExp != "" {
+		input.ConditionExpression = aws.String(condExp)
+	}
+
+	result, err := _db.UpdateItem(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrConditionFailed
+		}
+		log.Println(fmt.Sprintf("failed to DynamoDB update item, %v", err))
+		return err
+	}
+	return dynamodbattribute.UnmarshalMap(result.Attributes, dst)
+}
+
+// QueryIndex gets the items of a global secondary index matching
+// the key condition. It follows the LastEvaluatedKey until every
+// item has been read.
+func (db *DB) QueryIndex(tableName string, indexName string, key interface{}, keyCondExp string, dst interface{}) error {
+	_key, err := dynamodbattribute.MarshalMap(key)
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to DynamoDB marshal query key, %v", err))
+		return err
+	}
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeValues: _key,
+		KeyConditionExpression:    aws.String(keyCondExp),
+		IndexName:                 aws.String(indexName),
+		TableName:                 aws.String(tableName),
+	}
+	items := []map[string]*dynamodb.AttributeValue{}
+	for {
+		result, err := _db.Query(input)
+		if err != nil {
+			fmt.Println("Failed to query index", indexName, "of table", tableName)
+			return err
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	return dynamodbattribute.UnmarshalListOfMaps(items, dst)
+}
+
+// GetItems gets the items of the table matching the key condition.
+// It follows the LastEvaluatedKey until every item has been read.
 func (db *DB) GetItems(tableName string, key interface{}, keyCondExp string, projectionExp string, expAttNames map[string]*string, dst interface{}) error {
 	_key, err := dynamodbattribute.MarshalMap(key)
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to DynamoDB marshal query key, %v", err))
+		return err
+	}
 	// Prepare the input for the query.
 	input := &dynamodb.QueryInput{
 		ExpressionAttributeValues: _key,
 		KeyConditionExpression:    aws.String(keyCondExp),
-		ProjectionExpression:      aws.String(projectionExp),
-		ExpressionAttributeNames:  expAttNames,
 		TableName:                 aws.String(tableName),
 	}
-	result, err := _db.Query(input)
+	// An empty projection returns the whole items
+	if projectionExp != "" {
+		input.ProjectionExpression = aws.String(projectionExp)
+		input.ExpressionAttributeNames = expAttNames
+	}
+	items := []map[string]*dynamodb.AttributeValue{}
+	for {
+		result, err := _db.Query(input)
+		if err != nil {
+			fmt.Println("Failed to query table", tableName)
+			return err
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	return dynamodbattribute.UnmarshalListOfMaps(items, dst)
+}
+
+// Scan reads every item of the table that matches the filter expression.
+// An empty filter expression returns the whole table. Scan follows the
+// LastEvaluatedKey until the table has been read completely.
+func (db *DB) Scan(tableName string, filterExp string, expAttValues interface{}, expAttNames map[string]*string, dst interface{}) error {
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+	}
+	if filterExp != "" {
+		_values, err := dynamodbattribute.MarshalMap(expAttValues)
+		if err != nil {
+			log.Println(fmt.Sprintf("failed to DynamoDB marshal scan values, %v", err))
+			return err
+		}
+		input.FilterExpression = aws.String(filterExp)
+		input.ExpressionAttributeValues = _values
+		input.ExpressionAttributeNames = expAttNames
+	}
+	items := []map[string]*dynamodb.AttributeValue{}
+	for {
+		result, err := _db.Scan(input)
+		if err != nil {
+			fmt.Println("Failed to scan table", tableName)
+			return err
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	return dynamodbattribute.UnmarshalListOfMaps(items, dst)
+}
+
+// DeleteItem removes an item from the db
+func (db *DB) DeleteItem(tableName string, key interface{}) error {
+	_key, err := dynamodbattribute.MarshalMap(key)
 	if err != nil {
-		fmt.Println("Failed to query table", tableName)
+		log.Println(fmt.Sprintf("failed to DynamoDB marshal delete key, %v", err))
 		return err
 	}
-
-	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, dst)
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key:       _key,
+	}
+	_, err = _db.DeleteItem(input)
 	if err != nil {
+		log.Println(fmt.Sprintf("failed to DynamoDB delete item, %v", err))
 		return err
 	}
 	return nil
 }
+
+// MoveItem adds the item and removes the one of the old key in a
+// single transaction, so neither write happens without the other.
+// ErrConditionFailed is returned if the condition expression on the
+// new item is not met.
+func (db *DB) MoveItem(tableName string, item interface{}, condExp string, oldKey interface{}) error {
+	av, err := dynamodbattribute.MarshalMap(item)
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to DynamoDB marshal Record, %v", err))
+		return err
+	}
+	_key, err := dynamodbattribute.MarshalMap(oldKey)
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to DynamoDB marshal delete key, %v", err))
+		return err
+	}
+	input := &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Put: &dynamodb.Put{
+					TableName:           aws.String(tableName),
+					Item:                av,
+					ConditionExpression: aws.String(condExp),
+				},
+			},
+			{
+				Delete: &dynamodb.Delete{
+					TableName: aws.String(tableName),
+					Key:       _key,
+				},
+			},
+		},
+	}
+	_, err = _db.TransactWriteItems(input)
+	if terr, ok := err.(*dynamodb.TransactionCanceledException); ok {
+		for _, reason := range terr.CancellationReasons {
+			if aws.StringValue(reason.Code) == "ConditionalCheckFailed" {
+				return ErrConditionFailed
+			}
+		}
+	}
+	return err
+}
@@ -3,11 +3,24 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/jcamilom/ecommerce/blob"
 	"github.com/jcamilom/ecommerce/controllers"
 	"github.com/jcamilom/ecommerce/middleware"
 	"github.com/jcamilom/ecommerce/models"
+	"github.com/jcamilom/ecommerce/notify"
+	"github.com/jcamilom/ecommerce/oidc"
+	"github.com/jcamilom/ecommerce/pwhash"
+	"github.com/jcamilom/ecommerce/pwpolicy"
+	"github.com/jcamilom/ecommerce/ratelimit"
+	"github.com/jcamilom/ecommerce/session"
+	"golang.org/x/crypto/bcrypt"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -19,28 +32,115 @@ var (
 
 func main() {
 	loadEnvVars()
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
 
-	us := models.NewUserService()
+	middleware.SetTrustedProxies(trustedProxies())
+	pus := models.NewPurchaseService()
+	ws := models.NewWishlistService()
+	notifier := newNotifier()
+	keys := newSessionKeys()
+	us := models.NewUserService(pus, ws, notifier, baseURL(), keys, newPasswordHasher(), newPasswordPolicy())
 	usersC := controllers.NewUsers(us)
-	ps := models.NewProductsService()
+	keysC := controllers.NewKeys(keys)
+	oidcC := controllers.NewOIDC(models.NewOIDCService(us, newOIDCProviders()), us, strings.HasPrefix(baseURL(), "https://"))
+	cs := models.NewCategoryService()
+	categoriesC := controllers.NewCategories(cs)
+	bs := newBlobStore()
+	ns := models.NewNotificationService(us, notifier)
+	ps := models.NewProductsService(cs, bs, ns)
+	go rebuildSearchIndex(ps, searchReindexInterval())
 	productsC := controllers.NewProducts(ps, us)
-	pus := models.NewPurchaseService()
-	purchaseC := controllers.NewPurchases(pus, ps, us)
+	wishlistsC := controllers.NewWishlists(ws, ps)
+	purchaseC := controllers.NewPurchases(pus, ps, us, ws, stepUpAmount())
 
 	requireUserMw := middleware.RequireUser{
 		UserService: us,
 	}
+	requireAdminMw := middleware.RequireRole{
+		Roles: []string{models.RoleAdmin},
+	}
+	requireStaffMw := middleware.RequireRole{
+		Roles: []string{models.RoleAdmin, models.RoleSupport},
+	}
+	rateLimits := newRateLimitStore()
+	registerLimitMw := rateLimit(rateLimits, "register", "5/1h")
+	loginLimitMw := rateLimit(rateLimits, "login", "20/1m")
+	forgotPasswordLimitMw := rateLimit(rateLimits, "forgot_password", "5/1h")
+	purchasesLimitMw := rateLimit(rateLimits, "purchases", "10/1m")
+	refreshLimitMw := rateLimit(rateLimits, "refresh", "30/1m")
+	resetPasswordLimitMw := rateLimit(rateLimits, "reset_password", "10/1h")
+	unlockLimitMw := rateLimit(rateLimits, "unlock", "10/1h")
+	verifyEmailLimitMw := rateLimit(rateLimits, "verify_email", "10/1h")
+	passwordCheckLimitMw := rateLimit(rateLimits, "password_check", "10/1h")
 
 	r := mux.NewRouter()
-	r.HandleFunc("/login", usersC.Login).Methods("POST")
-	r.HandleFunc("/register", usersC.Create).Methods("POST")
-	r.HandleFunc("/users/balance", requireUserMw.ApplyFn(usersC.GetBalance)).Methods("GET")
-	r.HandleFunc("/users/favorites", requireUserMw.ApplyFn(productsC.AddFavorite)).Methods("POST")
-	r.HandleFunc("/users/favorites", requireUserMw.ApplyFn(usersC.GetFavorites)).Methods("GET")
-	r.HandleFunc("/store/balance", usersC.GetStoreBalance).Methods("GET")
-	r.HandleFunc("/products/{id}", requireUserMw.ApplyFn(productsC.GetProduct)).Methods("GET")
-	r.HandleFunc("/purchases", requireUserMw.ApplyFn(purchaseC.Get)).Methods("GET")
-	r.HandleFunc("/purchases", requireUserMw.ApplyFn(purchaseC.Create)).Methods("POST")
+	r.HandleFunc("/.well-known/jwks.json", keysC.JWKS).Methods("GET")
+	r.HandleFunc("/login", loginLimitMw.ApplyFn(usersC.Login)).Methods("POST")
+	r.HandleFunc("/login/2fa", loginLimitMw.ApplyFn(usersC.LoginMFA)).Methods("POST")
+	r.HandleFunc("/register", registerLimitMw.ApplyFn(usersC.Create)).Methods("POST")
+	r.HandleFunc("/token/refresh", refreshLimitMw.ApplyFn(usersC.Refresh)).Methods("POST")
+	r.HandleFunc("/auth/providers", oidcC.Providers).Methods("GET")
+	r.HandleFunc("/auth/{provider}/login", oidcC.Login).Methods("GET")
+	r.HandleFunc("/auth/{provider}/callback", oidcC.Callback).Methods("GET")
+	r.HandleFunc("/logout", requireUserMw.ApplyFn(usersC.Logout)).Methods("POST")
+	r.HandleFunc("/users/verify", verifyEmailLimitMw.ApplyFn(usersC.VerifyEmail)).Methods("GET")
+	r.HandleFunc("/users/unlock", unlockLimitMw.ApplyFn(usersC.Unlock)).Methods("GET")
+	r.HandleFunc("/users/email/confirm", verifyEmailLimitMw.ApplyFn(usersC.ConfirmEmailChange)).Methods("GET")
+	r.HandleFunc("/users/me/verification", requireUserMw.ApplyFn(usersC.ResendVerification)).Methods("POST")
+	r.HandleFunc("/password/forgot", forgotPasswordLimitMw.ApplyFn(usersC.ForgotPassword)).Methods("POST")
+	r.HandleFunc("/password/reset", resetPasswordLimitMw.ApplyFn(usersC.ResetPassword)).Methods("POST")
+	r.HandleFunc("/users/me", requireUserMw.ApplyScopeFn(models.ScopeProfileRead, usersC.GetProfile)).Methods("GET")
+	r.HandleFunc("/users/me", requireUserMw.ApplyFn(passwordCheckLimitMw.ApplyFn(usersC.UpdateProfile))).Methods("PATCH")
+	r.HandleFunc("/users/me", requireUserMw.ApplyFn(passwordCheckLimitMw.ApplyFn(usersC.DeleteAccount))).Methods("DELETE")
+	r.HandleFunc("/users/me/export", requireUserMw.ApplyFn(usersC.Export)).Methods("GET")
+	r.HandleFunc("/users/me/sessions", requireUserMw.ApplyFn(usersC.GetSessions)).Methods("GET")
+	r.HandleFunc("/users/me/sessions", requireUserMw.ApplyFn(usersC.RevokeSessions)).Methods("DELETE")
+	r.HandleFunc("/users/me/sessions/{id}", requireUserMw.ApplyFn(usersC.RevokeSession)).Methods("DELETE")
+	r.HandleFunc("/users/me/api-keys", requireUserMw.ApplyFn(usersC.GetAPIKeys)).Methods("GET")
+	r.HandleFunc("/users/me/api-keys", requireUserMw.ApplyFn(usersC.CreateAPIKey)).Methods("POST")
+	r.HandleFunc("/users/me/api-keys/{id}", requireUserMw.ApplyFn(usersC.RevokeAPIKey)).Methods("DELETE")
+	r.HandleFunc("/users/me/2fa", requireUserMw.ApplyFn(usersC.EnrollTOTP)).Methods("POST")
+	r.HandleFunc("/users/me/2fa", requireUserMw.ApplyFn(passwordCheckLimitMw.ApplyFn(usersC.DisableTOTP))).Methods("DELETE")
+	r.HandleFunc("/users/me/2fa/confirm", requireUserMw.ApplyFn(usersC.ConfirmTOTP)).Methods("POST")
+	r.HandleFunc("/users/me/2fa/recovery-codes", requireUserMw.ApplyFn(usersC.RegenerateRecoveryCodes)).Methods("POST")
+	r.HandleFunc("/users/me/password", requireUserMw.ApplyFn(passwordCheckLimitMw.ApplyFn(usersC.ChangePassword))).Methods("POST")
+	r.HandleFunc("/users/balance", requireUserMw.ApplyScopeFn(models.ScopeProfileRead, usersC.GetBalance)).Methods("GET")
+	r.HandleFunc("/users/favorites", requireUserMw.ApplyScopeFn(models.ScopeFavoritesWrite, productsC.AddFavorite)).Methods("POST")
+	r.HandleFunc("/users/favorites", requireUserMw.ApplyScopeFn(models.ScopeFavoritesRead, productsC.GetFavorites)).Methods("GET")
+	r.HandleFunc("/users/favorites/order", requireUserMw.ApplyScopeFn(models.ScopeFavoritesWrite, productsC.ReorderFavorites)).Methods("PUT")
+	r.HandleFunc("/users/favorites/{id}", requireUserMw.ApplyScopeFn(models.ScopeFavoritesWrite, productsC.RemoveFavorite)).Methods("DELETE")
+	r.HandleFunc("/users/notifications", requireUserMw.ApplyFn(usersC.GetNotificationPrefs)).Methods("GET")
+	r.HandleFunc("/users/notifications", requireUserMw.ApplyFn(usersC.UpdateNotificationPrefs)).Methods("PUT")
+	r.HandleFunc("/users/wishlists", requireUserMw.ApplyScopeFn(models.ScopeWishlistsRead, wishlistsC.List)).Methods("GET")
+	r.HandleFunc("/users/wishlists", requireUserMw.ApplyScopeFn(models.ScopeWishlistsWrite, wishlistsC.Create)).Methods("POST")
+	r.HandleFunc("/users/wishlists/{id}", requireUserMw.ApplyScopeFn(models.ScopeWishlistsRead, wishlistsC.Get)).Methods("GET")
+	r.HandleFunc("/users/wishlists/{id}", requireUserMw.ApplyScopeFn(models.ScopeWishlistsWrite, wishlistsC.Update)).Methods("PATCH")
+	r.HandleFunc("/users/wishlists/{id}", requireUserMw.ApplyScopeFn(models.ScopeWishlistsWrite, wishlistsC.Delete)).Methods("DELETE")
+	r.HandleFunc("/users/wishlists/{id}/items", requireUserMw.ApplyScopeFn(models.ScopeWishlistsWrite, wishlistsC.AddItem)).Methods("POST")
+	r.HandleFunc("/users/wishlists/{id}/items/{productID}", requireUserMw.ApplyScopeFn(models.ScopeWishlistsWrite, wishlistsC.RemoveItem)).Methods("DELETE")
+	r.HandleFunc("/wishlists/{slug}", wishlistsC.GetShared).Methods("GET")
+	r.HandleFunc("/wishlists/{slug}/purchases", requireUserMw.ApplyScopeFn(models.ScopePurchasesWrite, purchasesLimitMw.ApplyFn(purchaseC.CreateGift))).Methods("POST")
+	r.HandleFunc("/store/balance", requireUserMw.ApplyScopeFn(models.ScopeStoreRead, requireStaffMw.ApplyFn(usersC.GetStoreBalance))).Methods("GET")
+	r.HandleFunc("/products", productsC.List).Methods("GET")
+	r.HandleFunc("/products/search", productsC.Search).Methods("GET")
+	r.HandleFunc("/products/facets", productsC.Facets).Methods("GET")
+	r.HandleFunc("/products/{id}", productsC.GetProduct).Methods("GET")
+	r.HandleFunc("/products/{id}/images", requireUserMw.ApplyScopeFn(models.ScopeCatalogWrite, requireAdminMw.ApplyFn(productsC.AddImage))).Methods("POST")
+	r.HandleFunc("/products/{id}/images/{imageID}", requireUserMw.ApplyScopeFn(models.ScopeCatalogWrite, requireAdminMw.ApplyFn(productsC.RemoveImage))).Methods("DELETE")
+	if ls, ok := bs.(*blob.LocalStore); ok {
+		r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", http.FileServer(http.Dir(ls.Dir()))))
+	}
+	r.HandleFunc("/admin/products/import", requireUserMw.ApplyScopeFn(models.ScopeCatalogWrite, requireAdminMw.ApplyFn(productsC.Import))).Methods("POST")
+	r.HandleFunc("/admin/products/export", requireUserMw.ApplyScopeFn(models.ScopeCatalogWrite, requireAdminMw.ApplyFn(productsC.Export))).Methods("GET")
+	r.HandleFunc("/categories", categoriesC.Tree).Methods("GET")
+	r.HandleFunc("/admin/categories", requireUserMw.ApplyScopeFn(models.ScopeCatalogWrite, requireAdminMw.ApplyFn(categoriesC.Create))).Methods("POST")
+	r.HandleFunc("/admin/categories/{id}", requireUserMw.ApplyScopeFn(models.ScopeCatalogWrite, requireAdminMw.ApplyFn(categoriesC.Update))).Methods("PUT")
+	r.HandleFunc("/admin/categories/{id}", requireUserMw.ApplyScopeFn(models.ScopeCatalogWrite, requireAdminMw.ApplyFn(categoriesC.Delete))).Methods("DELETE")
+	r.HandleFunc("/categories/{id}/products", productsC.ListByCategory).Methods("GET")
+	r.HandleFunc("/purchases", requireUserMw.ApplyScopeFn(models.ScopePurchasesRead, purchaseC.Get)).Methods("GET")
+	r.HandleFunc("/purchases", requireUserMw.ApplyScopeFn(models.ScopePurchasesWrite, purchasesLimitMw.ApplyFn(purchaseC.Create))).Methods("POST")
 	fmt.Printf("Starting the server on :%d...\n", port)
 	http.ListenAndServe(fmt.Sprintf(":%d", port), r)
 }
@@ -51,3 +151,256 @@ func loadEnvVars() {
 		log.Fatal("Error loading .env file")
 	}
 }
+
+// baseURL is the address of the API used in the links sent to the
+// users, from the BASE_URL variable
+func baseURL() string {
+	if url := os.Getenv("BASE_URL"); url != "" {
+		return url
+	}
+	return fmt.Sprintf("http://localhost:%d", port)
+}
+
+// newBlobStore creates the store for the product images. The local
+// filesystem is used unless BLOB_STORE is set to "s3".
+func newBlobStore() blob.BlobStore {
+	if os.Getenv("BLOB_STORE") == "s3" {
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		return blob.NewS3Store(blob.S3Config{
+			Bucket:   os.Getenv("S3_BUCKET"),
+			Region:   region,
+			Endpoint: os.Getenv("S3_ENDPOINT"),
+			BaseURL:  os.Getenv("BLOB_BASE_URL"),
+		})
+	}
+	dir := os.Getenv("BLOB_LOCAL_DIR")
+	if dir == "" {
+		dir = "uploads"
+	}
+	imagesURL := os.Getenv("BLOB_BASE_URL")
+	if imagesURL == "" {
+		imagesURL = baseURL() + "/images"
+	}
+	return blob.NewLocalStore(dir, imagesURL)
+}
+
+// newPasswordHasher configures the hashing of the passwords with the
+// PASSWORD_HASH variable, bcrypt (default) or argon2id, and the
+// parameters of the algorithm: BCRYPT_COST, or ARGON2_TIME,
+// ARGON2_MEMORY in KiB and ARGON2_THREADS. PASSWORD_PEPPERS is a
+// comma separated list of version:pepper.
+func newPasswordHasher() *pwhash.Hasher {
+	peppers, err := pwhash.ParsePeppers(os.Getenv("PASSWORD_PEPPERS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	algorithm := os.Getenv("PASSWORD_HASH")
+	if algorithm == "" {
+		algorithm = pwhash.Bcrypt
+	}
+	hasher, err := models.NewPasswordHasher(pwhash.Config{
+		Algorithm:  algorithm,
+		BcryptCost: envInt("BCRYPT_COST", bcrypt.DefaultCost),
+		Argon2: pwhash.Argon2Params{
+			Time:    uint32(envInt("ARGON2_TIME", 3)),
+			Memory:  uint32(envInt("ARGON2_MEMORY", 64*1024)),
+			Threads: uint8(envInt("ARGON2_THREADS", 4)),
+		},
+		Peppers: peppers,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return hasher
+}
+
+// newPasswordPolicy configures the rules of the passwords with the
+// PASSWORD_MIN_LENGTH (8 by default), PASSWORD_MAX_LENGTH (128) and
+// PASSWORD_MIN_SCORE (2, from 0 to 4) variables. The passwords in the
+// BREACHED_PASSWORDS_FILE list, if set, are rejected.
+func newPasswordPolicy() *pwpolicy.Policy {
+	policy := &pwpolicy.Policy{
+		MinLength: envInt("PASSWORD_MIN_LENGTH", 8),
+		MaxLength: envInt("PASSWORD_MAX_LENGTH", 128),
+		MinScore:  envInt("PASSWORD_MIN_SCORE", 2),
+	}
+	if path := os.Getenv("BREACHED_PASSWORDS_FILE"); path != "" {
+		breached, err := pwpolicy.OpenBreachedList(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		policy.Breached = breached
+	}
+	return policy
+}
+
+// envInt returns the number of the variable, or def if it isn't set
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Fatalf("%v must be a number of 0 or more", name)
+	}
+	return n
+}
+
+// stepUpAmount is the price above which the purchases of the users
+// with two-factor authentication need a code, from the
+// STEP_UP_AMOUNT variable. It is 100 by default.
+func stepUpAmount() int {
+	return envInt("STEP_UP_AMOUNT", 100)
+}
+
+// trustedProxies reads the proxies in front of the API, whose
+// X-Forwarded-For headers give the IP address of the clients, from
+// the TRUSTED_PROXIES variable as a comma separated list of IP
+// addresses and CIDR networks. None are trusted by default.
+func trustedProxies() []*net.IPNet {
+	networks, err := middleware.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return networks
+}
+
+// searchReindexInterval is how often the search index is rebuilt to
+// pick up the changes made by other instances of the API, from the
+// SEARCH_REINDEX_INTERVAL variable as a duration like 5m. It is 5
+// minutes by default and 0 disables it.
+func searchReindexInterval() time.Duration {
+	v := os.Getenv("SEARCH_REINDEX_INTERVAL")
+	if v == "" {
+		return 5 * time.Minute
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Fatal("SEARCH_REINDEX_INTERVAL must be a duration like 5m")
+	}
+	return d
+}
+
+// rebuildSearchIndex rebuilds the search index of the products
+// every interval
+func rebuildSearchIndex(ps models.ProductsService, interval time.Duration) {
+	if interval == 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		if err := ps.RebuildIndex(); err != nil {
+			log.Println("Unable to rebuild the products search index:", err)
+		}
+	}
+}
+
+// newRateLimitStore creates the store of the rate limits. They are
+// kept in memory unless RATE_LIMIT_STORE is set to "dynamodb", which
+// shares them between the instances of the API.
+func newRateLimitStore() ratelimit.Store {
+	switch store := os.Getenv("RATE_LIMIT_STORE"); store {
+	case "", "memory":
+		return ratelimit.NewMemoryStore()
+	case "dynamodb":
+		return ratelimit.NewDBStore()
+	default:
+		log.Fatalf("RATE_LIMIT_STORE must be memory or dynamodb, not %v", store)
+		return nil
+	}
+}
+
+// rateLimit creates the middleware of the limit with the name, read
+// from the RATE_LIMIT_<NAME> variable as requests/period, or def if
+// it isn't set
+func rateLimit(store ratelimit.Store, name, def string) *middleware.RateLimit {
+	v := os.Getenv("RATE_LIMIT_" + strings.ToUpper(name))
+	if v == "" {
+		v = def
+	}
+	limit, err := ratelimit.ParseLimit(v)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &middleware.RateLimit{
+		Store: store,
+		Name:  name,
+		Limit: limit,
+	}
+}
+
+// newSessionKeys loads the keys the access tokens are signed with
+// from the file of the JWT_KEYS_FILE variable. It is required unless
+// JWT_INSECURE_DEV_SECRET is true, then nil is returned and the tokens
+// are signed with a fixed HMAC secret that anyone can read in the
+// source, which is only meant for development.
+func newSessionKeys() *session.KeySet {
+	path := os.Getenv("JWT_KEYS_FILE")
+	if path == "" {
+		if os.Getenv("JWT_INSECURE_DEV_SECRET") != "true" {
+			log.Fatal("JWT_KEYS_FILE must be set, or JWT_INSECURE_DEV_SECRET=true to sign the tokens with the public development secret")
+		}
+		log.Println("WARNING: the access tokens are signed with the public development secret, anyone can forge them. Set JWT_KEYS_FILE outside development.")
+		return nil
+	}
+	keys, err := session.LoadKeySet(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return keys
+}
+
+// newOIDCProviders creates the OpenID Connect providers of the
+// OIDC_PROVIDERS variable, a comma separated list of names. Each
+// provider is configured with OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID
+// and OIDC_<NAME>_CLIENT_SECRET.
+func newOIDCProviders() map[string]*oidc.Provider {
+	providers := map[string]*oidc.Provider{}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		providers[name] = oidc.New(oidc.Config{
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  baseURL() + "/auth/" + name + "/callback",
+		})
+	}
+	return providers
+}
+
+// newNotifier creates the notifier of the emails sent to the users
+// from the NOTIFIER variable: "smtp", "webhook", "file" or "log". It
+// must be set, since the log and file notifiers write the password
+// reset and verification links where whoever reads the logs can use
+// them.
+func newNotifier() notify.Notifier {
+	switch notifier := os.Getenv("NOTIFIER"); notifier {
+	case "file":
+		path := os.Getenv("NOTIFIER_FILE")
+		if path == "" {
+			path = "notifications.log"
+		}
+		return notify.NewFileNotifier(path)
+	case "smtp":
+		return notify.NewSMTPNotifier(
+			os.Getenv("SMTP_ADDR"),
+			os.Getenv("SMTP_FROM"),
+			os.Getenv("SMTP_USER"),
+			os.Getenv("SMTP_PASSWORD"),
+		)
+	case "webhook":
+		return notify.NewWebhookNotifier(os.Getenv("WEBHOOK_URL"))
+	case "log":
+		return &notify.LogNotifier{}
+	default:
+		log.Fatalf("NOTIFIER must be smtp, webhook, file or log, not %q", notifier)
+		return nil
+	}
+}
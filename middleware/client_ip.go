@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks of the proxies in front of the API,
+// whose X-Forwarded-For headers are believed. It is set once on start.
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets the networks of the proxies in front of the
+// API. It must be called before serving requests.
+func SetTrustedProxies(networks []*net.IPNet) {
+	trustedProxies = networks
+}
+
+// ParseTrustedProxies reads a comma separated list of IP addresses
+// and CIDR networks
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("middleware: trusted proxy %q is not an IP address", v)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("middleware: trusted proxy %q is not a CIDR network", v)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ClientIP returns the IP address of the client of the request. If
+// the request comes from a trusted proxy, the X-Forwarded-For header
+// is read from the right, skipping the trusted proxies, as the
+// addresses on the left can be sent by the client.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(ip) == nil {
+			// The header was changed on the way, the last
+			// address that could be checked is used
+			return host
+		}
+		host = ip
+		if !isTrustedProxy(ip) {
+			return ip
+		}
+	}
+	return host
+}
+
+// isTrustedProxy returns true if the address is in one of the
+// networks of the trusted proxies
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jcamilom/ecommerce/context"
+	"github.com/jcamilom/ecommerce/ratelimit"
+)
+
+// RateLimit limits the requests of each user, or of each IP address
+// if the request has no user, with a token bucket. To limit by user
+// it must be applied after RequireUser.
+type RateLimit struct {
+	Store ratelimit.Store
+	// Name of the limit, the routes with the same name share the
+	// buckets
+	Name  string
+	Limit ratelimit.Limit
+}
+
+func (mw *RateLimit) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := mw.Name + "#ip#" + ClientIP(r)
+		if user := context.User(r.Context()); user != nil {
+			key = mw.Name + "#user#" + user.Email
+		}
+		res, err := mw.Store.Take(key, mw.Limit)
+		if err != nil {
+			// The API keeps working if the store is down
+			log.Println("Unable to check the rate limit", key, err)
+			next(w, r)
+			return
+		}
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", mw.Limit.Burst, ceilSeconds(mw.Limit.Period)))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(mw.Limit.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+		if !res.Allowed {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: "Too many requests, try again later",
+			})
+			return
+		}
+		next(w, r)
+	})
+}
+
+// ceilSeconds rounds up to whole seconds, the unit of the headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/jcamilom/ecommerce/context"
+)
+
+// RequireRole only lets through the users with one of the Roles.
+// It must be applied after RequireUser.
+type RequireRole struct {
+	Roles []string
+}
+
+func (mw *RequireRole) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		user := context.User(r.Context())
+		if user == nil {
+			log.Println("Error while fetching the user from the context")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !user.HasRole(mw.Roles...) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: "You don't have permission to do this",
+			})
+			return
+		}
+		next(w, r)
+	})
+}
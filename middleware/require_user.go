@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
@@ -11,40 +12,109 @@ import (
 	"github.com/jcamilom/ecommerce/session"
 )
 
+// Realm of the WWW-Authenticate header of the unauthorized requests
+const authRealm = "ecommerce"
+
 type RequireUser struct {
 	models.UserService
 }
 
+// ApplyFn lets the request through if it has a valid access token.
+// API keys aren't accepted.
 func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.ApplyScopeFn("", next)
+}
+
+// ApplyScopeFn is like ApplyFn but also accepts the API keys with the
+// scope
+func (mw *RequireUser) ApplyScopeFn(scope string, next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		authValue := r.Header.Get("Authorization")
-		token := checkAuthorizationHeader(authValue)
+		token := BearerToken(r)
 		if token == "" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", authRealm))
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		user, err := mw.UserService.Authorize(token)
+		if strings.HasPrefix(token, models.APIKeyPrefix) {
+			mw.applyAPIKey(w, r, token, scope, next)
+			return
+		}
+		user, s, err := mw.UserService.Authorize(token)
 		if err != nil {
-			switch err {
-			case session.ErrTokenExpired, session.ErrTokenInvalid:
-				w.WriteHeader(http.StatusUnauthorized)
-				json.NewEncoder(w).Encode(&messageResponse{
-					Message: err.Error(),
-				})
-			default:
+			if !session.IsTokenError(err) {
+				log.Println(err)
 				w.WriteHeader(http.StatusInternalServerError)
+				return
 			}
+			// As in RFC 6750, the error tells the client whether to
+			// refresh the token or log in again
+			description := strings.TrimPrefix(err.Error(), "session: ")
+			invalidToken(w, description)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
 			return
 		}
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
+		ctx = context.WithSession(ctx, s)
 		r = r.WithContext(ctx)
 		log.Printf("User %v authorized\n", user.Email)
 		next(w, r)
 	})
 }
 
+func (mw *RequireUser) applyAPIKey(w http.ResponseWriter, r *http.Request, apiKey, scope string, next http.HandlerFunc) {
+	if scope == "" {
+		invalidToken(w, "route doesn't accept API keys")
+		json.NewEncoder(w).Encode(&messageResponse{
+			Message: "This route requires an access token",
+		})
+		return
+	}
+	user, key, err := mw.UserService.AuthorizeAPIKey(apiKey, scope)
+	if err != nil {
+		switch err {
+		case models.ErrAPIKeyInvalid:
+			invalidToken(w, "API key invalid")
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		case models.ErrAPIKeyScopeMissing:
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf("Bearer realm=%q, error=\"insufficient_scope\", scope=%q", authRealm, scope))
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(&messageResponse{
+				Message: err.Error(),
+			})
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	ctx := r.Context()
+	ctx = context.WithUser(ctx, user)
+	ctx = context.WithAPIKey(ctx, key)
+	r = r.WithContext(ctx)
+	log.Printf("User %v authorized with API key %v\n", user.Email, key.Prefix)
+	next(w, r)
+}
+
+// invalidToken writes the 401 status of a token that isn't valid
+func invalidToken(w http.ResponseWriter, description string) {
+	w.Header().Set("WWW-Authenticate",
+		fmt.Sprintf("Bearer realm=%q, error=\"invalid_token\", error_description=%q", authRealm, description))
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// BearerToken returns the token of the Authorization header of the
+// request, or an empty string
+func BearerToken(r *http.Request) string {
+	return checkAuthorizationHeader(r.Header.Get("Authorization"))
+}
+
 func checkAuthorizationHeader(value string) string {
 	if !(strings.HasPrefix(value, "bearer ")) {
 		return ""
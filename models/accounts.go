@@ -0,0 +1,117 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrAddressInvalid is returned when the address to send the
+	// lumens of a deleted account is not a Stellar public key.
+	ErrAddressInvalid = errors.New("models: stellar address is not valid")
+)
+
+// UserExport is every data stored about a user, for data
+// portability requests
+type UserExport struct {
+	ID                string            `json:"id"`
+	Name              string            `json:"name"`
+	Email             string            `json:"email"`
+	Verified          bool              `json:"verified"`
+	Address           string            `json:"address"`
+	NotificationPrefs NotificationPrefs `json:"notification_prefs"`
+	Favorites         []Favorite        `json:"favorites"`
+	Purchases         []Purchase        `json:"purchases"`
+	Wishlists         []Wishlist        `json:"wishlists"`
+	Identities        []Identity        `json:"identities"`
+	ExportedAt        time.Time         `json:"exported_at"`
+}
+
+func (us *userService) DeleteAccount(user *User, password, address, ip string) error {
+	stored, err := us.ByEmail(user.Email)
+	if err != nil {
+		return err
+	}
+	if err := us.checkPassword(stored, password, ip); err != nil {
+		return err
+	}
+	if address == "" {
+		address = StoreStellarAddress
+	}
+	if !us.stellar.ValidAddress(address) || address == stored.Wallet.Address {
+		return ErrAddressInvalid
+	}
+	// The lumens go first, the account can't be used once the
+	// seed is deleted
+	if err := us.stellar.MergeAccount(stored.Wallet.Seed, address); err != nil {
+		return err
+	}
+
+	// The purchases are kept for the store records under an email
+	// that can't be registered
+	id, err := newRandomID()
+	if err != nil {
+		return err
+	}
+	anonymous := "deleted-" + id
+	if err := us.purchases.ChangeEmail(stored.Email, anonymous); err != nil {
+		return err
+	}
+	if err := us.purchases.ChangeRecipient(stored.Email, anonymous); err != nil {
+		return err
+	}
+	wishlists, err := us.wishlists.ByEmail(stored.Email)
+	if err != nil {
+		return err
+	}
+	for _, wl := range wishlists {
+		if err := us.wishlists.Delete(wl.Email, wl.ID); err != nil {
+			return err
+		}
+	}
+	if err := us.sent.DeleteByEmail(stored.Email); err != nil {
+		return err
+	}
+	if err := us.sessions.DeleteByEmail(stored.Email, ""); err != nil {
+		return err
+	}
+	if err := us.apiKeys.DeleteByEmail(stored.Email); err != nil {
+		return err
+	}
+	if err := us.identities.DeleteByEmail(stored.Email); err != nil {
+		return err
+	}
+	return us.UserDB.Delete(stored.Email)
+}
+
+func (us *userService) Export(user *User) (*UserExport, error) {
+	stored, err := us.ByEmail(user.Email)
+	if err != nil {
+		return nil, err
+	}
+	purchases, err := us.purchases.ByEmail(stored.Email)
+	if err != nil {
+		return nil, err
+	}
+	wishlists, err := us.wishlists.ByEmail(stored.Email)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := us.identities.ByEmail(stored.Email)
+	if err != nil {
+		return nil, err
+	}
+	return &UserExport{
+		ID:                stored.ID,
+		Name:              stored.Name,
+		Email:             stored.Email,
+		Verified:          !stored.VerificationPending,
+		Address:           stored.Wallet.Address,
+		NotificationPrefs: stored.NotificationPrefsOrDefault(),
+		Favorites:         stored.Favorites,
+		Purchases:         purchases,
+		Wishlists:         wishlists,
+		Identities:        identities,
+		ExportedAt:        time.Now(),
+	}, nil
+}
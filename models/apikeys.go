@@ -0,0 +1,324 @@
+package models
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jcamilom/ecommerce/db"
+)
+
+var (
+	// The DB table name for the API keys
+	dbAPIKeysTableName = "APIKeys"
+
+	// The DB global secondary index to look up the API keys of a user
+	dbAPIKeysEmailIndexName = "email-index"
+
+	// ErrAPIKeyInvalid is returned when an API key doesn't exist,
+	// expired or was revoked.
+	ErrAPIKeyInvalid = errors.New("models: API key is invalid or expired")
+
+	// ErrAPIKeyNameRequired is returned when creating an API key
+	// without a name.
+	ErrAPIKeyNameRequired = errors.New("models: API key name is required")
+
+	// ErrAPIKeyScopeInvalid is returned when creating an API key with
+	// no scopes or an unknown scope.
+	ErrAPIKeyScopeInvalid = errors.New("models: API key scopes must be one or more of the known scopes")
+
+	// ErrAPIKeyExpiryInvalid is returned when creating an API key
+	// that is already expired.
+	ErrAPIKeyExpiryInvalid = errors.New("models: API key expiry must be in the future")
+
+	// ErrAPIKeyScopeMissing is returned when an API key is used on a
+	// route its scopes don't allow.
+	ErrAPIKeyScopeMissing = errors.New("models: API key doesn't have the scope of the route")
+)
+
+// Scopes of the API keys. Each route that accepts API keys requires
+// one of them.
+const (
+	ScopeProfileRead    = "profile:read"
+	ScopePurchasesRead  = "purchases:read"
+	ScopePurchasesWrite = "purchases:write"
+	ScopeWishlistsRead  = "wishlists:read"
+	ScopeWishlistsWrite = "wishlists:write"
+	ScopeFavoritesRead  = "favorites:read"
+	ScopeFavoritesWrite = "favorites:write"
+	ScopeCatalogWrite   = "catalog:write"
+	ScopeStoreRead      = "store:read"
+)
+
+// APIKeyScopes lists the known scopes
+var APIKeyScopes = []string{
+	ScopeProfileRead,
+	ScopePurchasesRead,
+	ScopePurchasesWrite,
+	ScopeWishlistsRead,
+	ScopeWishlistsWrite,
+	ScopeFavoritesRead,
+	ScopeFavoritesWrite,
+	ScopeCatalogWrite,
+	ScopeStoreRead,
+}
+
+// APIKeyPrefix starts every API key, so they can be told apart from
+// the access tokens and found by secret scanners
+const APIKeyPrefix = "ek_"
+
+// Length in bytes of the random part of the API keys
+const apiKeyBytes = 32
+
+// The last use of an API key is stored at most once per interval,
+// to not write on every request
+const apiKeyLastUsedInterval = time.Minute
+
+// APIKey lets a backend integration call the API as the user,
+// limited to the routes of its scopes. Only the hash of the secret
+// is stored. A zero ExpiresAt never expires.
+type APIKey struct {
+	ID         string    `json:"id"`
+	Email      string    `json:"email"`
+	Name       string    `json:"key_name"`
+	Prefix     string    `json:"prefix"`
+	KeyHash    string    `json:"key_hash"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// HasScope tells if the key allows the scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// CreateAPIKey creates an API key for the user. The key is returned
+// with the secret, which can't be recovered later.
+func (us *userService) CreateAPIKey(user *User, name string, scopes []string, expiresAt time.Time) (*APIKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", ErrAPIKeyNameRequired
+	}
+	if len(scopes) == 0 {
+		return nil, "", ErrAPIKeyScopeInvalid
+	}
+	for _, s := range scopes {
+		if !validScope(s) {
+			return nil, "", ErrAPIKeyScopeInvalid
+		}
+	}
+	now := time.Now()
+	if !expiresAt.IsZero() && !expiresAt.After(now) {
+		return nil, "", ErrAPIKeyExpiryInvalid
+	}
+	id, err := newRandomID()
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := newRandomToken(apiKeyBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	key := &APIKey{
+		ID:        id,
+		Email:     user.Email,
+		Name:      name,
+		Prefix:    APIKeyPrefix + id,
+		KeyHash:   hashToken(secret),
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+	if err := us.apiKeys.Create(key); err != nil {
+		return nil, "", err
+	}
+	return key, key.Prefix + "." + secret, nil
+}
+
+// APIKeys returns the API keys of the user
+func (us *userService) APIKeys(user *User) ([]APIKey, error) {
+	return us.apiKeys.ByEmail(user.Email)
+}
+
+// RevokeAPIKey deletes an API key of the user. ErrNotFound is
+// returned if the user has no key with the ID.
+func (us *userService) RevokeAPIKey(user *User, id string) error {
+	key, err := us.apiKeys.ByID(id)
+	if err != nil {
+		return err
+	}
+	if key.Email != user.Email {
+		return ErrNotFound
+	}
+	return us.apiKeys.Delete(id)
+}
+
+// AuthorizeAPIKey returns the user of the API key, as long as the
+// key allows the scope. The last use of the key is recorded.
+func (us *userService) AuthorizeAPIKey(apiKey, scope string) (*User, *APIKey, error) {
+	parts := strings.SplitN(strings.TrimPrefix(apiKey, APIKeyPrefix), ".", 2)
+	if !strings.HasPrefix(apiKey, APIKeyPrefix) || len(parts) != 2 {
+		return nil, nil, ErrAPIKeyInvalid
+	}
+	key, err := us.apiKeys.ByID(parts[0])
+	if err == ErrNotFound {
+		return nil, nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	hash := hashToken(parts[1])
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(key.KeyHash)) != 1 || key.expired(now) {
+		return nil, nil, ErrAPIKeyInvalid
+	}
+	if !key.HasScope(scope) {
+		return nil, nil, ErrAPIKeyScopeMissing
+	}
+	user, err := us.ByEmail(key.Email)
+	if err == ErrNotFound {
+		return nil, nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if now.Sub(key.LastUsedAt) > apiKeyLastUsedInterval {
+		if err := us.apiKeys.Touch(key, now); err != nil {
+			return nil, nil, err
+		}
+	}
+	return user, key, nil
+}
+
+func validScope(scope string) bool {
+	for _, s := range APIKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func newAPIKeyDB() *apiKeyDB {
+	db := &db.DB{}
+	return &apiKeyDB{
+		db: db,
+	}
+}
+
+type apiKeyDB struct {
+	db *db.DB
+}
+
+// ByID will look up the API key with the provided ID
+func (kdb *apiKeyDB) ByID(id string) (*APIKey, error) {
+	key := new(APIKey)
+	query := apiKeyTableQueryKey{
+		ID: id,
+	}
+	found, err := kdb.db.GetItem(query, dbAPIKeysTableName, key)
+	if err != nil {
+		return nil, err
+	} else if found == false {
+		return nil, ErrNotFound
+	} else {
+		return key, nil
+	}
+}
+
+// ByEmail will look up the API keys of the user
+func (kdb *apiKeyDB) ByEmail(email string) ([]APIKey, error) {
+	keys := []APIKey{}
+	query := struct {
+		Email string `json:":e"`
+	}{
+		Email: email,
+	}
+	err := kdb.db.QueryIndex(dbAPIKeysTableName, dbAPIKeysEmailIndexName, query, "email = :e", &keys)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Create will create the provided API key in the database
+func (kdb *apiKeyDB) Create(key *APIKey) error {
+	return kdb.db.PutItem(dbAPIKeysTableName, key)
+}
+
+// Touch will set the last use of the API key
+func (kdb *apiKeyDB) Touch(key *APIKey, usedAt time.Time) error {
+	query := apiKeyTableQueryKey{
+		ID: key.ID,
+	}
+	update := struct {
+		UsedAt time.Time `json:":u"`
+	}{
+		UsedAt: usedAt,
+	}
+	if err := kdb.db.UpdateItem(dbAPIKeysTableName, query, update, "set last_used_at = :u"); err != nil {
+		return err
+	}
+	key.LastUsedAt = usedAt
+	return nil
+}
+
+// ChangeEmail will move the API keys of a user to the new email
+func (kdb *apiKeyDB) ChangeEmail(oldEmail, newEmail string) error {
+	keys, err := kdb.ByEmail(oldEmail)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		query := apiKeyTableQueryKey{
+			ID: k.ID,
+		}
+		update := struct {
+			Email string `json:":e"`
+		}{
+			Email: newEmail,
+		}
+		if err := kdb.db.UpdateItem(dbAPIKeysTableName, query, update, "set email = :e"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete will delete the API key with the provided ID
+func (kdb *apiKeyDB) Delete(id string) error {
+	query := apiKeyTableQueryKey{
+		ID: id,
+	}
+	return kdb.db.DeleteItem(dbAPIKeysTableName, query)
+}
+
+// DeleteByEmail will delete the API keys of the user
+func (kdb *apiKeyDB) DeleteByEmail(email string) error {
+	keys, err := kdb.ByEmail(email)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := kdb.Delete(k.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type apiKeyTableQueryKey struct {
+	ID string `json:"id"`
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"log"
+	"time"
+
+	"github.com/jcamilom/ecommerce/db"
+)
+
+var (
+	// The DB table name for the security audit events
+	dbAuditEventsTableName = "AuditEvents"
+)
+
+// Kinds of audit events
+const (
+	AuditLoginSucceeded  = "login_succeeded"
+	AuditLoginFailed     = "login_failed"
+	AuditLoginThrottled  = "login_throttled"
+	AuditAccountLocked   = "account_locked"
+	AuditAccountUnlocked = "account_unlocked"
+)
+
+// Time the audit events are kept
+const auditEventRetention = 90 * 24 * time.Hour
+
+// AuditEvent is a security relevant event of an account or an IP
+// address
+type AuditEvent struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	Email     string    `json:"email"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	// TTL is the expiry time in unix seconds, so DynamoDB deletes
+	// the old events
+	TTL int64 `json:"ttl"`
+}
+
+// audit records the event. A failure is only logged, it never stops
+// what is being audited.
+func (us *userService) audit(event, email, ip string) {
+	id, err := newRandomID()
+	if err != nil {
+		log.Println("Unable to record the audit event", event, err)
+		return
+	}
+	now := time.Now()
+	err = us.auditEvents.Create(&AuditEvent{
+		ID:        id,
+		Event:     event,
+		Email:     email,
+		IP:        ip,
+		CreatedAt: now,
+		TTL:       now.Add(auditEventRetention).Unix(),
+	})
+	if err != nil {
+		log.Println("Unable to record the audit event", event, err)
+	}
+}
+
+func newAuditEventDB() *auditEventDB {
+	db := &db.DB{}
+	return &auditEventDB{
+		db: db,
+	}
+}
+
+type auditEventDB struct {
+	db *db.DB
+}
+
+// Create will create the provided event in the database
+func (adb *auditEventDB) Create(event *AuditEvent) error {
+	return adb.db.PutItem(dbAuditEventsTableName, event)
+}
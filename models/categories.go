@@ -0,0 +1,336 @@
+package models
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/jcamilom/ecommerce/db"
+)
+
+var (
+	// The DB table name for categories
+	dbCategoriesTableName = "Categories"
+
+	// ErrCategoryIDRequired is returned when a category is created
+	// or updated without an ID.
+	ErrCategoryIDRequired = errors.New("models: category id is required")
+
+	// ErrCategoryNameRequired is returned when a category is created
+	// or updated without a name.
+	ErrCategoryNameRequired = errors.New("models: category name is required")
+
+	// ErrCategoryParentInvalid is returned when the parent of a category
+	// doesn't exist or the category would end up being its own ancestor.
+	ErrCategoryParentInvalid = errors.New("models: category parent is not valid")
+
+	// ErrCategoryNotEmpty is returned when deleting a category that
+	// still has subcategories.
+	ErrCategoryNotEmpty = errors.New("models: category has subcategories")
+
+	// ErrCategoryExists is returned when creating a category with
+	// the ID of another one.
+	ErrCategoryExists = errors.New("models: category already exists")
+)
+
+// Category groups products of the catalog. Categories form a tree,
+// the root categories have an empty ParentID.
+type Category struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ParentID string `json:"parent_id"`
+}
+
+// CategoryNode is a category along with its subcategories
+type CategoryNode struct {
+	Category
+	Children []CategoryNode `json:"children"`
+}
+
+// CategoryDB is used to interact with the categories database.
+type CategoryDB interface {
+	// Methods for querying for single categories
+	ByID(id string) (*Category, error)
+	// Methods for querying several categories
+	All() ([]Category, error)
+	// Methods for altering categories
+	Create(category *Category) error
+	Update(category *Category) error
+	Delete(id string) error
+}
+
+// CategoryService is a set of methods used to manipulate and
+// work with the category model
+type CategoryService interface {
+	// Tree returns the root categories with all their descendants
+	Tree() ([]CategoryNode, error)
+	// Descendants returns the ID of the category followed by the
+	// IDs of all its subcategories, at any depth. It returns
+	// ErrNotFound if the category doesn't exist.
+	Descendants(id string) ([]string, error)
+	CategoryDB
+}
+
+func NewCategoryService() CategoryService {
+	cdb := newCategoryDB()
+	cv := newCategoryValidator(cdb)
+	return &categoryService{
+		CategoryDB: cv,
+	}
+}
+
+var _ CategoryService = &categoryService{}
+
+type categoryService struct {
+	CategoryDB
+}
+
+func (cs *categoryService) Tree() ([]CategoryNode, error) {
+	categories, err := cs.CategoryDB.All()
+	if err != nil {
+		return nil, err
+	}
+	children := childrenByParent(categories)
+	return buildCategoryNodes(children, ""), nil
+}
+
+func (cs *categoryService) Descendants(id string) ([]string, error) {
+	categories, err := cs.CategoryDB.All()
+	if err != nil {
+		return nil, err
+	}
+	var found bool
+	for _, c := range categories {
+		if c.ID == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	children := childrenByParent(categories)
+	ids := []string{id}
+	// Walk the tree breadth first, ids grows while it is walked
+	for i := 0; i < len(ids); i++ {
+		for _, c := range children[ids[i]] {
+			ids = append(ids, c.ID)
+		}
+	}
+	return ids, nil
+}
+
+// childrenByParent groups the categories by parent ID, sorted by name
+func childrenByParent(categories []Category) map[string][]Category {
+	children := map[string][]Category{}
+	for _, c := range categories {
+		children[c.ParentID] = append(children[c.ParentID], c)
+	}
+	for _, cs := range children {
+		sort.Slice(cs, func(i, j int) bool {
+			return cs[i].Name < cs[j].Name
+		})
+	}
+	return children
+}
+
+func buildCategoryNodes(children map[string][]Category, parentID string) []CategoryNode {
+	nodes := []CategoryNode{}
+	for _, c := range children[parentID] {
+		nodes = append(nodes, CategoryNode{
+			Category: c,
+			Children: buildCategoryNodes(children, c.ID),
+		})
+	}
+	return nodes
+}
+
+type categoryValFunc func(*Category) error
+
+func runCategoryValFuncs(category *Category, fns ...categoryValFunc) error {
+	for _, fn := range fns {
+		if err := fn(category); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ CategoryDB = &categoryValidator{}
+
+func newCategoryValidator(cdb CategoryDB) *categoryValidator {
+	return &categoryValidator{
+		CategoryDB: cdb,
+	}
+}
+
+type categoryValidator struct {
+	CategoryDB
+}
+
+// Create will validate the category before calling Create
+// on the CategoryDB field.
+func (cv *categoryValidator) Create(category *Category) error {
+	err := runCategoryValFuncs(category,
+		cv.normalizeID,
+		cv.requireID,
+		cv.normalizeName,
+		cv.requireName,
+		cv.parentIsValid,
+	)
+	if err != nil {
+		return err
+	}
+	return cv.CategoryDB.Create(category)
+}
+
+// Update will validate the category before calling Update
+// on the CategoryDB field.
+func (cv *categoryValidator) Update(category *Category) error {
+	err := runCategoryValFuncs(category,
+		cv.normalizeID,
+		cv.requireID,
+		cv.exists,
+		cv.normalizeName,
+		cv.requireName,
+		cv.parentIsValid,
+	)
+	if err != nil {
+		return err
+	}
+	return cv.CategoryDB.Update(category)
+}
+
+// Delete will make sure the category exists and has no
+// subcategories before calling Delete on the CategoryDB field.
+func (cv *categoryValidator) Delete(id string) error {
+	if _, err := cv.CategoryDB.ByID(id); err != nil {
+		return err
+	}
+	categories, err := cv.CategoryDB.All()
+	if err != nil {
+		return err
+	}
+	for _, c := range categories {
+		if c.ParentID == id {
+			return ErrCategoryNotEmpty
+		}
+	}
+	return cv.CategoryDB.Delete(id)
+}
+
+func (cv *categoryValidator) normalizeID(category *Category) error {
+	category.ID = strings.ToLower(strings.TrimSpace(category.ID))
+	category.ParentID = strings.ToLower(strings.TrimSpace(category.ParentID))
+	return nil
+}
+
+func (cv *categoryValidator) requireID(category *Category) error {
+	if category.ID == "" {
+		return ErrCategoryIDRequired
+	}
+	return nil
+}
+
+func (cv *categoryValidator) exists(category *Category) error {
+	_, err := cv.CategoryDB.ByID(category.ID)
+	return err
+}
+
+func (cv *categoryValidator) normalizeName(category *Category) error {
+	category.Name = strings.TrimSpace(category.Name)
+	return nil
+}
+
+func (cv *categoryValidator) requireName(category *Category) error {
+	if category.Name == "" {
+		return ErrCategoryNameRequired
+	}
+	return nil
+}
+
+// parentIsValid makes sure the parent exists and walks up the tree
+// to make sure the category is not its own ancestor.
+func (cv *categoryValidator) parentIsValid(category *Category) error {
+	parentID := category.ParentID
+	for parentID != "" {
+		if parentID == category.ID {
+			return ErrCategoryParentInvalid
+		}
+		parent, err := cv.CategoryDB.ByID(parentID)
+		if err == ErrNotFound {
+			return ErrCategoryParentInvalid
+		}
+		if err != nil {
+			return err
+		}
+		parentID = parent.ParentID
+	}
+	return nil
+}
+
+var _ CategoryDB = &categoryDB{}
+
+func newCategoryDB() *categoryDB {
+	db := &db.DB{}
+	return &categoryDB{
+		db: db,
+	}
+}
+
+type categoryDB struct {
+	db *db.DB
+}
+
+// ByID will look up a category with the provided ID.
+func (cdb *categoryDB) ByID(id string) (*Category, error) {
+	c := new(Category)
+	key := categoryTableQueryKey{
+		ID: id,
+	}
+	found, err := cdb.db.GetItem(key, dbCategoriesTableName, c)
+	if err != nil {
+		return nil, err
+	} else if found == false {
+		return nil, ErrNotFound
+	} else {
+		return c, nil
+	}
+}
+
+// All will scan every category
+func (cdb *categoryDB) All() ([]Category, error) {
+	categories := []Category{}
+	err := cdb.db.Scan(dbCategoriesTableName, "", nil, nil, &categories)
+	if err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+// Create will create the provided category in the database as long
+// as there isn't one with the same ID
+func (cdb *categoryDB) Create(category *Category) error {
+	err := cdb.db.ConditionalPutItem(dbCategoriesTableName, category, "attribute_not_exists(id)")
+	if err == db.ErrConditionFailed {
+		return ErrCategoryExists
+	}
+	return err
+}
+
+// Update will replace the stored category with the provided one
+func (cdb *categoryDB) Update(category *Category) error {
+	return cdb.db.PutItem(dbCategoriesTableName, category)
+}
+
+// Delete will delete the category with the provided ID
+func (cdb *categoryDB) Delete(id string) error {
+	key := categoryTableQueryKey{
+		ID: id,
+	}
+	return cdb.db.DeleteItem(dbCategoriesTableName, key)
+}
+
+type categoryTableQueryKey struct {
+	ID string `json:"id"`
+}
@@ -0,0 +1,41 @@
+package models
+
+// FavoriteView is a favorite joined with the current data of the
+// product. Price is the price when the favorite was added, and
+// PriceDropped is set when the product is cheaper now. Deleted
+// products are kept in the view so users know why they are gone.
+type FavoriteView struct {
+	Favorite
+	CurrentPrice int  `json:"current_price"`
+	Quantity     int  `json:"quantity"`
+	InStock      bool `json:"in_stock"`
+	Deleted      bool `json:"deleted"`
+	PriceDropped bool `json:"price_dropped"`
+}
+
+// FavoriteViews will join the favorites with the current products,
+// keeping the order of the favorites.
+func (ps *productsService) FavoriteViews(favorites []Favorite) ([]FavoriteView, error) {
+	views := []FavoriteView{}
+	for _, f := range favorites {
+		view := FavoriteView{
+			Favorite:     f,
+			CurrentPrice: f.Price,
+		}
+		product, err := ps.ProductDB.ByID(f.ID)
+		switch err {
+		case nil:
+			view.Name = product.Name
+			view.CurrentPrice = product.Price
+			view.Quantity = product.Quantity
+			view.InStock = product.Quantity > 0
+			view.PriceDropped = product.Price < f.Price
+		case ErrNotFound:
+			view.Deleted = true
+		default:
+			return nil, err
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
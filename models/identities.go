@@ -0,0 +1,237 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jcamilom/ecommerce/db"
+	"github.com/jcamilom/ecommerce/oidc"
+)
+
+var (
+	// The DB table name for the identities of the OpenID Connect
+	// providers
+	dbIdentitiesTableName = "Identities"
+
+	// The DB global secondary index to look up the identities of a
+	// user
+	dbIdentitiesEmailIndexName = "email-index"
+
+	// ErrIdentityEmailNotVerified is returned when logging in with a
+	// provider that didn't verify the email of the user, which is
+	// needed to link or create the account.
+	ErrIdentityEmailNotVerified = errors.New("models: the provider didn't verify the email address")
+
+	// ErrIdentityAccountNotVerified is returned when logging in with
+	// a provider for the first time with the email of an account
+	// that wasn't confirmed, as anyone could have registered it.
+	ErrIdentityAccountNotVerified = errors.New("models: confirm the email of your account before signing in with the provider")
+)
+
+// Length in bytes of the random password of the users created on
+// their first login with a provider
+const identityPasswordBytes = 32
+
+// Random passwords tried when one breaks the password policy
+const identityPasswordAttempts = 3
+
+// Identity links a user to the account of an OpenID Connect
+// provider. The ID is the provider name and the subject of the
+// account, joined by #.
+type Identity struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LoginWithIdentity returns the user linked to the account of the
+// provider. The first time, the account is linked to the user with
+// the same email, or a user is created with a wallet like on
+// Register. The provider must have verified the email in both cases,
+// and the user must have confirmed it too, otherwise whoever
+// registered the email would share the account.
+func (us *userService) LoginWithIdentity(provider string, claims *oidc.Claims) (*User, error) {
+	id := provider + "#" + claims.Subject
+	identity, err := us.identities.ByID(id)
+	if err == nil {
+		user, err := us.ByEmail(identity.Email)
+		if err != ErrNotFound {
+			return user, err
+		}
+		// The user was deleted without the identity, it is
+		// linked again below
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+	if !claims.EmailVerified {
+		return nil, ErrIdentityEmailNotVerified
+	}
+	user, err := us.ByEmail(claims.Email)
+	switch err {
+	case nil:
+		if user.VerificationPending {
+			return nil, ErrIdentityAccountNotVerified
+		}
+	case ErrNotFound:
+		user, err = us.registerWithIdentity(claims)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	err = us.identities.Create(&Identity{
+		ID:        id,
+		Email:     user.Email,
+		Provider:  provider,
+		Subject:   claims.Subject,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Identities returns the provider accounts linked to the user
+func (us *userService) Identities(user *User) ([]Identity, error) {
+	return us.identities.ByEmail(user.Email)
+}
+
+// registerWithIdentity creates the user of the claims. The password
+// is random, the user can set one with ForgotPassword.
+func (us *userService) registerWithIdentity(claims *oidc.Claims) (*User, error) {
+	name := strings.TrimSpace(claims.Name)
+	if name == "" {
+		name = strings.Split(claims.Email, "@")[0]
+	}
+	var user *User
+	for attempt := 0; ; attempt++ {
+		password, err := newRandomToken(identityPasswordBytes)
+		if err != nil {
+			return nil, err
+		}
+		user = &User{
+			Name:     name,
+			Email:    claims.Email,
+			Password: password,
+		}
+		err = us.register(user)
+		// A random password may contain a short name by chance
+		if _, ok := err.(*PasswordPolicyError); ok && attempt < identityPasswordAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	log.Printf("User %v registered with an OpenID Connect provider\n", user.Email)
+	return user, nil
+}
+
+// identityStore keeps the identities. It is the identityDB, the
+// interface lets the logins be tested without DynamoDB.
+type identityStore interface {
+	ByID(id string) (*Identity, error)
+	ByEmail(email string) ([]Identity, error)
+	Create(identity *Identity) error
+	ChangeEmail(oldEmail, newEmail string) error
+	DeleteByEmail(email string) error
+}
+
+var _ identityStore = &identityDB{}
+
+func newIdentityDB() *identityDB {
+	db := &db.DB{}
+	return &identityDB{
+		db: db,
+	}
+}
+
+type identityDB struct {
+	db *db.DB
+}
+
+// ByID will look up the identity with the provided ID
+func (idb *identityDB) ByID(id string) (*Identity, error) {
+	identity := new(Identity)
+	key := identityTableQueryKey{
+		ID: id,
+	}
+	found, err := idb.db.GetItem(key, dbIdentitiesTableName, identity)
+	if err != nil {
+		return nil, err
+	} else if found == false {
+		return nil, ErrNotFound
+	} else {
+		return identity, nil
+	}
+}
+
+// ByEmail will look up the identities of the user
+func (idb *identityDB) ByEmail(email string) ([]Identity, error) {
+	identities := []Identity{}
+	key := struct {
+		Email string `json:":e"`
+	}{
+		Email: email,
+	}
+	err := idb.db.QueryIndex(dbIdentitiesTableName, dbIdentitiesEmailIndexName, key, "email = :e", &identities)
+	if err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+// Create will create the provided identity in the database
+func (idb *identityDB) Create(identity *Identity) error {
+	return idb.db.PutItem(dbIdentitiesTableName, identity)
+}
+
+// ChangeEmail will move the identities of a user to the new email
+func (idb *identityDB) ChangeEmail(oldEmail, newEmail string) error {
+	identities, err := idb.ByEmail(oldEmail)
+	if err != nil {
+		return err
+	}
+	for _, identity := range identities {
+		key := identityTableQueryKey{
+			ID: identity.ID,
+		}
+		update := struct {
+			Email string `json:":e"`
+		}{
+			Email: newEmail,
+		}
+		if err := idb.db.UpdateItem(dbIdentitiesTableName, key, update, "set email = :e"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteByEmail will delete the identities of the user
+func (idb *identityDB) DeleteByEmail(email string) error {
+	identities, err := idb.ByEmail(email)
+	if err != nil {
+		return err
+	}
+	for _, identity := range identities {
+		key := identityTableQueryKey{
+			ID: identity.ID,
+		}
+		if err := idb.db.DeleteItem(dbIdentitiesTableName, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type identityTableQueryKey struct {
+	ID string `json:"id"`
+}
@@ -0,0 +1,182 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/jcamilom/ecommerce/oidc"
+)
+
+// memoryUserDB keeps the users by email. Only the lookups used by
+// the logins are implemented.
+type memoryUserDB struct {
+	UserDB
+	users map[string]*User
+}
+
+func (udb *memoryUserDB) ByEmail(email string) (*User, error) {
+	user, ok := udb.users[email]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return user, nil
+}
+
+// memoryIdentityStore keeps the identities by ID
+type memoryIdentityStore struct {
+	identities map[string]*Identity
+}
+
+func (is *memoryIdentityStore) ByID(id string) (*Identity, error) {
+	identity, ok := is.identities[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return identity, nil
+}
+
+func (is *memoryIdentityStore) ByEmail(email string) ([]Identity, error) {
+	identities := []Identity{}
+	for _, identity := range is.identities {
+		if identity.Email == email {
+			identities = append(identities, *identity)
+		}
+	}
+	return identities, nil
+}
+
+func (is *memoryIdentityStore) Create(identity *Identity) error {
+	is.identities[identity.ID] = identity
+	return nil
+}
+
+func (is *memoryIdentityStore) ChangeEmail(oldEmail, newEmail string) error {
+	for _, identity := range is.identities {
+		if identity.Email == oldEmail {
+			identity.Email = newEmail
+		}
+	}
+	return nil
+}
+
+func (is *memoryIdentityStore) DeleteByEmail(email string) error {
+	for id, identity := range is.identities {
+		if identity.Email == email {
+			delete(is.identities, id)
+		}
+	}
+	return nil
+}
+
+func newTestIdentityService(users ...*User) (*userService, *memoryIdentityStore) {
+	udb := &memoryUserDB{
+		users: map[string]*User{},
+	}
+	for _, u := range users {
+		udb.users[u.Email] = u
+	}
+	store := &memoryIdentityStore{
+		identities: map[string]*Identity{},
+	}
+	return &userService{
+		UserDB:     udb,
+		identities: store,
+	}, store
+}
+
+func testClaims() *oidc.Claims {
+	return &oidc.Claims{
+		Subject:       "subject",
+		Email:         "user@example.com",
+		EmailVerified: true,
+		Name:          "User",
+	}
+}
+
+func TestLoginWithIdentityLinked(t *testing.T) {
+	user := &User{Email: "user@example.com"}
+	us, store := newTestIdentityService(user)
+	store.Create(&Identity{ID: "mock#subject", Email: user.Email})
+	claims := testClaims()
+	// The provider email doesn't matter once the account is linked
+	claims.Email = "other@example.com"
+	claims.EmailVerified = false
+	got, err := us.LoginWithIdentity("mock", claims)
+	if err != nil {
+		t.Fatalf("LoginWithIdentity returned %v", err)
+	}
+	if got != user {
+		t.Errorf("LoginWithIdentity returned %+v", got)
+	}
+}
+
+func TestLoginWithIdentityLinksVerifiedAccount(t *testing.T) {
+	user := &User{Email: "user@example.com"}
+	us, store := newTestIdentityService(user)
+	got, err := us.LoginWithIdentity("mock", testClaims())
+	if err != nil {
+		t.Fatalf("LoginWithIdentity returned %v", err)
+	}
+	if got != user {
+		t.Errorf("LoginWithIdentity returned %+v", got)
+	}
+	identity, err := store.ByID("mock#subject")
+	if err != nil {
+		t.Fatalf("the identity wasn't linked: %v", err)
+	}
+	if identity.Email != user.Email || identity.Provider != "mock" || identity.Subject != "subject" {
+		t.Errorf("the identity was linked as %+v", identity)
+	}
+}
+
+func TestLoginWithIdentityRelinksDeletedUser(t *testing.T) {
+	user := &User{Email: "user@example.com"}
+	us, store := newTestIdentityService(user)
+	// Left over from a deleted user
+	store.Create(&Identity{ID: "mock#subject", Email: "deleted@example.com"})
+	got, err := us.LoginWithIdentity("mock", testClaims())
+	if err != nil {
+		t.Fatalf("LoginWithIdentity returned %v", err)
+	}
+	if got != user {
+		t.Errorf("LoginWithIdentity returned %+v", got)
+	}
+	if identity, _ := store.ByID("mock#subject"); identity.Email != user.Email {
+		t.Errorf("the identity is linked to %v", identity.Email)
+	}
+}
+
+func TestLoginWithIdentityRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   *User
+		claims func(*oidc.Claims)
+		want   error
+	}{
+		{
+			name:   "email not verified by the provider",
+			user:   &User{Email: "user@example.com"},
+			claims: func(c *oidc.Claims) { c.EmailVerified = false },
+			want:   ErrIdentityEmailNotVerified,
+		},
+		{
+			name:   "account not verified",
+			user:   &User{Email: "user@example.com", VerificationPending: true},
+			claims: func(c *oidc.Claims) {},
+			want:   ErrIdentityAccountNotVerified,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us, store := newTestIdentityService(tt.user)
+			claims := testClaims()
+			tt.claims(claims)
+			_, err := us.LoginWithIdentity("mock", claims)
+			if err != tt.want {
+				t.Errorf("LoginWithIdentity returned %v, want %v", err, tt.want)
+			}
+			if len(store.identities) != 0 {
+				t.Errorf("the identity was linked: %+v", store.identities)
+			}
+		})
+	}
+}
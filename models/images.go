@@ -0,0 +1,185 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+
+	// Register the GIF decoder for image.Decode
+	_ "image/gif"
+
+	"github.com/jcamilom/ecommerce/thumbnail"
+)
+
+var (
+	// ErrImageInvalid is returned when an uploaded file is not
+	// a JPEG, PNG or GIF image.
+	ErrImageInvalid = errors.New("models: image must be a JPEG, PNG or GIF file")
+
+	// ErrImageTooLarge is returned when an uploaded image is
+	// bigger than MaxImageSize or MaxImagePixels.
+	ErrImageTooLarge = errors.New("models: image is too large")
+
+	// ErrImageNotFound is returned when the image ID doesn't match
+	// any image of the product.
+	ErrImageNotFound = errors.New("models: image not found")
+)
+
+// MaxImageSize is the max size in bytes of an uploaded image
+const MaxImageSize = 10 << 20
+
+// MaxImagePixels is the max width times height of an uploaded image.
+// A small file can decompress to a huge image, so the size of the
+// file isn't enough.
+const MaxImagePixels = 40000000
+
+// Quality of the JPEG thumbnails
+const thumbnailJPEGQuality = 85
+
+// Image is a picture of a product. The original file is kept
+// along with thumbnails in the sizes defined by thumbnail.Sizes.
+type Image struct {
+	ID         string      `json:"id"`
+	Key        string      `json:"key"`
+	URL        string      `json:"url"`
+	Thumbnails []Thumbnail `json:"thumbnails"`
+}
+
+// Thumbnail is a scaled down version of an image
+type Thumbnail struct {
+	Size   string `json:"size"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Key    string `json:"key"`
+	URL    string `json:"url"`
+}
+
+// AddImage will store the image read from r and its thumbnails
+// in the blob store and add it to the product images.
+func (ps *productsService) AddImage(product *Product, r io.Reader) (*Image, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxImageSize {
+		return nil, ErrImageTooLarge
+	}
+	// The dimensions are read from the header before decoding
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrImageInvalid
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrImageInvalid
+	}
+	if config.Width > MaxImagePixels/config.Height {
+		return nil, ErrImageTooLarge
+	}
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrImageInvalid
+	}
+	id, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := fmt.Sprintf("products/%v/%v", product.ID, id)
+	img := &Image{
+		ID:         id,
+		Key:        fmt.Sprintf("%v/original.%v", prefix, format),
+		Thumbnails: []Thumbnail{},
+	}
+	img.URL = ps.blobs.URL(img.Key)
+	err = ps.blobs.Put(img.Key, bytes.NewReader(data), "image/"+format)
+	if err != nil {
+		return nil, err
+	}
+	for _, size := range thumbnail.Sizes {
+		t, err := ps.putThumbnail(src, format, prefix, size)
+		if err != nil {
+			ps.deleteImageBlobs(img)
+			return nil, err
+		}
+		img.Thumbnails = append(img.Thumbnails, *t)
+	}
+
+	product.Images = append(product.Images, *img)
+	if err := ps.ProductDB.SetImages(product); err != nil {
+		ps.deleteImageBlobs(img)
+		return nil, err
+	}
+	return img, nil
+}
+
+// RemoveImage will remove the image from the product images and
+// delete its files from the blob store.
+func (ps *productsService) RemoveImage(product *Product, imageID string) error {
+	images := []Image{}
+	var removed *Image
+	for i, img := range product.Images {
+		if img.ID == imageID {
+			removed = &product.Images[i]
+			continue
+		}
+		images = append(images, img)
+	}
+	if removed == nil {
+		return ErrImageNotFound
+	}
+	product.Images = images
+	if err := ps.ProductDB.SetImages(product); err != nil {
+		return err
+	}
+	ps.deleteImageBlobs(removed)
+	return nil
+}
+
+// putThumbnail stores a thumbnail of src. PNG and GIF images are
+// saved as PNG to keep their transparency, the rest as JPEG.
+func (ps *productsService) putThumbnail(src image.Image, format, prefix string, size thumbnail.Size) (*Thumbnail, error) {
+	dst := thumbnail.Resize(src, size.Max)
+	buf := new(bytes.Buffer)
+	ext, contentType := "jpeg", "image/jpeg"
+	var err error
+	if format == "png" || format == "gif" {
+		ext, contentType = "png", "image/png"
+		err = png.Encode(buf, dst)
+	} else {
+		err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &Thumbnail{
+		Size:   size.Name,
+		Width:  dst.Bounds().Dx(),
+		Height: dst.Bounds().Dy(),
+		Key:    fmt.Sprintf("%v/%v.%v", prefix, size.Name, ext),
+	}
+	t.URL = ps.blobs.URL(t.Key)
+	if err := ps.blobs.Put(t.Key, buf, contentType); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// deleteImageBlobs deletes the files of the image. Failures are only
+// logged since the image is no longer referenced by the product.
+func (ps *productsService) deleteImageBlobs(img *Image) {
+	keys := []string{img.Key}
+	for _, t := range img.Thumbnails {
+		keys = append(keys, t.Key)
+	}
+	for _, key := range keys {
+		if err := ps.blobs.Delete(key); err != nil {
+			log.Println("Unable to delete image file", key, err)
+		}
+	}
+}
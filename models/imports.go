@@ -0,0 +1,159 @@
+package models
+
+import (
+	"errors"
+)
+
+// ErrProductIDRepeated is returned for an import row with the same
+// product ID as a previous row.
+var ErrProductIDRepeated = errors.New("models: product id is repeated in the import")
+
+// Actions reported for every import row
+const (
+	ImportActionCreate = "create"
+	ImportActionUpdate = "update"
+)
+
+// ImportRow is a product read from an import file. Err is set when
+// the row couldn't be parsed, the row is then reported as failed.
+type ImportRow struct {
+	Line    int
+	Product Product
+	// Columns are the fields of the product set in the file, named
+	// like in JSON. The others keep their stored value when the
+	// product is updated. Nil means every field is set.
+	Columns []string
+	Err     error
+}
+
+// ImportReport is the result of importing a set of rows
+type ImportReport struct {
+	DryRun  bool              `json:"dry_run"`
+	Created int               `json:"created"`
+	Updated int               `json:"updated"`
+	Failed  int               `json:"failed"`
+	Rows    []ImportRowResult `json:"rows"`
+}
+
+// ImportRowResult is the result of importing a single row. Action is
+// what was done, or would be done on a dry run, with the product.
+type ImportRowResult struct {
+	Line   int    `json:"line"`
+	ID     string `json:"id"`
+	Action string `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Import will create the products of the rows that don't exist yet
+// and update the ones that do. Rows are imported one by one, so an
+// invalid row doesn't stop the rest. On a dry run the rows are
+// validated the same way but nothing is written.
+//
+// The returned error is only set if something goes wrong reading the
+// catalog, validation errors are reported in the rows.
+func (ps *productsService) Import(rows []ImportRow, dryRun bool) (*ImportReport, error) {
+	report := &ImportReport{
+		DryRun: dryRun,
+		Rows:   []ImportRowResult{},
+	}
+	seen := map[string]bool{}
+	for _, row := range rows {
+		product := row.Product
+		result := ImportRowResult{
+			Line: row.Line,
+			ID:   product.ID,
+		}
+		err := row.Err
+		if err == nil && product.ID != "" && seen[product.ID] {
+			err = ErrProductIDRepeated
+		}
+		if err == nil {
+			seen[product.ID] = true
+			result.Action, err = ps.importProduct(&product, row.Columns, dryRun)
+			if err != nil && !isValidationError(err) {
+				return nil, err
+			}
+		}
+		switch {
+		case err != nil:
+			result.Action = ""
+			result.Error = err.Error()
+			report.Failed++
+		case result.Action == ImportActionCreate:
+			result.ID = product.ID
+			report.Created++
+		default:
+			report.Updated++
+		}
+		report.Rows = append(report.Rows, result)
+	}
+	return report, nil
+}
+
+// importProduct upserts the product, returning the action taken.
+// An update only changes the columns of the row.
+func (ps *productsService) importProduct(product *Product, columns []string, dryRun bool) (string, error) {
+	action := ImportActionCreate
+	if product.ID != "" {
+		stored, err := ps.ProductDB.ByID(product.ID)
+		switch err {
+		case nil:
+			action = ImportActionUpdate
+			if columns != nil {
+				*product = mergeImportColumns(*stored, product, columns)
+			}
+		case ErrNotFound:
+		default:
+			return "", err
+		}
+	}
+	var err error
+	switch {
+	case dryRun && action == ImportActionCreate:
+		err = ps.validator.validateCreate(product)
+	case dryRun:
+		err = ps.validator.validateUpdate(product)
+	case action == ImportActionCreate:
+		err = ps.Create(product)
+	default:
+		err = ps.Update(product)
+	}
+	return action, err
+}
+
+// mergeImportColumns returns the stored product with the columns of
+// the imported one
+func mergeImportColumns(stored Product, imported *Product, columns []string) Product {
+	for _, c := range columns {
+		switch c {
+		case "name":
+			stored.Name = imported.Name
+		case "price":
+			stored.Price = imported.Price
+		case "quantity":
+			stored.Quantity = imported.Quantity
+		case "category_id":
+			stored.CategoryID = imported.CategoryID
+		case "tags":
+			stored.Tags = imported.Tags
+		case "attributes":
+			stored.Attributes = imported.Attributes
+		case "variants":
+			stored.Variants = imported.Variants
+		}
+	}
+	return stored
+}
+
+// isValidationError returns true for the errors caused by an invalid
+// product, as opposed to errors talking to the database.
+func isValidationError(err error) bool {
+	switch err {
+	case ErrProductIDRequired, ErrProductIDRepeated, ErrProductNameRequired,
+		ErrProductPriceInvalid, ErrProductQuantityInvalid,
+		ErrAttributeNameRequired, ErrAttributeTypeInvalid, ErrAttributeValueInvalid,
+		ErrCategoryInvalid, ErrSKURequired, ErrSKUTaken:
+		return true
+	}
+	return false
+}
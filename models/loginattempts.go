@@ -0,0 +1,330 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/jcamilom/ecommerce/db"
+	"github.com/jcamilom/ecommerce/notify"
+)
+
+var (
+	// The DB table name for the failed logins of the accounts and IP
+	// addresses
+	dbLoginAttemptsTableName = "LoginAttempts"
+
+	// ErrUnlockTokenInvalid is returned when an unlock token is
+	// invalid, expired or for an unknown user.
+	ErrUnlockTokenInvalid = errors.New("models: unlock token is invalid or expired")
+)
+
+// Kind of the messages sent when an account is locked out
+const NotificationAccountLocked = "account_locked"
+
+// Failed logins of an account allowed before each new one makes the
+// next wait twice as long
+const accountFreeAttempts = 5
+
+// Failed logins of an account that lock it out for
+// accountLockoutTime, or until it is unlocked by email
+const accountLockoutAttempts = 10
+
+const accountLockoutTime = time.Hour
+
+// Failed logins from an IP address allowed before the backoff
+// starts. It is higher than for accounts since many users can share
+// an address.
+const ipFreeAttempts = 20
+
+// Wait after the first failed login over the free attempts, and the
+// longest wait of the backoff
+const loginBackoffBase = time.Second
+const loginBackoffMax = 15 * time.Minute
+
+// The failed logins are forgotten after this time without a new one
+const loginAttemptsWindow = 24 * time.Hour
+
+// Unlock token expire time, the same as the lockout
+const unlockExpireTime = accountLockoutTime
+
+// LockoutError is returned while the account or the IP address of a
+// login has to wait after too many failed logins
+type LockoutError struct {
+	// Until is when the login can be tried again
+	Until time.Time
+	// Locked is set when the account is locked out, in which case
+	// an unlock link was emailed to the user
+	Locked bool
+}
+
+func (e *LockoutError) Error() string {
+	if e.Locked {
+		return "models: account locked after too many failed logins, check your email to unlock it"
+	}
+	return "models: too many failed logins, try again later"
+}
+
+// loginAttempt counts the failed logins of an account or an IP
+// address. Successful logins reset the ones of the account.
+type loginAttempt struct {
+	Key         string    `json:"attempt_key"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+	// TTL is the expiry time in unix seconds, so DynamoDB deletes
+	// the attempts after loginAttemptsWindow
+	TTL int64 `json:"ttl"`
+}
+
+// UnlockAccount forgets the failed logins of the user of the token
+// of the unlock link. The token works only once.
+func (us *userService) UnlockAccount(token string) (*User, error) {
+	unlock, err := us.tokens.Valid(tokenPurposeUnlock, token)
+	if err == ErrNotFound {
+		return nil, ErrUnlockTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	user, err := us.ByEmail(unlock.Email)
+	if err == ErrNotFound {
+		return nil, ErrUnlockTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = us.tokens.MarkUsed(unlock)
+	if err == ErrNotFound {
+		return nil, ErrUnlockTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := us.attempts.Delete(accountAttemptKey(user.Email)); err != nil {
+		return nil, err
+	}
+	us.audit(AuditAccountUnlocked, user.Email, "")
+	return user, nil
+}
+
+// checkPassword checks the password of a signed in user before a
+// sensitive action. Wrong passwords count as failed logins, so they
+// can't be guessed with a stolen session.
+func (us *userService) checkPassword(user *User, password, ip string) error {
+	if err := us.checkLockout(user.Email, ip); err != nil {
+		return err
+	}
+	err := us.comparePassword(user, password)
+	if err == ErrPasswordIncorrect {
+		if ferr := us.loginFailed(user.Email, ip); ferr != nil {
+			return ferr
+		}
+	}
+	return err
+}
+
+// checkLockout returns a LockoutError if the account or the IP
+// address has to wait before trying again
+func (us *userService) checkLockout(email, ip string) error {
+	now := time.Now()
+	lockout := &LockoutError{}
+	for _, key := range loginAttemptKeys(email, ip) {
+		attempt, err := us.attempts.ByKey(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if attempt.LockedUntil.After(now) && attempt.LockedUntil.After(lockout.Until) {
+			lockout.Until = attempt.LockedUntil
+			lockout.Locked = key == accountAttemptKey(email) && attempt.Failures >= accountLockoutAttempts
+		}
+	}
+	if lockout.Until.IsZero() {
+		return nil
+	}
+	us.audit(AuditLoginThrottled, email, ip)
+	return lockout
+}
+
+// loginFailed counts a failed login for the account and the IP
+// address and makes them wait. The user is emailed an unlock link
+// when the account gets locked out.
+func (us *userService) loginFailed(email, ip string) error {
+	us.audit(AuditLoginFailed, email, ip)
+	now := time.Now()
+	for _, key := range loginAttemptKeys(email, ip) {
+		attempt, err := us.attempts.AddFailure(key, now)
+		if err != nil {
+			return err
+		}
+		free := ipFreeAttempts
+		if key == accountAttemptKey(email) {
+			free = accountFreeAttempts
+			if attempt.Failures >= accountLockoutAttempts {
+				if err := us.attempts.Lock(key, now.Add(accountLockoutTime)); err != nil {
+					return err
+				}
+				us.audit(AuditAccountLocked, email, ip)
+				if err := us.sendUnlock(email); err != nil {
+					log.Println("Unable to send the unlock link to", email, err)
+				}
+				continue
+			}
+		}
+		if wait := loginBackoff(attempt.Failures, free); wait > 0 {
+			if err := us.attempts.Lock(key, now.Add(wait)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sendUnlock emails the unlock link to the user of the email, if
+// there is one
+func (us *userService) sendUnlock(email string) error {
+	user, err := us.ByEmail(email)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	token, err := us.newOneTimeToken(tokenPurposeUnlock, user.Email, unlockExpireTime)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%v/users/unlock?token=%v", us.baseURL, url.QueryEscape(token))
+	return us.notifier.Notify(notify.Message{
+		To:      user.Email,
+		Kind:    NotificationAccountLocked,
+		Subject: "Your account was locked",
+		Body: fmt.Sprintf("Hi %v, your account was locked for %v after too many failed logins. If it was you, open this link to unlock it: %v\nIf it wasn't, change your password.",
+			user.Name, accountLockoutTime, link),
+		Data: map[string]string{
+			"link": link,
+		},
+	})
+}
+
+// loginBackoff is the wait after the failures, which doubles with
+// each failure over the free ones
+func loginBackoff(failures, free int) time.Duration {
+	if failures <= free {
+		return 0
+	}
+	wait := loginBackoffBase
+	for i := free + 1; i < failures && wait < loginBackoffMax; i++ {
+		wait *= 2
+	}
+	if wait > loginBackoffMax {
+		wait = loginBackoffMax
+	}
+	return wait
+}
+
+func accountAttemptKey(email string) string {
+	return "account#" + strings.ToLower(email)
+}
+
+// loginAttemptKeys returns the keys of the attempts of the account
+// and, if it is known, the IP address
+func loginAttemptKeys(email, ip string) []string {
+	keys := []string{accountAttemptKey(email)}
+	if ip != "" {
+		keys = append(keys, "ip#"+ip)
+	}
+	return keys
+}
+
+func newLoginAttemptDB() *loginAttemptDB {
+	db := &db.DB{}
+	return &loginAttemptDB{
+		db: db,
+	}
+}
+
+type loginAttemptDB struct {
+	db *db.DB
+}
+
+// ByKey will look up the attempts with the key. The attempts older
+// than loginAttemptsWindow are not found, even if DynamoDB didn't
+// delete them yet.
+func (adb *loginAttemptDB) ByKey(key string) (*loginAttempt, error) {
+	attempt := new(loginAttempt)
+	found, err := adb.db.GetItem(loginAttemptTableQueryKey{Key: key}, dbLoginAttemptsTableName, attempt)
+	if err != nil {
+		return nil, err
+	} else if found == false || attempt.TTL < time.Now().Unix() {
+		return nil, ErrNotFound
+	} else {
+		return attempt, nil
+	}
+}
+
+// AddFailure will count a failed login, atomically so the instances
+// of the API share the count, and return the attempts after it
+func (adb *loginAttemptDB) AddFailure(key string, now time.Time) (*loginAttempt, error) {
+	tableKey := loginAttemptTableQueryKey{
+		Key: key,
+	}
+	update := struct {
+		One int   `json:":one"`
+		TTL int64 `json:":t"`
+		Now int64 `json:":now"`
+	}{
+		One: 1,
+		TTL: now.Add(loginAttemptsWindow).Unix(),
+		Now: now.Unix(),
+	}
+	// ttl is a reserved word
+	names := map[string]*string{
+		"#t": aws.String("ttl"),
+	}
+	attempt := new(loginAttempt)
+	updateExp := "add failures :one set #t = :t"
+	condExp := "attribute_not_exists(attempt_key) OR #t > :now"
+	err := adb.db.UpdateItemReturning(dbLoginAttemptsTableName, tableKey, update, updateExp, condExp, names, attempt)
+	if err != db.ErrConditionFailed {
+		return attempt, err
+	}
+	// The attempts are older than the window, they start over
+	attempt = &loginAttempt{
+		Key:      key,
+		Failures: 1,
+		TTL:      update.TTL,
+	}
+	if err := adb.db.PutItem(dbLoginAttemptsTableName, attempt); err != nil {
+		return nil, err
+	}
+	return attempt, nil
+}
+
+// Lock will make the login with the key wait until the time
+func (adb *loginAttemptDB) Lock(key string, until time.Time) error {
+	tableKey := loginAttemptTableQueryKey{
+		Key: key,
+	}
+	update := struct {
+		Until time.Time `json:":u"`
+	}{
+		Until: until,
+	}
+	return adb.db.UpdateItem(dbLoginAttemptsTableName, tableKey, update, "set locked_until = :u")
+}
+
+// Delete will forget the attempts with the key
+func (adb *loginAttemptDB) Delete(key string) error {
+	return adb.db.DeleteItem(dbLoginAttemptsTableName, loginAttemptTableQueryKey{Key: key})
+}
+
+type loginAttemptTableQueryKey struct {
+	Key string `json:"attempt_key"`
+}
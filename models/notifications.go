@@ -0,0 +1,308 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jcamilom/ecommerce/db"
+	"github.com/jcamilom/ecommerce/notify"
+)
+
+var (
+	// The DB table name for the sent notifications
+	dbNotificationsTableName = "Notifications"
+)
+
+// Kinds of notifications
+const (
+	NotificationPriceDrop   = "price_drop"
+	NotificationBackInStock = "back_in_stock"
+)
+
+// A notification of the same kind about the same product is sent
+// at most once in this window
+const notificationDedupWindow = 24 * time.Hour
+
+// Number of product changes that may wait for the worker before
+// ProductChanged blocks
+const notificationQueueSize = 1000
+
+// NotificationPrefs are the notifications the user wants to get
+// about the products in the favorites list
+type NotificationPrefs struct {
+	PriceDrop   bool `json:"price_drop"`
+	BackInStock bool `json:"back_in_stock"`
+}
+
+// NotificationPrefsOrDefault returns the notification preferences of
+// the user. Users that never changed them get every notification.
+func (u *User) NotificationPrefsOrDefault() NotificationPrefs {
+	if u.NotificationPrefs == nil {
+		return NotificationPrefs{
+			PriceDrop:   true,
+			BackInStock: true,
+		}
+	}
+	return *u.NotificationPrefs
+}
+
+// NotificationService notifies the users about changes of the
+// products in their favorites list
+type NotificationService interface {
+	// ProductChanged notifies, in the background, the users with the
+	// product in their favorites if its price dropped or it is back
+	// in stock.
+	ProductChanged(before, after *Product)
+	// Wait blocks until the notifications in the background are sent
+	Wait()
+}
+
+// NewNotificationService creates the service and starts the worker
+// that sends the notifications
+func NewNotificationService(udb UserDB, notifier notify.Notifier) NotificationService {
+	ns := &notificationService{
+		users:    udb,
+		notifier: notifier,
+		sent:     newSentNotificationDB(),
+		queue:    make(chan productChange, notificationQueueSize),
+	}
+	go ns.work()
+	return ns
+}
+
+var _ NotificationService = &notificationService{}
+
+type notificationService struct {
+	users    UserDB
+	notifier notify.Notifier
+	sent     *sentNotificationDB
+	// queue has the changes waiting for the worker. wg counts the
+	// ones not sent yet.
+	queue chan productChange
+	wg    sync.WaitGroup
+}
+
+// productChange is a change of a product the favorites are
+// notified about
+type productChange struct {
+	before, after Product
+	priceDropped  bool
+	backInStock   bool
+}
+
+func (ns *notificationService) ProductChanged(before, after *Product) {
+	if before == nil || after == nil {
+		return
+	}
+	priceDropped := after.Price < before.Price
+	backInStock := before.Quantity <= 0 && after.Quantity > 0
+	if !priceDropped && !backInStock {
+		return
+	}
+	// Copies are queued so the caller may keep changing the product
+	ns.wg.Add(1)
+	ns.queue <- productChange{
+		before:       *before,
+		after:        *after,
+		priceDropped: priceDropped,
+		backInStock:  backInStock,
+	}
+}
+
+func (ns *notificationService) Wait() {
+	ns.wg.Wait()
+}
+
+// work sends the notifications of the queued changes. The changes
+// queued while the users were being read are sent together, so an
+// import of many products reads the users a few times instead of
+// once per product.
+func (ns *notificationService) work() {
+	for change := range ns.queue {
+		changes := []productChange{change}
+		for len(ns.queue) > 0 {
+			changes = append(changes, <-ns.queue)
+		}
+		if err := ns.notifyFavorites(changes); err != nil {
+			log.Println("Unable to send the notifications of", len(changes), "products", err)
+		}
+		ns.wg.Add(-len(changes))
+	}
+}
+
+func (ns *notificationService) notifyFavorites(changes []productChange) error {
+	ids := make([]string, len(changes))
+	for i, c := range changes {
+		ids[i] = c.after.ID
+	}
+	users, err := ns.users.ByFavorites(ids)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		prefs := user.NotificationPrefsOrDefault()
+		for i := range changes {
+			if hasFavorite(&user, changes[i].after.ID) {
+				ns.notifyChange(&user, prefs, &changes[i])
+			}
+		}
+	}
+	return nil
+}
+
+func (ns *notificationService) notifyChange(user *User, prefs NotificationPrefs, change *productChange) {
+	before, after := &change.before, &change.after
+	if change.priceDropped && prefs.PriceDrop {
+		msg := notify.Message{
+			To:      user.Email,
+			Kind:    NotificationPriceDrop,
+			Subject: fmt.Sprintf("%v is cheaper now", after.Name),
+			Body:    fmt.Sprintf("Hi %v, %v from your favorites dropped from %v to %v lumens.", user.Name, after.Name, before.Price, after.Price),
+			Data: map[string]string{
+				"product_id": after.ID,
+				"old_price":  fmt.Sprint(before.Price),
+				"price":      fmt.Sprint(after.Price),
+			},
+		}
+		ns.send(msg, after)
+	}
+	if change.backInStock && prefs.BackInStock {
+		msg := notify.Message{
+			To:      user.Email,
+			Kind:    NotificationBackInStock,
+			Subject: fmt.Sprintf("%v is back in stock", after.Name),
+			Body:    fmt.Sprintf("Hi %v, %v from your favorites is available again.", user.Name, after.Name),
+			Data: map[string]string{
+				"product_id": after.ID,
+			},
+		}
+		ns.send(msg, after)
+	}
+}
+
+// hasFavorite returns true if the product is in the favorites
+// of the user
+func hasFavorite(user *User, productID string) bool {
+	for _, f := range user.Favorites {
+		if f.ID == productID {
+			return true
+		}
+	}
+	return false
+}
+
+// send delivers the message unless the user was already notified.
+// Errors are logged so one user doesn't stop the rest.
+func (ns *notificationService) send(msg notify.Message, product *Product) {
+	key := msg.Kind + "#" + product.ID
+	last, err := ns.sent.ByKey(msg.To, key)
+	if err != nil && err != ErrNotFound {
+		log.Println("Unable to check the notifications sent to", msg.To, err)
+		return
+	}
+	if last != nil && isDuplicateNotification(last, msg.Kind, product) {
+		return
+	}
+	if err := ns.notifier.Notify(msg); err != nil {
+		log.Println("Unable to notify", msg.To, err)
+		return
+	}
+	err = ns.sent.Create(&sentNotification{
+		Email:  msg.To,
+		Key:    key,
+		Price:  product.Price,
+		SentAt: time.Now(),
+	})
+	if err != nil {
+		log.Println("Unable to save the notification sent to", msg.To, err)
+	}
+}
+
+// isDuplicateNotification returns true if the user got the same kind
+// of notification about the product recently. A price drop below the
+// price the user was told about is sent anyway.
+func isDuplicateNotification(last *sentNotification, kind string, product *Product) bool {
+	if time.Since(last.SentAt) >= notificationDedupWindow {
+		return false
+	}
+	if kind == NotificationPriceDrop && product.Price < last.Price {
+		return false
+	}
+	return true
+}
+
+// sentNotification is the last notification of a kind about
+// a product sent to a user. Key is "<kind>#<product id>".
+type sentNotification struct {
+	Email  string    `json:"email"`
+	Key    string    `json:"key"`
+	Price  int       `json:"price"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+func newSentNotificationDB() *sentNotificationDB {
+	db := &db.DB{}
+	return &sentNotificationDB{
+		db: db,
+	}
+}
+
+type sentNotificationDB struct {
+	db *db.DB
+}
+
+// ByKey will look up the last notification sent to the user
+// with the provided key
+func (sdb *sentNotificationDB) ByKey(email, key string) (*sentNotification, error) {
+	sn := new(sentNotification)
+	k := struct {
+		Email string `json:"email"`
+		Key   string `json:"key"`
+	}{
+		Email: email,
+		Key:   key,
+	}
+	found, err := sdb.db.GetItem(k, dbNotificationsTableName, sn)
+	if err != nil {
+		return nil, err
+	} else if found == false {
+		return nil, ErrNotFound
+	} else {
+		return sn, nil
+	}
+}
+
+// DeleteByEmail will delete every notification sent to the user
+func (sdb *sentNotificationDB) DeleteByEmail(email string) error {
+	sent := []sentNotification{}
+	key := struct {
+		Email string `json:":e"`
+	}{
+		Email: email,
+	}
+	err := sdb.db.GetItems(dbNotificationsTableName, key, "email = :e", "", nil, &sent)
+	if err != nil {
+		return err
+	}
+	for _, sn := range sent {
+		k := struct {
+			Email string `json:"email"`
+			Key   string `json:"key"`
+		}{
+			Email: sn.Email,
+			Key:   sn.Key,
+		}
+		if err := sdb.db.DeleteItem(dbNotificationsTableName, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create will save the notification, replacing the previous one
+// with the same key
+func (sdb *sentNotificationDB) Create(sn *sentNotification) error {
+	return sdb.db.PutItem(dbNotificationsTableName, sn)
+}
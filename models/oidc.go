@@ -0,0 +1,197 @@
+package models
+
+import (
+	"crypto/subtle"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/jcamilom/ecommerce/db"
+	"github.com/jcamilom/ecommerce/oidc"
+)
+
+var (
+	// The DB table name for the logins in progress with a provider
+	dbOIDCLoginsTableName = "OIDCLogins"
+
+	// ErrProviderNotFound is returned when logging in with a provider
+	// that isn't configured.
+	ErrProviderNotFound = errors.New("models: login provider not found")
+
+	// ErrOIDCStateInvalid is returned when the state of a provider
+	// callback doesn't match a login in progress, or it expired.
+	ErrOIDCStateInvalid = errors.New("models: login state is invalid or expired")
+)
+
+// OIDCLoginExpireTime is the time the user has to log in with the
+// provider
+const OIDCLoginExpireTime = 10 * time.Minute
+
+// Length in bytes of the random state, nonce and PKCE verifier
+const oidcLoginTokenBytes = 32
+
+// OIDCService logs the users in with OpenID Connect providers,
+// using the authorization code flow with PKCE
+type OIDCService interface {
+	// Providers returns the names of the configured providers
+	Providers() []string
+	// AuthURL starts a login and returns the address of the
+	// provider the user is sent to, and the binding the client must
+	// keep, like in a cookie, to finish the login
+	AuthURL(provider string) (url, binding string, err error)
+	// Login finishes the login started by AuthURL with the state and
+	// code of the provider callback and the binding of the client
+	// that started it
+	Login(provider, state, binding, code string) (*User, error)
+}
+
+// NewOIDCService creates the OpenID Connect service with the
+// providers by name
+func NewOIDCService(us UserService, providers map[string]*oidc.Provider) OIDCService {
+	return &oidcService{
+		us:        us,
+		providers: providers,
+		logins:    newOIDCLoginDB(),
+	}
+}
+
+var _ OIDCService = &oidcService{}
+
+type oidcService struct {
+	us        UserService
+	providers map[string]*oidc.Provider
+	logins    *oidcLoginDB
+}
+
+// oidcLogin is a login in progress. Only the hash of the state is
+// stored, the verifier and nonce never leave the API.
+type oidcLogin struct {
+	StateHash string    `json:"state_hash"`
+	Provider  string    `json:"provider"`
+	Verifier  string    `json:"verifier"`
+	Nonce     string    `json:"nonce"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// TTL is the expiry time in unix seconds, so DynamoDB deletes
+	// the abandoned logins
+	TTL int64 `json:"ttl"`
+}
+
+func (s *oidcService) Providers() []string {
+	names := []string{}
+	for name := range s.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AuthURL returns the hash of the state as the binding, so only the
+// client that started the login can finish it
+func (s *oidcService) AuthURL(provider string) (string, string, error) {
+	p, ok := s.providers[provider]
+	if !ok {
+		return "", "", ErrProviderNotFound
+	}
+	var values [3]string
+	for i := range values {
+		v, err := newRandomToken(oidcLoginTokenBytes)
+		if err != nil {
+			return "", "", err
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+	url, err := p.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		return "", "", err
+	}
+	expiresAt := time.Now().Add(OIDCLoginExpireTime)
+	err = s.logins.Create(&oidcLogin{
+		StateHash: hashToken(state),
+		Provider:  provider,
+		Verifier:  verifier,
+		Nonce:     nonce,
+		ExpiresAt: expiresAt,
+		TTL:       expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return url, hashToken(state), nil
+}
+
+func (s *oidcService) Login(provider, state, binding, code string) (*User, error) {
+	p, ok := s.providers[provider]
+	if !ok {
+		return nil, ErrProviderNotFound
+	}
+	// A callback of a login started by someone else, like a forged
+	// link, is rejected before spending the state
+	stateHash := hashToken(state)
+	if subtle.ConstantTimeCompare([]byte(binding), []byte(stateHash)) != 1 {
+		return nil, ErrOIDCStateInvalid
+	}
+	login, err := s.logins.ByStateHash(stateHash)
+	if err == ErrNotFound {
+		return nil, ErrOIDCStateInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The state can only be used once
+	if err := s.logins.Delete(login.StateHash); err != nil {
+		return nil, err
+	}
+	if login.Provider != provider || time.Now().After(login.ExpiresAt) {
+		return nil, ErrOIDCStateInvalid
+	}
+	claims, err := p.Exchange(code, login.Verifier, login.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	return s.us.LoginWithIdentity(provider, claims)
+}
+
+func newOIDCLoginDB() *oidcLoginDB {
+	db := &db.DB{}
+	return &oidcLoginDB{
+		db: db,
+	}
+}
+
+type oidcLoginDB struct {
+	db *db.DB
+}
+
+// ByStateHash will look up the login with the hash of the state
+func (ldb *oidcLoginDB) ByStateHash(hash string) (*oidcLogin, error) {
+	login := new(oidcLogin)
+	key := oidcLoginTableQueryKey{
+		StateHash: hash,
+	}
+	found, err := ldb.db.GetItem(key, dbOIDCLoginsTableName, login)
+	if err != nil {
+		return nil, err
+	} else if found == false {
+		return nil, ErrNotFound
+	} else {
+		return login, nil
+	}
+}
+
+// Create will create the provided login in the database
+func (ldb *oidcLoginDB) Create(login *oidcLogin) error {
+	return ldb.db.PutItem(dbOIDCLoginsTableName, login)
+}
+
+// Delete will delete the login with the hash of the state
+func (ldb *oidcLoginDB) Delete(hash string) error {
+	key := oidcLoginTableQueryKey{
+		StateHash: hash,
+	}
+	return ldb.db.DeleteItem(dbOIDCLoginsTableName, key)
+}
+
+type oidcLoginTableQueryKey struct {
+	StateHash string `json:"state_hash"`
+}
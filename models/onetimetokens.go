@@ -0,0 +1,121 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jcamilom/ecommerce/db"
+)
+
+var (
+	// The DB table name for the one-time tokens
+	dbOneTimeTokensTableName = "OneTimeTokens"
+)
+
+// Purposes of the one-time tokens, a token only works for its own
+const (
+	tokenPurposeMFA           = "mfa"
+	tokenPurposeUnlock        = "account_unlock"
+	tokenPurposeVerification  = "email_verification"
+	tokenPurposeEmailChange   = "email_change"
+	tokenPurposePasswordReset = "password_reset"
+)
+
+// Length in bytes of the random one-time tokens
+const oneTimeTokenBytes = 32
+
+// oneTimeToken is a random token given to a user for a single use,
+// like the second login step. Only the hash of the token is stored.
+// NewEmail is only set for the email change tokens.
+type oneTimeToken struct {
+	TokenHash string    `json:"token_hash"`
+	Purpose   string    `json:"purpose"`
+	Email     string    `json:"email"`
+	NewEmail  string    `json:"new_email"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Used      bool      `json:"used"`
+	// TTL is the time in unix seconds DynamoDB deletes the token
+	TTL int64 `json:"ttl"`
+}
+
+// newOneTimeToken stores a token of the purpose for the email, which
+// expires after the time, and returns it
+func (us *userService) newOneTimeToken(purpose, email string, expire time.Duration) (string, error) {
+	token, err := newRandomToken(oneTimeTokenBytes)
+	if err != nil {
+		return "", err
+	}
+	expiresAt := time.Now().Add(expire)
+	err = us.tokens.Create(&oneTimeToken{
+		TokenHash: hashToken(token),
+		Purpose:   purpose,
+		Email:     email,
+		ExpiresAt: expiresAt,
+		TTL:       expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func newOneTimeTokenDB() *oneTimeTokenDB {
+	db := &db.DB{}
+	return &oneTimeTokenDB{
+		db: db,
+	}
+}
+
+type oneTimeTokenDB struct {
+	db *db.DB
+}
+
+// Valid will look up the token of the purpose. ErrNotFound is
+// returned if it doesn't exist, is for another purpose, expired or
+// was already used.
+func (tdb *oneTimeTokenDB) Valid(purpose, token string) (*oneTimeToken, error) {
+	t := new(oneTimeToken)
+	key := oneTimeTokenTableQueryKey{
+		TokenHash: hashToken(token),
+	}
+	found, err := tdb.db.GetItem(key, dbOneTimeTokensTableName, t)
+	if err != nil {
+		return nil, err
+	}
+	if !found || t.Purpose != purpose || t.Used || time.Now().After(t.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+// Create will create the provided token in the database
+func (tdb *oneTimeTokenDB) Create(t *oneTimeToken) error {
+	return tdb.db.PutItem(dbOneTimeTokensTableName, t)
+}
+
+// MarkUsed will flag the token as used. ErrNotFound is returned if
+// it was already used, so only one of two concurrent uses succeeds.
+func (tdb *oneTimeTokenDB) MarkUsed(t *oneTimeToken) error {
+	key := oneTimeTokenTableQueryKey{
+		TokenHash: t.TokenHash,
+	}
+	update := struct {
+		Used    bool `json:":u"`
+		NotUsed bool `json:":f"`
+	}{
+		Used:    true,
+		NotUsed: false,
+	}
+	err := tdb.db.ConditionalUpdateItem(dbOneTimeTokensTableName, key, update, "set used = :u", "used = :f")
+	if err == db.ErrConditionFailed {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	t.Used = true
+	return nil
+}
+
+type oneTimeTokenTableQueryKey struct {
+	TokenHash string `json:"token_hash"`
+}
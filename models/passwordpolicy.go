@@ -0,0 +1,42 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jcamilom/ecommerce/pwpolicy"
+)
+
+// Minimum length of the passwords if no policy is configured
+const defaultPasswordMinLength = 8
+
+// PasswordPolicyError is returned when a new password doesn't meet
+// the password policy. Every problem of the password is listed.
+type PasswordPolicyError struct {
+	Problems []pwpolicy.Problem
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		messages[i] = p.Message
+	}
+	return "models: " + strings.Join(messages, ", ")
+}
+
+// passwordPolicy checks the password against the policy, with the
+// email and name of the user when they are set
+func (uv *userValidator) passwordPolicy(user *User) error {
+	if user.Password == "" {
+		return nil
+	}
+	problems, err := uv.policy.Check(user.Password, user.Email, user.Name)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return &PasswordPolicyError{
+			Problems: problems,
+		}
+	}
+	return nil
+}
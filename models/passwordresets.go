@@ -0,0 +1,104 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jcamilom/ecommerce/notify"
+)
+
+var (
+	// ErrResetTokenInvalid is returned when a password reset token
+	// doesn't exist, expired or was already used.
+	ErrResetTokenInvalid = errors.New("models: password reset token is invalid or expired")
+)
+
+// Kind of the password reset messages
+const NotificationPasswordReset = "password_reset"
+
+// Time a password reset token can be used
+const passwordResetExpireTime = time.Hour
+
+// ForgotPassword emails a password reset token to the user. Nothing
+// is sent for unknown emails, but no error is returned either so
+// the registered emails can't be discovered.
+func (us *userService) ForgotPassword(email string) error {
+	user, err := us.ByEmail(email)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	token, err := us.newOneTimeToken(tokenPurposePasswordReset, user.Email, passwordResetExpireTime)
+	if err != nil {
+		return err
+	}
+	return us.notifier.Notify(notify.Message{
+		To:      user.Email,
+		Kind:    NotificationPasswordReset,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %v, use this token to reset your password: %v\nIt expires in %v. If you didn't ask for it, ignore this message.",
+			user.Name, token, passwordResetExpireTime),
+		Data: map[string]string{
+			"token": token,
+		},
+	})
+}
+
+// ResetPassword sets a new password for the user of the token. The
+// token can only be used once and every session and API key of the
+// user is revoked.
+func (us *userService) ResetPassword(token, password string) error {
+	reset, err := us.tokens.Valid(tokenPurposePasswordReset, token)
+	if err == ErrNotFound {
+		return ErrResetTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+	user, err := us.ByEmail(reset.Email)
+	if err == ErrNotFound {
+		return ErrResetTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+	newUser := User{
+		Password: password,
+		Email:    user.Email,
+		Name:     user.Name,
+	}
+	err = runUserValFuncs(&newUser,
+		us.validator.passwordRequired,
+		us.validator.passwordPolicy,
+		us.validator.hashPassword,
+	)
+	if err != nil {
+		return err
+	}
+	// The token is spent before changing the password so it can't
+	// be used twice at the same time
+	err = us.tokens.MarkUsed(reset)
+	if err == ErrNotFound {
+		return ErrResetTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+	update := struct {
+		PasswordHash string `json:":p"`
+	}{
+		PasswordHash: newUser.PasswordHash,
+	}
+	updateExp := "set password_hash = :p"
+	if err := us.UserDB.Update(user, update, updateExp); err != nil {
+		return err
+	}
+	// The new password unlocks the account
+	if err := us.attempts.Delete(accountAttemptKey(user.Email)); err != nil {
+		return err
+	}
+	return us.revokeCredentials(user.Email)
+}
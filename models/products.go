@@ -1,7 +1,20 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcamilom/ecommerce/blob"
 	"github.com/jcamilom/ecommerce/db"
+	"github.com/jcamilom/ecommerce/search"
+	"github.com/mitchellh/hashstructure"
 )
 
 var (
@@ -10,38 +23,860 @@ var (
 
 	// The DB primary key for products
 	dbProductsKeyName = "id"
+
+	// ErrSortInvalid is returned when a product listing is requested
+	// with a sort option that is not supported.
+	ErrSortInvalid = errors.New("models: sort option is not valid")
+
+	// ErrPriceRangeInvalid is returned when a product listing is requested
+	// with a negative price or a min price greater than the max price.
+	ErrPriceRangeInvalid = errors.New("models: price range is not valid")
+
+	// ErrPageInvalid is returned when a product listing is requested
+	// with a page or page size lower than 1.
+	ErrPageInvalid = errors.New("models: page is not valid")
+
+	// ErrProductNameRequired is returned when a product is created
+	// or updated without a name.
+	ErrProductNameRequired = errors.New("models: product name is required")
+
+	// ErrProductPriceInvalid is returned when a product is created
+	// or updated with a negative price.
+	ErrProductPriceInvalid = errors.New("models: product price must not be negative")
+
+	// ErrProductQuantityInvalid is returned when a product is created
+	// or updated with a negative quantity.
+	ErrProductQuantityInvalid = errors.New("models: product quantity must not be negative")
+
+	// ErrProductIDRequired is returned when a product is updated
+	// or deleted without an ID.
+	ErrProductIDRequired = errors.New("models: product id is required")
+
+	// ErrQueryRequired is returned when a search is attempted
+	// with an empty query.
+	ErrQueryRequired = errors.New("models: search query is required")
+
+	// ErrAttributeNameRequired is returned when a product has an
+	// attribute without a name.
+	ErrAttributeNameRequired = errors.New("models: attribute name is required")
+
+	// ErrAttributeTypeInvalid is returned when a product has an
+	// attribute with a type that is not supported.
+	ErrAttributeTypeInvalid = errors.New("models: attribute type is not valid")
+
+	// ErrAttributeValueInvalid is returned when the value of a product
+	// attribute doesn't match the attribute type.
+	ErrAttributeValueInvalid = errors.New("models: attribute value doesn't match its type")
+
+	// ErrCategoryInvalid is returned when a product references
+	// a category that doesn't exist.
+	ErrCategoryInvalid = errors.New("models: category is not valid")
+
+	// ErrSKURequired is returned when a variant has no SKU, or when
+	// a product with variants is purchased without choosing one.
+	ErrSKURequired = errors.New("models: variant sku is required")
+
+	// ErrSKUTaken is returned when two variants of a product
+	// have the same SKU.
+	ErrSKUTaken = errors.New("models: variant sku is repeated")
+
+	// ErrVariantNotFound is returned when the SKU doesn't match
+	// any variant of the product.
+	ErrVariantNotFound = errors.New("models: variant not found")
+
+	// ErrOutOfStock is returned when there are not enough items of
+	// the product or variant in the stock.
+	ErrOutOfStock = errors.New("models: product is out of stock")
+)
+
+const (
+	// Default number of products returned by a search
+	productsDefaultSearchLimit = 20
+
+	// Default number of products returned per page
+	productsDefaultPerPage = 20
+
+	// Max number of products returned per page
+	productsMaxPerPage = 100
+)
+
+// Sort options supported when listing products
+const (
+	ProductSortName      = "name"
+	ProductSortNameDesc  = "-name"
+	ProductSortPrice     = "price"
+	ProductSortPriceDesc = "-price"
+	ProductSortNewest    = "newest"
+)
+
+// Types supported for the product attributes
+const (
+	AttributeTypeText   = "text"
+	AttributeTypeNumber = "number"
+	AttributeTypeBool   = "bool"
 )
 
 type Product struct {
-	ID       string `json:"id"`
-	Name     string `json:"name"`
-	Price    int    `json:"price"`
-	Quantity int    `json:"quantity"`
+	ID         string      `json:"id"`
+	Name       string      `json:"name"`
+	Price      int         `json:"price"`
+	Quantity   int         `json:"quantity"`
+	CategoryID string      `json:"category_id"`
+	Tags       []string    `json:"tags"`
+	Attributes []Attribute `json:"attributes"`
+	Variants   []Variant   `json:"variants"`
+	Images     []Image     `json:"images"`
+	CreatedAt  time.Time   `json:"created_at"`
+}
+
+// Variant is a purchasable version of a product, such as a size or
+// color, with its own stock. A zero Price means the variant is sold
+// at the product price.
+//
+// When a product has variants its Quantity is the sum of the
+// quantity of its variants.
+type Variant struct {
+	SKU        string      `json:"sku"`
+	Name       string      `json:"name"`
+	Price      int         `json:"price"`
+	Quantity   int         `json:"quantity"`
+	Attributes []Attribute `json:"attributes"`
+}
+
+// Variant returns the variant of the product with the provided SKU.
+// Products without variants are bought without a SKU, so an empty
+// SKU returns nil. Otherwise ErrSKURequired or ErrVariantNotFound
+// are returned.
+func (p *Product) Variant(sku string) (*Variant, error) {
+	if sku == "" {
+		if len(p.Variants) > 0 {
+			return nil, ErrSKURequired
+		}
+		return nil, nil
+	}
+	for i := range p.Variants {
+		if p.Variants[i].SKU == normalizeSKU(sku) {
+			return &p.Variants[i], nil
+		}
+	}
+	return nil, ErrVariantNotFound
+}
+
+// PriceOf returns the price of the variant, or the product price
+// if the variant is nil or has no price of its own.
+func (p *Product) PriceOf(variant *Variant) int {
+	if variant != nil && variant.Price > 0 {
+		return variant.Price
+	}
+	return p.Price
+}
+
+// StockOf returns the quantity in stock of the variant, or of the
+// product if the variant is nil.
+func (p *Product) StockOf(variant *Variant) int {
+	if variant != nil {
+		return variant.Quantity
+	}
+	return p.Quantity
+}
+
+func normalizeSKU(sku string) string {
+	return strings.ToUpper(strings.TrimSpace(sku))
+}
+
+// Attribute is a typed property of a product such as its color
+// or size. The value is stored as text and must be parseable
+// according to the attribute type.
+type Attribute struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// ProductListParams holds the paging, sorting and filtering options
+// used to list the products of the catalog. A zero MinPrice or
+// MaxPrice means no limit for that side of the range.
+//
+// Filtering by Category includes the products of its subcategories.
+// Products must have all of the Tags and Attributes to match.
+type ProductListParams struct {
+	Page       int
+	PerPage    int
+	Sort       string
+	MinPrice   int
+	MaxPrice   int
+	InStock    bool
+	Category   string
+	Tags       []string
+	Attributes map[string]string
+
+	// IDs of the Category and its subcategories, set by the service
+	categoryIDs []string
+}
+
+// ProductPage is a page of products returned by a listing
+type ProductPage struct {
+	Products []Product `json:"products"`
+	Page     int       `json:"page"`
+	PerPage  int       `json:"per_page"`
+	Total    int       `json:"total"`
+}
+
+// ProductFacets holds the number of products matching a filter set
+// for every category, tag and attribute value.
+type ProductFacets struct {
+	Total      int                       `json:"total"`
+	Categories map[string]int            `json:"categories"`
+	Tags       map[string]int            `json:"tags"`
+	Attributes map[string]map[string]int `json:"attributes"`
 }
 
 // ProductDB is used to interact with the products database.
 type ProductDB interface {
 	// Methods for querying for single products
 	ByID(id string) (*Product, error)
+	// Methods for querying several products
+	List(params *ProductListParams) (*ProductPage, error)
+	Facets(params *ProductListParams) (*ProductFacets, error)
+	All() ([]Product, error)
+	// Methods for altering products
+	Create(product *Product) error
+	Update(product *Product) error
+	Delete(id string) error
+	// AdjustStock adds delta to the quantity of the product, or of
+	// the variant with the provided SKU. It returns ErrOutOfStock if
+	// the quantity would become negative.
+	AdjustStock(product *Product, sku string, delta int) error
+	// SetImages stores the images of the product
+	SetImages(product *Product) error
 }
 
 // ProductsService is a set of methods used to manipulate and
 // work with the product model
 type ProductsService interface {
+	// Search returns up to limit products matching the query,
+	// the most relevant first.
+	Search(query string, limit int) ([]Product, error)
+	// AddImage stores the image and its thumbnails and adds it to
+	// the product. It returns ErrImageInvalid if r is not an image
+	// and ErrImageTooLarge if it is bigger than MaxImageSize.
+	AddImage(product *Product, r io.Reader) (*Image, error)
+	// RemoveImage removes the image from the product and deletes
+	// its files. It returns ErrImageNotFound if the product has
+	// no image with that ID.
+	RemoveImage(product *Product, imageID string) error
+	// Import creates or updates the products of the rows, reporting
+	// the result of every row. With dryRun the rows are only validated.
+	Import(rows []ImportRow, dryRun bool) (*ImportReport, error)
+	// FavoriteViews joins the favorites with the current data
+	// of their products.
+	FavoriteViews(favorites []Favorite) ([]FavoriteView, error)
+	// RebuildIndex reads the whole catalog again and replaces the
+	// search index, so it picks up the changes made by other
+	// instances.
+	RebuildIndex() error
 	ProductDB
 }
 
-func NewProductsService() ProductsService {
+func NewProductsService(cs CategoryService, bs blob.BlobStore, ns NotificationService) ProductsService {
 	pdb := newProductDB()
-	return &productsService{
-		ProductDB: pdb,
+	pv := newProductValidator(pdb, cs)
+	ps := &productsService{
+		ProductDB:     pv,
+		validator:     pv,
+		categories:    cs,
+		blobs:         bs,
+		notifications: ns,
+		index:         search.NewIndex(),
+	}
+	if err := ps.RebuildIndex(); err != nil {
+		log.Println("Unable to build the products search index:", err)
 	}
+	return ps
 }
 
 var _ ProductsService = &productsService{}
 
 type productsService struct {
 	ProductDB
+	validator     *productValidator
+	categories    CategoryService
+	blobs         blob.BlobStore
+	notifications NotificationService
+	index         *search.Index
+	// indexMu guards rebuild, the index being filled by RebuildIndex
+	indexMu sync.Mutex
+	rebuild *indexRebuild
+	// rebuildMu lets one rebuild run at a time
+	rebuildMu sync.Mutex
+}
+
+// indexRebuild is an index being filled from a scan of the catalog.
+// The products changed since the scan started are already in it with
+// their latest version, so the scanned version is skipped.
+type indexRebuild struct {
+	index   *search.Index
+	changed map[string]bool
+}
+
+// List will resolve the subcategories of the category filter
+// before calling List on the ProductDB field.
+func (ps *productsService) List(params *ProductListParams) (*ProductPage, error) {
+	if err := ps.resolveCategory(params); err != nil {
+		return nil, err
+	}
+	return ps.ProductDB.List(params)
+}
+
+// Facets will resolve the subcategories of the category filter
+// before calling Facets on the ProductDB field.
+func (ps *productsService) Facets(params *ProductListParams) (*ProductFacets, error) {
+	if err := ps.resolveCategory(params); err != nil {
+		return nil, err
+	}
+	return ps.ProductDB.Facets(params)
+}
+
+// resolveCategory fills the IDs of the category filter and its
+// subcategories. The filter is normalized first since the IDs are
+// stored in lower case.
+func (ps *productsService) resolveCategory(params *ProductListParams) error {
+	if err := ps.validator.normalizeFilters(params); err != nil {
+		return err
+	}
+	if params.Category == "" {
+		return nil
+	}
+	ids, err := ps.categories.Descendants(params.Category)
+	if err != nil {
+		return err
+	}
+	params.categoryIDs = ids
+	return nil
+}
+
+// Create will create the product and add it to the search index
+func (ps *productsService) Create(product *Product) error {
+	if err := ps.ProductDB.Create(product); err != nil {
+		return err
+	}
+	ps.indexProduct(product)
+	return nil
+}
+
+// Update will update the product and reindex it. The users with
+// the product in their favorites are notified if its price dropped
+// or it is back in stock.
+func (ps *productsService) Update(product *Product) error {
+	before, err := ps.ProductDB.ByID(product.ID)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if err := ps.ProductDB.Update(product); err != nil {
+		return err
+	}
+	ps.indexProduct(product)
+	if before != nil {
+		ps.notifications.ProductChanged(before, product)
+	}
+	return nil
+}
+
+// Delete will delete the product and its images and remove it
+// from the search index
+func (ps *productsService) Delete(id string) error {
+	product, err := ps.ProductDB.ByID(id)
+	if err != nil {
+		return err
+	}
+	if err := ps.ProductDB.Delete(id); err != nil {
+		return err
+	}
+	ps.unindexProduct(id)
+	for i := range product.Images {
+		ps.deleteImageBlobs(&product.Images[i])
+	}
+	return nil
+}
+
+func (ps *productsService) Search(query string, limit int) ([]Product, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, ErrQueryRequired
+	}
+	if limit <= 0 {
+		limit = productsDefaultSearchLimit
+	}
+	if limit > productsMaxPerPage {
+		limit = productsMaxPerPage
+	}
+	products := []Product{}
+	for _, hit := range ps.index.Search(query) {
+		if len(products) == limit {
+			break
+		}
+		p, err := ps.ProductDB.ByID(hit.ID)
+		if err == ErrNotFound {
+			// Deleted by another instance, drop it from our index
+			ps.unindexProduct(hit.ID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, *p)
+	}
+	return products, nil
+}
+
+// RebuildIndex fills a new index with the whole catalog and then
+// swaps it in, so searches keep working while it is built. The
+// changes made by this instance during the scan go to both indexes.
+func (ps *productsService) RebuildIndex() error {
+	ps.rebuildMu.Lock()
+	defer ps.rebuildMu.Unlock()
+	rebuild := &indexRebuild{
+		index:   search.NewIndex(),
+		changed: map[string]bool{},
+	}
+	ps.indexMu.Lock()
+	ps.rebuild = rebuild
+	ps.indexMu.Unlock()
+
+	products, err := ps.ProductDB.All()
+
+	ps.indexMu.Lock()
+	defer ps.indexMu.Unlock()
+	ps.rebuild = nil
+	if err != nil {
+		return err
+	}
+	for i := range products {
+		if !rebuild.changed[products[i].ID] {
+			rebuild.index.Put(products[i].ID, productFields(&products[i])...)
+		}
+	}
+	ps.index.Replace(rebuild.index)
+	log.Printf("Products search index built with %d products\n", ps.index.Len())
+	return nil
+}
+
+// indexProduct adds the product to the search index, and to the one
+// being rebuilt if any
+func (ps *productsService) indexProduct(product *Product) {
+	fields := productFields(product)
+	ps.indexMu.Lock()
+	defer ps.indexMu.Unlock()
+	ps.index.Put(product.ID, fields...)
+	if ps.rebuild != nil {
+		ps.rebuild.index.Put(product.ID, fields...)
+		ps.rebuild.changed[product.ID] = true
+	}
+}
+
+// unindexProduct removes the product from the search index, and from
+// the one being rebuilt if any
+func (ps *productsService) unindexProduct(id string) {
+	ps.indexMu.Lock()
+	defer ps.indexMu.Unlock()
+	ps.index.Remove(id)
+	if ps.rebuild != nil {
+		ps.rebuild.index.Remove(id)
+		ps.rebuild.changed[id] = true
+	}
+}
+
+// productFields returns the text of the product that is searchable
+func productFields(product *Product) []search.Field {
+	fields := []search.Field{
+		{Text: product.Name, Boost: 2},
+		{Text: product.ID},
+		{Text: strings.Join(product.Tags, " ")},
+	}
+	for _, v := range product.Variants {
+		fields = append(fields, search.Field{Text: v.SKU + " " + v.Name})
+	}
+	for _, a := range product.Attributes {
+		if a.Type == AttributeTypeText {
+			fields = append(fields, search.Field{Text: a.Value})
+		}
+	}
+	return fields
+}
+
+type productValFunc func(*Product) error
+
+func runProductValFuncs(product *Product, fns ...productValFunc) error {
+	for _, fn := range fns {
+		if err := fn(product); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type productListValFunc func(*ProductListParams) error
+
+func runProductListValFuncs(params *ProductListParams, fns ...productListValFunc) error {
+	for _, fn := range fns {
+		if err := fn(params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ ProductDB = &productValidator{}
+
+func newProductValidator(pdb ProductDB, cdb CategoryDB) *productValidator {
+	return &productValidator{
+		ProductDB:  pdb,
+		categories: cdb,
+	}
+}
+
+type productValidator struct {
+	ProductDB
+	categories CategoryDB
+}
+
+// List will set the default listing options and validate
+// them before calling List on the ProductDB field.
+func (pv *productValidator) List(params *ProductListParams) (*ProductPage, error) {
+	err := runProductListValFuncs(params,
+		pv.defaultPage,
+		pv.pageRange,
+		pv.normalizeSort,
+		pv.sortSupported,
+		pv.priceRange,
+		pv.normalizeFilters,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pv.ProductDB.List(params)
+}
+
+// Facets will validate the filters before calling Facets
+// on the ProductDB field.
+func (pv *productValidator) Facets(params *ProductListParams) (*ProductFacets, error) {
+	err := runProductListValFuncs(params,
+		pv.priceRange,
+		pv.normalizeFilters,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pv.ProductDB.Facets(params)
+}
+
+// Create will validate the product and fill the ID and creation
+// time before calling Create on the ProductDB field.
+func (pv *productValidator) Create(product *Product) error {
+	if err := pv.validateCreate(product); err != nil {
+		return err
+	}
+	return pv.ProductDB.Create(product)
+}
+
+// Update will validate the product and keep its creation time
+// before calling Update on the ProductDB field.
+func (pv *productValidator) Update(product *Product) error {
+	if err := pv.validateUpdate(product); err != nil {
+		return err
+	}
+	return pv.ProductDB.Update(product)
+}
+
+func (pv *productValidator) validateCreate(product *Product) error {
+	return runProductValFuncs(product,
+		pv.normalizeName,
+		pv.requireName,
+		pv.priceNotNegative,
+		pv.quantityNotNegative,
+		pv.normalizeTags,
+		pv.attributesValid,
+		pv.variantsValid,
+		pv.categoryExists,
+		pv.setImages,
+		pv.setCreationTime,
+		pv.setID,
+	)
+}
+
+func (pv *productValidator) validateUpdate(product *Product) error {
+	return runProductValFuncs(product,
+		pv.requireID,
+		pv.normalizeName,
+		pv.requireName,
+		pv.priceNotNegative,
+		pv.quantityNotNegative,
+		pv.normalizeTags,
+		pv.attributesValid,
+		pv.variantsValid,
+		pv.categoryExists,
+		pv.keepStoredFields,
+	)
+}
+
+// Delete will make sure the product exists before calling
+// Delete on the ProductDB field.
+func (pv *productValidator) Delete(id string) error {
+	if id == "" {
+		return ErrProductIDRequired
+	}
+	if _, err := pv.ProductDB.ByID(id); err != nil {
+		return err
+	}
+	return pv.ProductDB.Delete(id)
+}
+
+func (pv *productValidator) requireID(product *Product) error {
+	if product.ID == "" {
+		return ErrProductIDRequired
+	}
+	return nil
+}
+
+func (pv *productValidator) normalizeName(product *Product) error {
+	product.Name = strings.TrimSpace(product.Name)
+	return nil
+}
+
+func (pv *productValidator) requireName(product *Product) error {
+	if product.Name == "" {
+		return ErrProductNameRequired
+	}
+	return nil
+}
+
+func (pv *productValidator) priceNotNegative(product *Product) error {
+	if product.Price < 0 {
+		return ErrProductPriceInvalid
+	}
+	return nil
+}
+
+func (pv *productValidator) quantityNotNegative(product *Product) error {
+	if product.Quantity < 0 {
+		return ErrProductQuantityInvalid
+	}
+	return nil
+}
+
+// normalizeTags lower cases the tags and removes the empty
+// and repeated ones.
+func (pv *productValidator) normalizeTags(product *Product) error {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, t := range product.Tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	product.Tags = tags
+	return nil
+}
+
+func (pv *productValidator) attributesValid(product *Product) error {
+	if product.Attributes == nil {
+		product.Attributes = []Attribute{}
+	}
+	return validateAttributes(product.Attributes)
+}
+
+// variantsValid normalizes the variants, makes sure their SKUs are
+// unique and sets the product quantity to the stock of all of them.
+func (pv *productValidator) variantsValid(product *Product) error {
+	if product.Variants == nil {
+		product.Variants = []Variant{}
+		return nil
+	}
+	if len(product.Variants) == 0 {
+		return nil
+	}
+	skus := map[string]bool{}
+	quantity := 0
+	for i := range product.Variants {
+		v := &product.Variants[i]
+		v.SKU = normalizeSKU(v.SKU)
+		v.Name = strings.TrimSpace(v.Name)
+		if v.SKU == "" {
+			return ErrSKURequired
+		}
+		if skus[v.SKU] {
+			return ErrSKUTaken
+		}
+		skus[v.SKU] = true
+		if v.Price < 0 {
+			return ErrProductPriceInvalid
+		}
+		if v.Quantity < 0 {
+			return ErrProductQuantityInvalid
+		}
+		if v.Attributes == nil {
+			v.Attributes = []Attribute{}
+		}
+		if err := validateAttributes(v.Attributes); err != nil {
+			return err
+		}
+		quantity += v.Quantity
+	}
+	product.Quantity = quantity
+	return nil
+}
+
+// AdjustStock will make sure the variant exists before calling
+// AdjustStock on the ProductDB field.
+func (pv *productValidator) AdjustStock(product *Product, sku string, delta int) error {
+	if _, err := product.Variant(sku); err != nil {
+		return err
+	}
+	return pv.ProductDB.AdjustStock(product, normalizeSKU(sku), delta)
+}
+
+// validateAttributes normalizes the attributes and makes sure every
+// value can be parsed according to its type. Text is the default type.
+func validateAttributes(attributes []Attribute) error {
+	for i := range attributes {
+		a := &attributes[i]
+		a.Name = strings.ToLower(strings.TrimSpace(a.Name))
+		a.Type = strings.ToLower(strings.TrimSpace(a.Type))
+		a.Value = strings.TrimSpace(a.Value)
+		if a.Name == "" {
+			return ErrAttributeNameRequired
+		}
+		switch a.Type {
+		case "", AttributeTypeText:
+			a.Type = AttributeTypeText
+		case AttributeTypeNumber:
+			n, err := strconv.ParseFloat(a.Value, 64)
+			if err != nil {
+				return ErrAttributeValueInvalid
+			}
+			a.Value = strconv.FormatFloat(n, 'f', -1, 64)
+		case AttributeTypeBool:
+			b, err := strconv.ParseBool(a.Value)
+			if err != nil {
+				return ErrAttributeValueInvalid
+			}
+			a.Value = strconv.FormatBool(b)
+		default:
+			return ErrAttributeTypeInvalid
+		}
+	}
+	return nil
+}
+
+func (pv *productValidator) categoryExists(product *Product) error {
+	product.CategoryID = strings.ToLower(strings.TrimSpace(product.CategoryID))
+	if product.CategoryID == "" {
+		return nil
+	}
+	_, err := pv.categories.ByID(product.CategoryID)
+	if err == ErrNotFound {
+		return ErrCategoryInvalid
+	}
+	return err
+}
+
+func (pv *productValidator) setCreationTime(product *Product) error {
+	product.CreatedAt = time.Now()
+	return nil
+}
+
+// keepStoredFields copies the creation time and images of the stored
+// product, returning ErrNotFound if the product doesn't exist. The
+// images are only changed through SetImages.
+func (pv *productValidator) keepStoredFields(product *Product) error {
+	existing, err := pv.ProductDB.ByID(product.ID)
+	if err != nil {
+		return err
+	}
+	product.CreatedAt = existing.CreatedAt
+	product.Images = existing.Images
+	return nil
+}
+
+func (pv *productValidator) setImages(product *Product) error {
+	product.Images = []Image{}
+	return nil
+}
+
+func (pv *productValidator) setID(product *Product) error {
+	if product.ID != "" {
+		return nil
+	}
+	hash, err := hashstructure.Hash(product, nil)
+	if err != nil {
+		return err
+	}
+	product.ID = strconv.FormatUint(hash, 10)
+	return nil
+}
+
+func (pv *productValidator) defaultPage(params *ProductListParams) error {
+	if params.Page == 0 {
+		params.Page = 1
+	}
+	if params.PerPage == 0 {
+		params.PerPage = productsDefaultPerPage
+	}
+	if params.PerPage > productsMaxPerPage {
+		params.PerPage = productsMaxPerPage
+	}
+	return nil
+}
+
+func (pv *productValidator) pageRange(params *ProductListParams) error {
+	if params.Page < 1 || params.PerPage < 1 {
+		return ErrPageInvalid
+	}
+	return nil
+}
+
+func (pv *productValidator) normalizeSort(params *ProductListParams) error {
+	params.Sort = strings.ToLower(strings.TrimSpace(params.Sort))
+	if params.Sort == "" {
+		params.Sort = ProductSortName
+	}
+	return nil
+}
+
+func (pv *productValidator) sortSupported(params *ProductListParams) error {
+	switch params.Sort {
+	case ProductSortName, ProductSortNameDesc, ProductSortPrice, ProductSortPriceDesc, ProductSortNewest:
+		return nil
+	default:
+		return ErrSortInvalid
+	}
+}
+
+// normalizeFilters lower cases the category, tag and attribute
+// filters the same way they are stored.
+func (pv *productValidator) normalizeFilters(params *ProductListParams) error {
+	params.Category = strings.ToLower(strings.TrimSpace(params.Category))
+	for i, t := range params.Tags {
+		params.Tags[i] = strings.ToLower(strings.TrimSpace(t))
+	}
+	attributes := map[string]string{}
+	for name, value := range params.Attributes {
+		attributes[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	params.Attributes = attributes
+	return nil
+}
+
+func (pv *productValidator) priceRange(params *ProductListParams) error {
+	if params.MinPrice < 0 || params.MaxPrice < 0 {
+		return ErrPriceRangeInvalid
+	}
+	if params.MaxPrice != 0 && params.MinPrice > params.MaxPrice {
+		return ErrPriceRangeInvalid
+	}
+	return nil
 }
 
 var _ ProductDB = &productDB{}
@@ -60,9 +895,7 @@ type productDB struct {
 // ByID will look up a product with the provided ID.
 func (pdb *productDB) ByID(id string) (*Product, error) {
 	p := new(Product)
-	key := struct {
-		ID string `json:"id"`
-	}{
+	key := productTableQueryKey{
 		ID: id,
 	}
 	found, err := pdb.db.GetItem(key, dbProductsTableName, p)
@@ -74,3 +907,284 @@ func (pdb *productDB) ByID(id string) (*Product, error) {
 		return p, nil
 	}
 }
+
+// All will scan the whole catalog
+func (pdb *productDB) All() ([]Product, error) {
+	products := []Product{}
+	err := pdb.db.Scan(dbProductsTableName, "", nil, nil, &products)
+	if err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+// Create will create the provided product in the database
+func (pdb *productDB) Create(product *Product) error {
+	return pdb.db.PutItem(dbProductsTableName, product)
+}
+
+// Update will replace the stored product with the provided one
+func (pdb *productDB) Update(product *Product) error {
+	return pdb.db.PutItem(dbProductsTableName, product)
+}
+
+// Delete will delete the product with the provided ID
+func (pdb *productDB) Delete(id string) error {
+	key := productTableQueryKey{
+		ID: id,
+	}
+	return pdb.db.DeleteItem(dbProductsTableName, key)
+}
+
+// AdjustStock will atomically add delta to the stored quantity of
+// the product and, if the SKU is set, of its variant. The update is
+// conditioned to the stock not becoming negative.
+func (pdb *productDB) AdjustStock(product *Product, sku string, delta int) error {
+	key := productTableQueryKey{
+		ID: product.ID,
+	}
+	minQuantity := 0
+	if delta < 0 {
+		minQuantity = -delta
+	}
+	update := struct {
+		Delta int    `json:":d"`
+		Min   int    `json:":min"`
+		SKU   string `json:":sku,omitempty"`
+	}{
+		Delta: delta,
+		Min:   minQuantity,
+	}
+	updateExp := "set quantity = quantity + :d"
+	condExp := "quantity >= :min"
+	if sku != "" {
+		index := -1
+		for i, v := range product.Variants {
+			if v.SKU == sku {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return ErrVariantNotFound
+		}
+		update.SKU = sku
+		variant := fmt.Sprintf("variants[%d]", index)
+		updateExp += fmt.Sprintf(", %[1]v.quantity = %[1]v.quantity + :d", variant)
+		// The SKU is checked in case the variants were reordered
+		condExp += fmt.Sprintf(" and %[1]v.sku = :sku and %[1]v.quantity >= :min", variant)
+	}
+	err := pdb.db.ConditionalUpdateItem(dbProductsTableName, key, update, updateExp, condExp)
+	if err == db.ErrConditionFailed {
+		return ErrOutOfStock
+	}
+	return err
+}
+
+// SetImages will update the images of the product
+func (pdb *productDB) SetImages(product *Product) error {
+	key := productTableQueryKey{
+		ID: product.ID,
+	}
+	update := struct {
+		Images []Image `json:":i"`
+	}{
+		Images: product.Images,
+	}
+	updateExp := "set images = :i"
+	return pdb.db.UpdateItem(dbProductsTableName, key, update, updateExp)
+}
+
+// List will scan the products matching the filters. DynamoDB can't
+// sort a scan, so the matching products are sorted and paginated
+// here. This is fine while the catalog is small.
+func (pdb *productDB) List(params *ProductListParams) (*ProductPage, error) {
+	products, err := pdb.matching(params)
+	if err != nil {
+		return nil, err
+	}
+	sortProducts(products, params.Sort)
+
+	page := &ProductPage{
+		Products: []Product{},
+		Page:     params.Page,
+		PerPage:  params.PerPage,
+		Total:    len(products),
+	}
+	// The page is checked before multiplying, a huge page would
+	// overflow
+	if params.Page-1 > len(products)/params.PerPage {
+		return page, nil
+	}
+	start := (params.Page - 1) * params.PerPage
+	if start >= len(products) {
+		return page, nil
+	}
+	end := start + params.PerPage
+	if end > len(products) {
+		end = len(products)
+	}
+	page.Products = products[start:end]
+	return page, nil
+}
+
+// Facets will count the categories, tags and attribute values
+// of the products matching the filters.
+func (pdb *productDB) Facets(params *ProductListParams) (*ProductFacets, error) {
+	products, err := pdb.matching(params)
+	if err != nil {
+		return nil, err
+	}
+	facets := &ProductFacets{
+		Total:      len(products),
+		Categories: map[string]int{},
+		Tags:       map[string]int{},
+		Attributes: map[string]map[string]int{},
+	}
+	for _, p := range products {
+		if p.CategoryID != "" {
+			facets.Categories[p.CategoryID]++
+		}
+		for _, t := range p.Tags {
+			facets.Tags[t]++
+		}
+		for _, a := range p.Attributes {
+			if facets.Attributes[a.Name] == nil {
+				facets.Attributes[a.Name] = map[string]int{}
+			}
+			facets.Attributes[a.Name][a.Value]++
+		}
+	}
+	return facets, nil
+}
+
+// matching scans the products filtering by price and stock in
+// DynamoDB. The category, tag and attribute filters are applied
+// here since they are nested in the item.
+func (pdb *productDB) matching(params *ProductListParams) ([]Product, error) {
+	products := []Product{}
+	filters := []string{}
+	values := map[string]int{}
+	if params.MinPrice > 0 {
+		filters = append(filters, "price >= :min")
+		values[":min"] = params.MinPrice
+	}
+	if params.MaxPrice > 0 {
+		filters = append(filters, "price <= :max")
+		values[":max"] = params.MaxPrice
+	}
+	if params.InStock {
+		filters = append(filters, "quantity > :zero")
+		values[":zero"] = 0
+	}
+	filterExp := strings.Join(filters, " and ")
+	err := pdb.db.Scan(dbProductsTableName, filterExp, values, nil, &products)
+	if err != nil {
+		return nil, err
+	}
+
+	categoryIDs := params.categoryIDs
+	if len(categoryIDs) == 0 && params.Category != "" {
+		categoryIDs = []string{params.Category}
+	}
+	matching := []Product{}
+	for _, p := range products {
+		if productMatches(&p, categoryIDs, params.Tags, params.Attributes) {
+			matching = append(matching, p)
+		}
+	}
+	return matching, nil
+}
+
+// productMatches returns true if the product belongs to one of the
+// categories (if any) and has all the tags and attribute values.
+func productMatches(product *Product, categoryIDs []string, tags []string, attributes map[string]string) bool {
+	if len(categoryIDs) > 0 {
+		var inCategory bool
+		for _, id := range categoryIDs {
+			if product.CategoryID == id {
+				inCategory = true
+				break
+			}
+		}
+		if !inCategory {
+			return false
+		}
+	}
+	for _, t := range tags {
+		var hasTag bool
+		for _, pt := range product.Tags {
+			if pt == t {
+				hasTag = true
+				break
+			}
+		}
+		if !hasTag {
+			return false
+		}
+	}
+	for name, value := range attributes {
+		var hasAttribute bool
+		for _, a := range product.Attributes {
+			if a.Name == name && attributeValueMatches(&a, value) {
+				hasAttribute = true
+				break
+			}
+		}
+		if !hasAttribute {
+			return false
+		}
+	}
+	return true
+}
+
+// attributeValueMatches returns true if the value of the filter is
+// the value of the attribute according to its type, so 10.0 matches
+// a number 10 and TRUE matches a bool true.
+func attributeValueMatches(a *Attribute, value string) bool {
+	switch a.Type {
+	case AttributeTypeNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		return err == nil && strconv.FormatFloat(n, 'f', -1, 64) == a.Value
+	case AttributeTypeBool:
+		b, err := strconv.ParseBool(value)
+		return err == nil && strconv.FormatBool(b) == a.Value
+	default:
+		return a.Value == value
+	}
+}
+
+// sortProducts sorts the products in place by the provided sort option.
+// Ties are broken by ID so pages are stable between requests.
+func sortProducts(products []Product, sortBy string) {
+	sort.SliceStable(products, func(i, j int) bool {
+		a, b := products[i], products[j]
+		switch sortBy {
+		case ProductSortPrice:
+			if a.Price != b.Price {
+				return a.Price < b.Price
+			}
+		case ProductSortPriceDesc:
+			if a.Price != b.Price {
+				return a.Price > b.Price
+			}
+		case ProductSortNameDesc:
+			if a.Name != b.Name {
+				return a.Name > b.Name
+			}
+		case ProductSortNewest:
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.After(b.CreatedAt)
+			}
+		default:
+			if a.Name != b.Name {
+				return a.Name < b.Name
+			}
+		}
+		return a.ID < b.ID
+	})
+}
+
+type productTableQueryKey struct {
+	ID string `json:"id"`
+}
@@ -0,0 +1,270 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/jcamilom/ecommerce/db"
+	"github.com/jcamilom/ecommerce/notify"
+	"github.com/jcamilom/ecommerce/pwhash"
+)
+
+var (
+	// ErrEmailChangeTokenInvalid is returned when an email change
+	// token is invalid, expired or for an unknown user.
+	ErrEmailChangeTokenInvalid = errors.New("models: email change token is invalid or expired")
+)
+
+// Kind of the email change messages
+const NotificationEmailChange = "email_change"
+
+// Email change token expire time
+const emailChangeExpireTime = 24 * time.Hour
+
+// ChangeEmail sends a link to the new email to confirm it. The email
+// of the user doesn't change until the link is opened.
+func (us *userService) ChangeEmail(user *User, email, password, ip string) error {
+	stored, err := us.ByEmail(user.Email)
+	if err != nil {
+		return err
+	}
+	if err := us.checkPassword(stored, password, ip); err != nil {
+		return err
+	}
+	newUser := User{
+		Email: email,
+	}
+	err = runUserValFuncs(&newUser,
+		us.validator.normalizeEmail,
+		us.validator.requireEmail,
+		us.validator.emailFormat,
+		us.validator.emailIsAvail,
+	)
+	if err != nil {
+		return err
+	}
+	if newUser.Email == stored.Email {
+		return nil
+	}
+	token, err := us.newEmailChangeToken(stored.Email, newUser.Email)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%v/users/email/confirm?token=%v", us.baseURL, url.QueryEscape(token))
+	return us.notifier.Notify(notify.Message{
+		To:      newUser.Email,
+		Kind:    NotificationEmailChange,
+		Subject: "Confirm your new email",
+		Body:    fmt.Sprintf("Hi %v, open this link to use this email in your account: %v", stored.Name, link),
+		Data: map[string]string{
+			"link": link,
+		},
+	})
+}
+
+// ConfirmEmailChange moves the user the token was sent to, with the
+// purchases, gifts, wishlists, API keys and identities, to the new
+// email. The token works only once and every session is revoked.
+func (us *userService) ConfirmEmailChange(token string) (*User, error) {
+	change, err := us.tokens.Valid(tokenPurposeEmailChange, token)
+	if err == ErrNotFound {
+		return nil, ErrEmailChangeTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored, err := us.ByEmail(change.Email)
+	if err == ErrNotFound {
+		return nil, ErrEmailChangeTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The email may have been taken since the link was sent
+	newUser := User{
+		Email: change.NewEmail,
+	}
+	if err := runUserValFuncs(&newUser, us.validator.emailIsAvail); err != nil {
+		return nil, err
+	}
+	err = us.tokens.MarkUsed(change)
+	if err == ErrNotFound {
+		return nil, ErrEmailChangeTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := us.moveEmail(stored, change.NewEmail); err != nil {
+		return nil, err
+	}
+	// Opening the link proves the new email is the user's
+	if stored.VerificationPending {
+		if err := us.markVerified(stored); err != nil {
+			return nil, err
+		}
+	}
+	return stored, nil
+}
+
+// newEmailChangeToken stores a token to change the email of the user
+// to the new one and returns it
+func (us *userService) newEmailChangeToken(email, newEmail string) (string, error) {
+	token, err := newRandomToken(oneTimeTokenBytes)
+	if err != nil {
+		return "", err
+	}
+	expiresAt := time.Now().Add(emailChangeExpireTime)
+	err = us.tokens.Create(&oneTimeToken{
+		TokenHash: hashToken(token),
+		Purpose:   tokenPurposeEmailChange,
+		Email:     email,
+		NewEmail:  newEmail,
+		ExpiresAt: expiresAt,
+		TTL:       expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// moveEmail moves the user and everything stored under its email to
+// the new email, and revokes the sessions of the old one
+func (us *userService) moveEmail(user *User, newEmail string) error {
+	oldEmail := user.Email
+	// The purchases, gifts, wishlists, API keys and identities are
+	// moved before the user so the account is never left without
+	// them. If something fails they are moved back.
+	rollback := func() {
+		if err := us.purchases.ChangeEmail(newEmail, oldEmail); err != nil {
+			log.Println("Unable to move back the purchases of", oldEmail, err)
+		}
+		if err := us.purchases.ChangeRecipient(newEmail, oldEmail); err != nil {
+			log.Println("Unable to move back the gifts of", oldEmail, err)
+		}
+		if err := us.wishlists.ChangeEmail(newEmail, oldEmail); err != nil {
+			log.Println("Unable to move back the wishlists of", oldEmail, err)
+		}
+		if err := us.apiKeys.ChangeEmail(newEmail, oldEmail); err != nil {
+			log.Println("Unable to move back the API keys of", oldEmail, err)
+		}
+		if err := us.identities.ChangeEmail(newEmail, oldEmail); err != nil {
+			log.Println("Unable to move back the identities of", oldEmail, err)
+		}
+	}
+	if err := us.purchases.ChangeEmail(oldEmail, newEmail); err != nil {
+		rollback()
+		return err
+	}
+	if err := us.purchases.ChangeRecipient(oldEmail, newEmail); err != nil {
+		rollback()
+		return err
+	}
+	if err := us.wishlists.ChangeEmail(oldEmail, newEmail); err != nil {
+		rollback()
+		return err
+	}
+	if err := us.apiKeys.ChangeEmail(oldEmail, newEmail); err != nil {
+		rollback()
+		return err
+	}
+	if err := us.identities.ChangeEmail(oldEmail, newEmail); err != nil {
+		rollback()
+		return err
+	}
+	if err := us.UserDB.Move(user, newEmail); err != nil {
+		rollback()
+		return err
+	}
+	// The sessions are for the old email
+	return us.sessions.DeleteByEmail(oldEmail, "")
+}
+
+func (us *userService) ChangePassword(user *User, current, password, ip string) error {
+	stored, err := us.ByEmail(user.Email)
+	if err != nil {
+		return err
+	}
+	if err := us.checkPassword(stored, current, ip); err != nil {
+		return err
+	}
+	newUser := User{
+		Password: password,
+		Email:    stored.Email,
+		Name:     stored.Name,
+	}
+	err = runUserValFuncs(&newUser,
+		us.validator.passwordRequired,
+		us.validator.passwordPolicy,
+		us.validator.hashPassword,
+	)
+	if err != nil {
+		return err
+	}
+	update := struct {
+		PasswordHash string `json:":p"`
+	}{
+		PasswordHash: newUser.PasswordHash,
+	}
+	updateExp := "set password_hash = :p"
+	if err := us.UserDB.Update(user, update, updateExp); err != nil {
+		return err
+	}
+	user.PasswordHash = newUser.PasswordHash
+	return us.revokeCredentials(user.Email)
+}
+
+// revokeCredentials ends every session and revokes every API key of
+// the user, for when the password changes. Whoever had access to the
+// account before loses it.
+func (us *userService) revokeCredentials(email string) error {
+	if err := us.sessions.DeleteByEmail(email, ""); err != nil {
+		return err
+	}
+	return us.apiKeys.DeleteByEmail(email)
+}
+
+// comparePassword returns ErrPasswordIncorrect if the password
+// is not the one of the user
+func (us *userService) comparePassword(user *User, password string) error {
+	err := us.hasher.Compare(user.PasswordHash, password)
+	if err == pwhash.ErrMismatch {
+		return ErrPasswordIncorrect
+	}
+	return err
+}
+
+// rehashPassword hashes the password again if its hash was made with
+// an outdated algorithm, cost or pepper. The password must be correct.
+// A failure is only logged, the old hash still works.
+func (us *userService) rehashPassword(user *User, password string) {
+	if !us.hasher.NeedsRehash(user.PasswordHash) {
+		return
+	}
+	newUser := User{
+		Password: password,
+	}
+	if err := runUserValFuncs(&newUser, us.validator.hashPassword); err != nil {
+		log.Println("Unable to rehash the password of", user.Email, err)
+		return
+	}
+	update := struct {
+		PasswordHash string `json:":p"`
+		OldHash      string `json:":o"`
+	}{
+		PasswordHash: newUser.PasswordHash,
+		OldHash:      user.PasswordHash,
+	}
+	// The password may have changed since it was read
+	err := us.UserDB.ConditionalUpdate(user, update, "set password_hash = :p", "password_hash = :o")
+	if err != nil && err != db.ErrConditionFailed {
+		log.Println("Unable to rehash the password of", user.Email, err)
+		return
+	}
+	if err == nil {
+		user.PasswordHash = newUser.PasswordHash
+	}
+}
@@ -20,17 +20,26 @@ var (
 	dbPurchaseSortKeyName = "id"
 )
 
+// Purchase is an item bought by the user with the Email. Gifts
+// bought from a wishlist record the wishlist owner as Recipient.
 type Purchase struct {
-	ID    string       `json:"id"`
-	Email string       `json:"email"`
-	Date  time.Time    `json:"date"`
-	ItemP PurchaseItem `json:"item_p"`
+	ID         string       `json:"id"`
+	Email      string       `json:"email"`
+	Date       time.Time    `json:"date"`
+	ItemP      PurchaseItem `json:"item_p"`
+	Recipient  string       `json:"recipient,omitempty"`
+	WishlistID string       `json:"wishlist_id,omitempty"`
 }
 
+// PurchaseItem is a snapshot of the product bought. For products
+// with variants it also holds the variant chosen.
 type PurchaseItem struct {
-	ID    string `json:"id"`
-	NameP string `json:"name_p"`
-	Price int    `json:"price"`
+	ID         string      `json:"id"`
+	NameP      string      `json:"name_p"`
+	Price      int         `json:"price"`
+	SKU        string      `json:"sku"`
+	Variant    string      `json:"variant"`
+	Attributes []Attribute `json:"attributes"`
 }
 
 // PurchaseDB is used to interact with the purchases database.
@@ -39,6 +48,11 @@ type PurchaseDB interface {
 	ByEmail(email string) ([]Purchase, error)
 	// Methods for altering purchases
 	Create(purchase *Purchase) error
+	// ChangeEmail moves the purchases of a user to a new email
+	ChangeEmail(oldEmail, newEmail string) error
+	// ChangeRecipient replaces the recipient of the gifts bought
+	// for a user
+	ChangeRecipient(oldEmail, newEmail string) error
 }
 
 // PurchaseService is a set of methods used to manipulate and
@@ -137,7 +151,7 @@ func (pdb *purchaseDB) ByEmail(email string) ([]Purchase, error) {
 		Email: email,
 	}
 	keyCondExp := "email = :e"
-	projectionExp := "id, email, item_p.id, item_p.price, item_p.name_p, #dt"
+	projectionExp := "id, email, item_p.id, item_p.price, item_p.name_p, item_p.sku, item_p.variant, item_p.attributes, recipient, wishlist_id, #dt"
 	expressionAttributeNames := map[string]*string{
 		"#dt": aws.String("date"),
 	}
@@ -147,3 +161,63 @@ func (pdb *purchaseDB) ByEmail(email string) ([]Purchase, error) {
 	}
 	return purchases, nil
 }
+
+// ChangeEmail will copy every purchase of the old email to the new
+// one and then delete the original. Purchases already copied are
+// skipped if it is run again after a failure.
+func (pdb *purchaseDB) ChangeEmail(oldEmail, newEmail string) error {
+	purchases, err := pdb.ByEmail(oldEmail)
+	if err != nil {
+		return err
+	}
+	for _, purchase := range purchases {
+		purchase.Email = newEmail
+		if err := pdb.db.PutItem(dbPurchaseTableName, &purchase); err != nil {
+			return err
+		}
+		key := purchaseTableQueryKey{
+			Email: oldEmail,
+			ID:    purchase.ID,
+		}
+		if err := pdb.db.DeleteItem(dbPurchaseTableName, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChangeRecipient will replace the recipient of every gift bought
+// for the old email. Gifts are stored with the buyer so the whole
+// table is scanned.
+func (pdb *purchaseDB) ChangeRecipient(oldEmail, newEmail string) error {
+	purchases := []Purchase{}
+	values := struct {
+		Recipient string `json:":r"`
+	}{
+		Recipient: oldEmail,
+	}
+	err := pdb.db.Scan(dbPurchaseTableName, "recipient = :r", values, nil, &purchases)
+	if err != nil {
+		return err
+	}
+	for _, purchase := range purchases {
+		key := purchaseTableQueryKey{
+			Email: purchase.Email,
+			ID:    purchase.ID,
+		}
+		update := struct {
+			Recipient string `json:":r"`
+		}{
+			Recipient: newEmail,
+		}
+		if err := pdb.db.UpdateItem(dbPurchaseTableName, key, update, "set recipient = :r"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type purchaseTableQueryKey struct {
+	Email string `json:"email"`
+	ID    string `json:"id"`
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"errors"
+)
+
+// Roles of the users
+const (
+	RoleCustomer = "customer"
+	RoleSupport  = "support"
+	RoleAdmin    = "admin"
+)
+
+var (
+	// ErrRoleInvalid is returned when setting a role that is not
+	// RoleCustomer, RoleSupport nor RoleAdmin.
+	ErrRoleInvalid = errors.New("models: role must be customer, support or admin")
+)
+
+// RoleOrDefault returns the role of the user. Users registered
+// before the roles existed are customers.
+func (u *User) RoleOrDefault() string {
+	if u.Role == "" {
+		return RoleCustomer
+	}
+	return u.Role
+}
+
+// HasRole returns true if the user has one of the roles
+func (u *User) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if u.RoleOrDefault() == role {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRole will change the role of the user. The sessions are
+// revoked since the tokens carry the old role, so the user must
+// log in again.
+func (us *userService) SetRole(user *User, role string) error {
+	switch role {
+	case RoleCustomer, RoleSupport, RoleAdmin:
+	default:
+		return ErrRoleInvalid
+	}
+	update := struct {
+		Role string `json:":r"`
+	}{
+		Role: role,
+	}
+	updateExp := "set user_role = :r"
+	if err := us.UserDB.Update(user, update, updateExp); err != nil {
+		return err
+	}
+	user.Role = role
+	return us.sessions.DeleteByEmail(user.Email, "")
+}
@@ -0,0 +1,322 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/jcamilom/ecommerce/db"
+	"github.com/jcamilom/ecommerce/session"
+)
+
+var (
+	// The DB table name for the sessions
+	dbSessionsTableName = "Sessions"
+
+	// The DB global secondary index to look up the sessions of a user
+	dbSessionsEmailIndexName = "email-index"
+
+	// ErrRefreshTokenInvalid is returned when a refresh token doesn't
+	// exist, expired, was already used or its session was revoked.
+	ErrRefreshTokenInvalid = errors.New("models: refresh token is invalid or expired")
+)
+
+// Time a session lasts without being refreshed
+const sessionRefreshExpireTime = 30 * 24 * time.Hour
+
+// Length in bytes of the random part of the refresh tokens
+const refreshTokenBytes = 32
+
+// Session is a device where the user is logged in. Each session has
+// a refresh token, of which only the hash is stored, that is replaced
+// every time it is used.
+type Session struct {
+	ID               string    `json:"id"`
+	Email            string    `json:"email"`
+	RefreshTokenHash string    `json:"refresh_token_hash"`
+	Device           string    `json:"device"`
+	IP               string    `json:"ip"`
+	CreatedAt        time.Time `json:"created_at"`
+	LastUsedAt       time.Time `json:"last_used_at"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	// TTL is the expiry time in unix seconds, so DynamoDB deletes
+	// the expired sessions
+	TTL int64 `json:"ttl"`
+}
+
+// Tokens are the credentials given to the user when a session starts
+// or is refreshed. ExpiresIn is the lifetime of the access token in
+// seconds.
+type Tokens struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// StartSession creates a session for the user on the device
+func (us *userService) StartSession(user *User, device, ip string) (*Tokens, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := newRandomToken(refreshTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	s := &Session{
+		ID:               id,
+		Email:            user.Email,
+		RefreshTokenHash: hashToken(secret),
+		Device:           device,
+		IP:               ip,
+		CreatedAt:        now,
+		LastUsedAt:       now,
+		ExpiresAt:        now.Add(sessionRefreshExpireTime),
+	}
+	s.TTL = s.ExpiresAt.Unix()
+	if err := us.sessions.Create(s); err != nil {
+		return nil, err
+	}
+	return us.newTokens(user, s, secret)
+}
+
+// Refresh replaces the refresh token with a new one and returns a new
+// access token. Using a refresh token twice revokes the session, as
+// it may have been stolen.
+func (us *userService) Refresh(refreshToken string) (*Tokens, error) {
+	parts := strings.SplitN(refreshToken, ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrRefreshTokenInvalid
+	}
+	s, err := us.sessions.ByID(parts[0])
+	if err == ErrNotFound {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(s.ExpiresAt) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if hashToken(parts[1]) != s.RefreshTokenHash {
+		if err := us.sessions.Delete(s.ID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenInvalid
+	}
+	user, err := us.ByEmail(s.Email)
+	if err == ErrNotFound {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	secret, err := newRandomToken(refreshTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = us.sessions.Rotate(s, hashToken(secret))
+	if err == ErrRefreshTokenInvalid {
+		// The token was used twice at the same time
+		if err := us.sessions.Delete(s.ID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return us.newTokens(user, s, secret)
+}
+
+// Sessions returns the sessions of the user that haven't expired
+func (us *userService) Sessions(user *User) ([]Session, error) {
+	sessions, err := us.sessions.ByEmail(user.Email)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	active := []Session{}
+	for _, s := range sessions {
+		// DynamoDB may take a while to delete the expired ones
+		if now.After(s.ExpiresAt) {
+			continue
+		}
+		active = append(active, s)
+	}
+	return active, nil
+}
+
+// RevokeSession ends a session of the user. ErrNotFound is returned
+// if the user has no session with the ID.
+func (us *userService) RevokeSession(user *User, id string) error {
+	s, err := us.sessions.ByID(id)
+	if err != nil {
+		return err
+	}
+	if s.Email != user.Email {
+		return ErrNotFound
+	}
+	return us.sessions.Delete(id)
+}
+
+// RevokeSessions ends every session of the user but the one with
+// the keepID, which may be empty.
+func (us *userService) RevokeSessions(user *User, keepID string) error {
+	return us.sessions.DeleteByEmail(user.Email, keepID)
+}
+
+// Logout revokes the access token and ends its session, or every
+// session of the user if everywhere is set
+func (us *userService) Logout(token string, everywhere bool) error {
+	claims, err := us.session.VerifyToken(token)
+	if err != nil {
+		return err
+	}
+	// The token is revoked so it stops working right away, even
+	// where the session isn't checked
+	if err := us.session.RevokeToken(claims); err != nil {
+		return err
+	}
+	if everywhere {
+		return us.sessions.DeleteByEmail(claims.Username, "")
+	}
+	return us.sessions.Delete(claims.SessionID)
+}
+
+func (us *userService) newTokens(user *User, s *Session, secret string) (*Tokens, error) {
+	token, err := us.session.CreateToken(&session.Claims{
+		Username:  user.Email,
+		Role:      user.RoleOrDefault(),
+		SessionID: s.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Tokens{
+		AccessToken:  token,
+		RefreshToken: s.ID + "." + secret,
+		ExpiresIn:    sessionExpireTime * 60,
+	}, nil
+}
+
+func newSessionDB() *sessionDB {
+	db := &db.DB{}
+	return &sessionDB{
+		db: db,
+	}
+}
+
+type sessionDB struct {
+	db *db.DB
+}
+
+// ByID will look up the session with the provided ID
+func (sdb *sessionDB) ByID(id string) (*Session, error) {
+	s := new(Session)
+	key := sessionTableQueryKey{
+		ID: id,
+	}
+	found, err := sdb.db.GetItem(key, dbSessionsTableName, s)
+	if err != nil {
+		return nil, err
+	} else if found == false {
+		return nil, ErrNotFound
+	} else {
+		return s, nil
+	}
+}
+
+// ByEmail will look up the sessions of the user
+func (sdb *sessionDB) ByEmail(email string) ([]Session, error) {
+	sessions := []Session{}
+	key := struct {
+		Email string `json:":e"`
+	}{
+		Email: email,
+	}
+	err := sdb.db.QueryIndex(dbSessionsTableName, dbSessionsEmailIndexName, key, "email = :e", &sessions)
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Create will create the provided session in the database
+func (sdb *sessionDB) Create(s *Session) error {
+	return sdb.db.PutItem(dbSessionsTableName, s)
+}
+
+// Rotate will replace the refresh token hash of the session as long
+// as it wasn't replaced by someone else in the meantime, in which
+// case ErrRefreshTokenInvalid is returned. The session lasts
+// sessionRefreshExpireTime from now.
+func (sdb *sessionDB) Rotate(s *Session, hash string) error {
+	key := sessionTableQueryKey{
+		ID: s.ID,
+	}
+	now := time.Now()
+	expiresAt := now.Add(sessionRefreshExpireTime)
+	update := struct {
+		Old       string    `json:":o"`
+		New       string    `json:":n"`
+		UsedAt    time.Time `json:":u"`
+		ExpiresAt time.Time `json:":e"`
+		TTL       int64     `json:":t"`
+	}{
+		Old:       s.RefreshTokenHash,
+		New:       hash,
+		UsedAt:    now,
+		ExpiresAt: expiresAt,
+		TTL:       expiresAt.Unix(),
+	}
+	// ttl is a reserved word
+	updateExp := "set refresh_token_hash = :n, last_used_at = :u, expires_at = :e, #t = :t"
+	expAttNames := map[string]*string{
+		"#t": aws.String("ttl"),
+	}
+	err := sdb.db.UpdateItemReturning(dbSessionsTableName, key, update, updateExp, "refresh_token_hash = :o", expAttNames, &Session{})
+	if err == db.ErrConditionFailed {
+		return ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+	s.RefreshTokenHash = update.New
+	s.LastUsedAt = update.UsedAt
+	s.ExpiresAt = update.ExpiresAt
+	s.TTL = update.TTL
+	return nil
+}
+
+// Delete will delete the session with the provided ID
+func (sdb *sessionDB) Delete(id string) error {
+	key := sessionTableQueryKey{
+		ID: id,
+	}
+	return sdb.db.DeleteItem(dbSessionsTableName, key)
+}
+
+// DeleteByEmail will delete the sessions of the user but the one
+// with the keepID
+func (sdb *sessionDB) DeleteByEmail(email, keepID string) error {
+	sessions, err := sdb.ByEmail(email)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if s.ID == keepID {
+			continue
+		}
+		if err := sdb.Delete(s.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sessionTableQueryKey struct {
+	ID string `json:"id"`
+}
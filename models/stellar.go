@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 
 	"github.com/stellar/go/clients/horizonclient"
 	"github.com/stellar/go/keypair"
@@ -59,6 +60,43 @@ func (ss *StellarService) GetBalance(address string) (string, error) {
 
 // ExecutePayment performs a payment operation in the stellar network
 func (ss *StellarService) ExecutePayment(sourceSeed, destinationAddr, amount string) error {
+	// Construct the operation
+	paymentOp := txnbuild.Payment{
+		Destination: destinationAddr,
+		Amount:      amount,
+		Asset:       txnbuild.NativeAsset{},
+	}
+	return ss.submit(sourceSeed, &paymentOp)
+}
+
+// MergeAccount sends every lumen of the account to the destination
+// and removes the account from the Stellar network. Merging an
+// account that no longer exists is not an error, so a failed
+// account deletion can be retried.
+func (ss *StellarService) MergeAccount(sourceSeed, destinationAddr string) error {
+	mergeOp := txnbuild.AccountMerge{
+		Destination: destinationAddr,
+	}
+	err := ss.submit(sourceSeed, &mergeOp)
+	if e, ok := err.(*horizonclient.Error); ok && e.Problem.Status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// ValidAddress returns true if the address is a Stellar public key
+func (ss *StellarService) ValidAddress(address string) bool {
+	kp, err := keypair.Parse(address)
+	if err != nil {
+		return false
+	}
+	_, isFull := kp.(*keypair.Full)
+	return !isFull
+}
+
+// submit signs a transaction with the operation and submits it
+// to the stellar network
+func (ss *StellarService) submit(sourceSeed string, op txnbuild.Operation) error {
 	// Recover the keypair from the account seed
 	kp, _ := keypair.Parse(sourceSeed)
 	// Get information about the account
@@ -69,17 +107,10 @@ func (ss *StellarService) ExecutePayment(sourceSeed, destinationAddr, amount str
 		return err
 	}
 
-	// Construct the operation
-	paymentOp := txnbuild.Payment{
-		Destination: destinationAddr,
-		Amount:      amount,
-		Asset:       txnbuild.NativeAsset{},
-	}
-
 	// Construct the transaction that will carry the operation
 	tx := txnbuild.Transaction{
 		SourceAccount: &sourceAccount,
-		Operations:    []txnbuild.Operation{&paymentOp},
+		Operations:    []txnbuild.Operation{op},
 		Timebounds:    txnbuild.NewInfiniteTimeout(),
 		Network:       network.TestNetworkPassphrase,
 	}
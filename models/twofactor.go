@@ -0,0 +1,327 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jcamilom/ecommerce/db"
+	"github.com/jcamilom/ecommerce/totp"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+var (
+	// ErrTOTPAlreadyEnabled is returned when enrolling a user that
+	// already has two-factor authentication.
+	ErrTOTPAlreadyEnabled = errors.New("models: two-factor authentication is already enabled")
+
+	// ErrTOTPNotEnabled is returned when disabling two-factor
+	// authentication or asking for recovery codes without it.
+	ErrTOTPNotEnabled = errors.New("models: two-factor authentication is not enabled")
+
+	// ErrTOTPNotEnrolled is returned when confirming two-factor
+	// authentication before starting the enrollment.
+	ErrTOTPNotEnrolled = errors.New("models: start the two-factor enrollment first")
+
+	// ErrTOTPCodeRequired is returned when an action needs a
+	// two-factor code and none was sent.
+	ErrTOTPCodeRequired = errors.New("models: two-factor code is required")
+
+	// ErrTOTPCodeInvalid is returned when a two-factor or recovery
+	// code is wrong or was already used.
+	ErrTOTPCodeInvalid = errors.New("models: two-factor code is invalid")
+
+	// ErrMFATokenInvalid is returned when the token of the second
+	// login step is invalid or expired.
+	ErrMFATokenInvalid = errors.New("models: two-factor login token is invalid or expired")
+)
+
+// Name of the API in the authenticator apps
+const totpIssuer = "ecommerce"
+
+// Size in pixels of the enrollment QR code
+const totpQRCodeSize = 256
+
+// Number of recovery codes given to the user
+const recoveryCodeCount = 10
+
+// Length in bytes of the recovery codes
+const recoveryCodeBytes = 5
+
+// MFA token expire time, the time the user has for the second login
+// step
+const mfaExpireTime = 5 * time.Minute
+
+// TOTPEnrollment is what the user needs to add the account to an
+// authenticator app
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URL    string `json:"url"`
+	// QRCode is a PNG of the URL
+	QRCode []byte `json:"qr_code"`
+}
+
+// EnrollTOTP creates a secret for the user, which doesn't take effect
+// until a code of it is confirmed with ConfirmTOTP. Enrolling again
+// replaces the secret.
+func (us *userService) EnrollTOTP(user *User) (*TOTPEnrollment, error) {
+	if user.TOTPEnabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return nil, err
+	}
+	url := totp.URL(totpIssuer, user.Email, secret)
+	png, err := qrcode.Encode(url, qrcode.Medium, totpQRCodeSize)
+	if err != nil {
+		return nil, err
+	}
+	update := struct {
+		Secret string `json:":s"`
+	}{
+		Secret: secret,
+	}
+	if err := us.UserDB.Update(user, update, "set totp_secret = :s"); err != nil {
+		return nil, err
+	}
+	user.TOTPSecret = secret
+	return &TOTPEnrollment{
+		Secret: secret,
+		URL:    url,
+		QRCode: png,
+	}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication once the user sends
+// a code of the enrolled secret. The recovery codes are returned,
+// only this time.
+func (us *userService) ConfirmTOTP(user *User, code string) ([]string, error) {
+	if user.TOTPEnabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTOTPNotEnrolled
+	}
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return nil, ErrTOTPCodeInvalid
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	update := struct {
+		Enabled bool     `json:":e"`
+		Step    int64    `json:":s"`
+		Hashes  []string `json:":h"`
+	}{
+		Enabled: true,
+		Step:    step,
+		Hashes:  hashes,
+	}
+	updateExp := "set totp_enabled = :e, totp_last_step = :s, recovery_code_hashes = :h"
+	if err := us.UserDB.Update(user, update, updateExp); err != nil {
+		return nil, err
+	}
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	user.RecoveryCodeHashes = hashes
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off. The password and
+// a two-factor or recovery code are required.
+func (us *userService) DisableTOTP(user *User, password, code, ip string) error {
+	if !user.TOTPEnabled {
+		return ErrTOTPNotEnabled
+	}
+	if err := us.checkPassword(user, password, ip); err != nil {
+		return err
+	}
+	if err := us.StepUp(user, code, ip); err != nil {
+		return err
+	}
+	update := struct {
+		Enabled bool     `json:":e"`
+		Secret  string   `json:":s"`
+		Hashes  []string `json:":h"`
+	}{
+		Enabled: false,
+		Secret:  "",
+		Hashes:  []string{},
+	}
+	updateExp := "set totp_enabled = :e, totp_secret = :s, recovery_code_hashes = :h"
+	if err := us.UserDB.Update(user, update, updateExp); err != nil {
+		return err
+	}
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.RecoveryCodeHashes = nil
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user.
+// A two-factor code is required.
+func (us *userService) RegenerateRecoveryCodes(user *User, code, ip string) ([]string, error) {
+	if !user.TOTPEnabled {
+		return nil, ErrTOTPNotEnabled
+	}
+	if err := us.StepUp(user, code, ip); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	update := struct {
+		Hashes []string `json:":h"`
+	}{
+		Hashes: hashes,
+	}
+	if err := us.UserDB.Update(user, update, "set recovery_code_hashes = :h"); err != nil {
+		return nil, err
+	}
+	user.RecoveryCodeHashes = hashes
+	return codes, nil
+}
+
+// VerifySecondFactor checks a code of the authenticator app or a
+// recovery code of the user. Each code works only once.
+func (us *userService) VerifySecondFactor(user *User, code string) error {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return ErrTOTPCodeRequired
+	}
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		// The step only moves forward, so the same code, or an older
+		// one, can't be used again
+		update := struct {
+			Step int64 `json:":s"`
+		}{
+			Step: step,
+		}
+		updateExp := "set totp_last_step = :s"
+		condExp := "attribute_not_exists(totp_last_step) OR totp_last_step < :s"
+		err := us.UserDB.ConditionalUpdate(user, update, updateExp, condExp)
+		if err == db.ErrConditionFailed {
+			return ErrTOTPCodeInvalid
+		}
+		if err != nil {
+			return err
+		}
+		user.TOTPLastStep = step
+		return nil
+	}
+	hash := hashToken(normalizeRecoveryCode(code))
+	for i, h := range user.RecoveryCodeHashes {
+		if h != hash {
+			continue
+		}
+		update := struct {
+			Hash string `json:":h"`
+		}{
+			Hash: hash,
+		}
+		updateExp := fmt.Sprintf("remove recovery_code_hashes[%d]", i)
+		condExp := fmt.Sprintf("recovery_code_hashes[%d] = :h", i)
+		err := us.UserDB.ConditionalUpdate(user, update, updateExp, condExp)
+		if err == db.ErrConditionFailed {
+			return ErrTOTPCodeInvalid
+		}
+		if err != nil {
+			return err
+		}
+		user.RecoveryCodeHashes = append(user.RecoveryCodeHashes[:i:i], user.RecoveryCodeHashes[i+1:]...)
+		return nil
+	}
+	return ErrTOTPCodeInvalid
+}
+
+// StepUp checks a two-factor or recovery code of the user before a
+// sensitive action. Wrong codes count as failed logins, like wrong
+// passwords, so the codes can't be guessed with a stolen session.
+func (us *userService) StepUp(user *User, code, ip string) error {
+	if err := us.checkLockout(user.Email, ip); err != nil {
+		return err
+	}
+	err := us.VerifySecondFactor(user, code)
+	if err == ErrTOTPCodeInvalid {
+		if ferr := us.loginFailed(user.Email, ip); ferr != nil {
+			return ferr
+		}
+	}
+	return err
+}
+
+// StartMFA returns the token of the second login step of a user
+// with two-factor authentication. It is random and works only once.
+func (us *userService) StartMFA(user *User) (string, error) {
+	return us.newOneTimeToken(tokenPurposeMFA, user.Email, mfaExpireTime)
+}
+
+// CompleteMFA returns the user of the MFA token if the code is
+// correct, and spends the token. Wrong codes count as failed logins,
+// like wrong passwords.
+func (us *userService) CompleteMFA(mfaToken, code, ip string) (*User, error) {
+	challenge, err := us.tokens.Valid(tokenPurposeMFA, mfaToken)
+	if err == ErrNotFound {
+		return nil, ErrMFATokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	user, err := us.ByEmail(challenge.Email)
+	if err == ErrNotFound {
+		return nil, ErrMFATokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !user.TOTPEnabled {
+		return nil, ErrMFATokenInvalid
+	}
+	if err := us.StepUp(user, code, ip); err != nil {
+		return nil, err
+	}
+	err = us.tokens.MarkUsed(challenge)
+	if err == ErrNotFound {
+		return nil, ErrMFATokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := us.attempts.Delete(accountAttemptKey(user.Email)); err != nil {
+		return nil, err
+	}
+	us.audit(AuditLoginSucceeded, user.Email, ip)
+	return user, nil
+}
+
+// newRecoveryCodes returns the recovery codes, formatted as
+// xxxx-xxxx, and their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashToken(code)
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode lets the user type the codes in any case and
+// without the dash
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.Replace(code, " ", "", -1)
+}
@@ -2,11 +2,18 @@ package models
 
 import (
 	"errors"
+	"log"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/jcamilom/ecommerce/db"
+	"github.com/jcamilom/ecommerce/notify"
+	"github.com/jcamilom/ecommerce/oidc"
+	"github.com/jcamilom/ecommerce/pwhash"
+	"github.com/jcamilom/ecommerce/pwpolicy"
 	"github.com/jcamilom/ecommerce/session"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -45,10 +52,6 @@ var (
 	// without a user password provided.
 	ErrPasswordRequired = errors.New("models: password is required")
 
-	// ErrPasswordTooShort is returned when an update or create is
-	// attempted with a user password that is less than 8 characters.
-	ErrPasswordTooShort = errors.New("models: password must be at least 8 characters long")
-
 	// ErrNameRequired is returned when a name is not provided
 	// when creating a user
 	ErrNameRequired = errors.New("models: name is required")
@@ -56,14 +59,30 @@ var (
 	// ErrIsFavorite is returned when an user tries to add a new favorite that
 	// is already on the favorites list.
 	ErrIsFavorite = errors.New("models: product is already a favorite")
+
+	// ErrFavoriteNotFound is returned when an user tries to remove a
+	// product that is not on the favorites list.
+	ErrFavoriteNotFound = errors.New("models: product is not a favorite")
+
+	// ErrFavoritesOrderInvalid is returned when the new order of the
+	// favorites doesn't list every favorite exactly once.
+	ErrFavoritesOrderInvalid = errors.New("models: favorites order must list every favorite once")
 )
 
+// userPwPepper is the pepper of the passwords hashed before the
+// peppers were configurable, version 0
 const userPwPepper = "secret-random-string"
 const sessionKey = "my_secret_key"
 
 // Token expire time in minutes
 const sessionExpireTime = 5
 
+// Audience of the access tokens, for the services that verify them
+const sessionAudience = "ecommerce-api"
+
+// Clock skew tolerated when checking the times of the tokens
+const tokenClockSkew = 30 * time.Second
+
 // User represents the user model stored in the database
 // This is used for user accounts, storing both an email
 // address and a password so users can log in and gain
@@ -74,9 +93,25 @@ type User struct {
 	Email        string     `json:"email"`
 	Password     string     `json:"password"`
 	PasswordHash string     `json:"password_hash"`
-	AccessToken  string     `json:"access_token"`
 	Favorites    []Favorite `json:"favorites"`
 	Wallet       Wallet     `json:"wallet"`
+	// Role is RoleCustomer, RoleSupport or RoleAdmin. The attribute
+	// is user_role as role is reserved in DynamoDB.
+	Role string `json:"user_role"`
+	// NotificationPrefs are the notifications wanted about the
+	// favorites. It is nil until the user changes them.
+	NotificationPrefs *NotificationPrefs `json:"notification_prefs"`
+	// VerificationPending is set until the user confirms the email
+	VerificationPending bool      `json:"verification_pending"`
+	VerificationSentAt  time.Time `json:"verification_sent_at"`
+	// TOTPSecret is the secret of the authenticator app, which is
+	// used once TOTPEnabled is set. TOTPLastStep is the time step of
+	// the last accepted code, so codes can't be used twice.
+	TOTPSecret   string `json:"totp_secret"`
+	TOTPEnabled  bool   `json:"totp_enabled"`
+	TOTPLastStep int64  `json:"totp_last_step"`
+	// RecoveryCodeHashes are the hashes of the unused recovery codes
+	RecoveryCodeHashes []string `json:"recovery_code_hashes"`
 }
 
 // Favorite represents a product to be add to the favorite list
@@ -106,9 +141,20 @@ type Wallet struct {
 type UserDB interface {
 	// Methods for querying for single users
 	ByEmail(email string) (*User, error)
+	// Methods for querying several users
+	ByFavorites(productIDs []string) ([]User, error)
 	// Methods for altering users
 	Create(user *User) error
 	Update(user *User, update interface{}, updateExp string) error
+	// ConditionalUpdate returns db.ErrConditionFailed if the
+	// condition doesn't hold
+	ConditionalUpdate(user *User, update interface{}, updateExp, condExp string) error
+	UpdateName(user *User, name string) error
+	// Move stores the user under a new email and deletes the
+	// row of the old one in a single transaction. ErrEmailTaken is
+	// returned if the new email is in use.
+	Move(user *User, email string) error
+	Delete(email string) error
 }
 
 // UserService is a set of methods used to manipulate and
@@ -118,25 +164,150 @@ type UserService interface {
 	// password are correct. If they are correct, the user
 	// corresponding to that email will be returned. Otherwise
 	// You will receive either:
-	// ErrNotFound, ErrPasswordIncorrect, or another error if
-	// something goes wrong.
-	Authenticate(email, password string) (*User, error)
+	// ErrNotFound, ErrPasswordIncorrect, a *LockoutError after too
+	// many failed logins of the account or the IP address, or
+	// another error if something goes wrong.
+	Authenticate(email, password, ip string) (*User, error)
+	// UnlockAccount forgets the failed logins of the user with the
+	// token of the link emailed on lockout
+	UnlockAccount(token string) (*User, error)
 	Register(user *User) error
-	Authorize(token string) (*User, error)
+	// Authorize verifies the access token and returns the user
+	// and the session of the token
+	Authorize(token string) (*User, *Session, error)
+	StartSession(user *User, device, ip string) (*Tokens, error)
+	// Refresh rotates the refresh token and returns new tokens
+	Refresh(refreshToken string) (*Tokens, error)
+	Sessions(user *User) ([]Session, error)
+	RevokeSession(user *User, id string) error
+	RevokeSessions(user *User, keepID string) error
+	// Logout revokes the access token and ends its session, or
+	// every session of the user if everywhere is set
+	Logout(token string, everywhere bool) error
+	// AuthorizeAPIKey returns the user of an API key that allows
+	// the scope
+	AuthorizeAPIKey(apiKey, scope string) (*User, *APIKey, error)
+	// LoginWithIdentity returns the user of the account of an
+	// OpenID Connect provider, linking or creating it the first time
+	LoginWithIdentity(provider string, claims *oidc.Claims) (*User, error)
+	Identities(user *User) ([]Identity, error)
+	// EnrollTOTP starts the two-factor enrollment and ConfirmTOTP
+	// enables it with the first code
+	EnrollTOTP(user *User) (*TOTPEnrollment, error)
+	ConfirmTOTP(user *User, code string) ([]string, error)
+	DisableTOTP(user *User, password, code, ip string) error
+	RegenerateRecoveryCodes(user *User, code, ip string) ([]string, error)
+	// VerifySecondFactor checks a two-factor or recovery code
+	VerifySecondFactor(user *User, code string) error
+	// StepUp checks a two-factor or recovery code like
+	// VerifySecondFactor, counting the wrong ones as failed logins
+	// of the account and IP address
+	StepUp(user *User, code, ip string) error
+	// StartMFA returns the token of the second login step, which
+	// CompleteMFA trades with a code for the user
+	StartMFA(user *User) (string, error)
+	CompleteMFA(mfaToken, code, ip string) (*User, error)
+	CreateAPIKey(user *User, name string, scopes []string, expiresAt time.Time) (*APIKey, string, error)
+	APIKeys(user *User) ([]APIKey, error)
+	RevokeAPIKey(user *User, id string) error
 	AddFavorite(user *User, favorite Favorite) error
+	RemoveFavorite(user *User, productID string) error
+	// ReorderFavorites sorts the favorites in the order of the
+	// provided product IDs, which must list every favorite once.
+	ReorderFavorites(user *User, productIDs []string) error
+	UpdateNotificationPrefs(user *User, prefs NotificationPrefs) error
+	// ChangeEmail sends a link to confirm the new email if the
+	// current password is correct. The user keeps the old email
+	// until ConfirmEmailChange. Like the rest of the methods that
+	// take the password, wrong ones count as failed logins of the
+	// account and IP address.
+	ChangeEmail(user *User, email, password, ip string) error
+	// ConfirmEmailChange moves the user, with the purchases, gifts
+	// and wishlists, to the new email with the token of the link.
+	// Every session is revoked.
+	ConfirmEmailChange(token string) (*User, error)
+	// ChangePassword sets a new password if the current one is
+	// correct. Every session and API key is revoked.
+	ChangePassword(user *User, current, password, ip string) error
+	ForgotPassword(email string) error
+	ResetPassword(token, password string) error
+	ResendVerification(user *User) error
+	SetRole(user *User, role string) error
+	// DeleteAccount removes the user after checking the password.
+	// The lumens are sent to the address, or to the store if it is
+	// empty, and the purchases are kept without the email.
+	DeleteAccount(user *User, password, address, ip string) error
+	// Export returns every data stored about the user
+	Export(user *User) (*UserExport, error)
+	// VerifyEmail confirms the email with the token of the
+	// verification link and returns the user
+	VerifyEmail(token string) (*User, error)
 	GetBalance(user *User) (float64, error)
 	ExecutePayment(user *User, amount int) error
 	UserDB
 }
 
-func NewUserService() UserService {
+// NewPasswordHasher creates the hasher of the passwords with the
+// config. The pepper of the passwords hashed before the peppers were
+// configurable is added as version 0 if the config has no version 0.
+func NewPasswordHasher(c pwhash.Config) (*pwhash.Hasher, error) {
+	peppers := map[int]string{0: userPwPepper}
+	for v, p := range c.Peppers {
+		peppers[v] = p
+	}
+	c.Peppers = peppers
+	return pwhash.New(c)
+}
+
+// NewUserService creates the user service. The baseURL is the
+// address of the API, used in the links emailed to the users. The
+// access tokens are signed with the keys, or with sessionKey if
+// keys is nil, which is only for development. The passwords are
+// hashed with the hasher, or with bcrypt and userPwPepper if hasher
+// is nil, and must meet the policy, or only be 8 characters long if
+// policy is nil.
+func NewUserService(pus PurchaseService, ws WishlistService, notifier notify.Notifier, baseURL string, keys *session.KeySet, hasher *pwhash.Hasher, policy *pwpolicy.Policy) UserService {
 	udb := newUserDB()
-	session := session.NewSessionService(sessionExpireTime, sessionKey)
-	uv := newUserValidator(udb)
+	if keys == nil {
+		keys = session.NewHMACKeySet(sessionKey)
+	}
+	if hasher == nil {
+		hasher, _ = NewPasswordHasher(pwhash.Config{
+			Algorithm:  pwhash.Bcrypt,
+			BcryptCost: bcrypt.DefaultCost,
+		})
+	}
+	session := session.NewSessionService(session.Config{
+		ExpireTime: sessionExpireTime,
+		Keys:       keys,
+		Denylist:   session.NewDBDenylist(),
+		Issuer:     baseURL,
+		Audience:   sessionAudience,
+		ClockSkew:  tokenClockSkew,
+	})
+	if policy == nil {
+		policy = &pwpolicy.Policy{
+			MinLength: defaultPasswordMinLength,
+		}
+	}
+	uv := newUserValidator(udb, hasher, policy)
 	return &userService{
-		UserDB:  uv,
-		session: session,
-		stellar: NewStellarService(),
+		UserDB:      uv,
+		validator:   uv,
+		session:     session,
+		stellar:     NewStellarService(),
+		purchases:   pus,
+		wishlists:   ws,
+		sent:        newSentNotificationDB(),
+		sessions:    newSessionDB(),
+		apiKeys:     newAPIKeyDB(),
+		identities:  newIdentityDB(),
+		notifier:    notifier,
+		baseURL:     baseURL,
+		tokens:      newOneTimeTokenDB(),
+		attempts:    newLoginAttemptDB(),
+		auditEvents: newAuditEventDB(),
+		hasher:      hasher,
 	}
 }
 
@@ -144,13 +315,39 @@ var _ UserService = &userService{}
 
 type userService struct {
 	UserDB
-	session *session.Session
-	stellar *StellarService
+	validator   *userValidator
+	session     *session.Session
+	stellar     *StellarService
+	purchases   PurchaseService
+	wishlists   WishlistService
+	sent        *sentNotificationDB
+	sessions    *sessionDB
+	apiKeys     *apiKeyDB
+	identities  identityStore
+	notifier    notify.Notifier
+	baseURL     string
+	tokens      *oneTimeTokenDB
+	attempts    *loginAttemptDB
+	auditEvents *auditEventDB
+	hasher      *pwhash.Hasher
 }
 
 // Register is used to register a new user in the db. Additionally
-// an access token is created for the user and returned
+// a wallet is created for the user
 func (us *userService) Register(user *User) error {
+	if err := us.register(user); err != nil {
+		return err
+	}
+	// The user can ask for the email again, so a failure
+	// doesn't undo the registration
+	if err := us.sendVerification(user); err != nil {
+		log.Println("Unable to send the verification email to", user.Email, err)
+	}
+	return nil
+}
+
+// register creates the user and its wallet
+func (us *userService) register(user *User) error {
 	err := us.UserDB.Create(user)
 	if err != nil {
 		return err
@@ -164,7 +361,7 @@ func (us *userService) Register(user *User) error {
 		Seed:    kp.Seed(),
 		Address: kp.Address(),
 	}
-	return us.updateTokenAndWallet(user)
+	return us.updateWallet(user)
 }
 
 // Authenticate can be used to authenticate a user with the
@@ -175,45 +372,73 @@ func (us *userService) Register(user *User) error {
 //   nil, ErrPasswordIncorrect
 // If the email and password are both valid, this will return
 //   user, nil
+// If the account or the IP address has to wait after too many
+// failed logins, this will return
+//   nil, *LockoutError
 // Otherwise if another error is encountered this will return
 //   nil, error
-func (us *userService) Authenticate(email, password string) (*User, error) {
+func (us *userService) Authenticate(email, password, ip string) (*User, error) {
+	email = strings.TrimSpace(email)
+	if err := us.checkLockout(email, ip); err != nil {
+		return nil, err
+	}
 	foundUser, err := us.ByEmail(email)
-	if err != nil {
+	if err == nil {
+		err = us.comparePassword(foundUser, password)
+	}
+	if err == nil {
+		us.rehashPassword(foundUser, password)
+	}
+	switch err {
+	case nil:
+	case ErrNotFound, ErrPasswordIncorrect:
+		// The failures count for unknown emails too, so the lockout
+		// doesn't tell which emails are registered
+		if ferr := us.loginFailed(email, ip); ferr != nil {
+			return nil, ferr
+		}
+		return nil, err
+	default:
 		return nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(foundUser.PasswordHash), []byte(password+userPwPepper))
-	if err != nil {
-		switch err {
-		case bcrypt.ErrMismatchedHashAndPassword:
-			return nil, ErrPasswordIncorrect
-		default:
-			return nil, err
-		}
+	// With two-factor authentication the login only succeeds, and
+	// the failures are forgotten, once CompleteMFA checks the code
+	if foundUser.TOTPEnabled {
+		return foundUser, nil
 	}
-	err = us.updateToken(foundUser)
-	if err != nil {
+	if err := us.attempts.Delete(accountAttemptKey(email)); err != nil {
 		return nil, err
 	}
-
+	us.audit(AuditLoginSucceeded, email, ip)
 	return foundUser, nil
 }
 
-func (us *userService) Authorize(token string) (*User, error) {
-	email, err := us.session.VerifyToken(token)
+func (us *userService) Authorize(token string) (*User, *Session, error) {
+	claims, err := us.session.VerifyToken(token)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	foundUser, err := us.ByEmail(claims.Username)
+	if err == ErrNotFound {
+		return nil, nil, session.ErrTokenRevoked
 	}
-	foundUser, err := us.ByEmail(email)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	// Provided token must be the one from last login
-	if foundUser.AccessToken != token {
-		return nil, session.ErrTokenInvalid
+	// The session of the token must not be revoked, and the role
+	// must not have changed since the token was issued
+	s, err := us.sessions.ByID(claims.SessionID)
+	if err == ErrNotFound {
+		return nil, nil, session.ErrTokenRevoked
 	}
-	return foundUser, nil
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.Email != foundUser.Email || claims.Role != foundUser.RoleOrDefault() {
+		return nil, nil, session.ErrTokenRevoked
+	}
+	return foundUser, s, nil
 }
 
 func (us *userService) AddFavorite(user *User, favorite Favorite) error {
@@ -232,13 +457,65 @@ func (us *userService) AddFavorite(user *User, favorite Favorite) error {
 		return ErrIsFavorite
 	}
 	user.Favorites = append(user.Favorites, favorite)
+	return us.updateFavorites(user)
+}
+
+func (us *userService) RemoveFavorite(user *User, productID string) error {
+	user, err := us.UserDB.ByEmail(user.Email)
+	if err != nil {
+		return err
+	}
+	favorites := []Favorite{}
+	for _, f := range user.Favorites {
+		if f.ID != productID {
+			favorites = append(favorites, f)
+		}
+	}
+	if len(favorites) == len(user.Favorites) {
+		return ErrFavoriteNotFound
+	}
+	user.Favorites = favorites
+	return us.updateFavorites(user)
+}
+
+func (us *userService) ReorderFavorites(user *User, productIDs []string) error {
+	user, err := us.UserDB.ByEmail(user.Email)
+	if err != nil {
+		return err
+	}
+	if len(productIDs) != len(user.Favorites) {
+		return ErrFavoritesOrderInvalid
+	}
+	byID := map[string]Favorite{}
+	for _, f := range user.Favorites {
+		byID[f.ID] = f
+	}
+	favorites := []Favorite{}
+	for _, id := range productIDs {
+		f, ok := byID[id]
+		if !ok {
+			return ErrFavoritesOrderInvalid
+		}
+		// Remove it so repeated IDs are detected
+		delete(byID, id)
+		favorites = append(favorites, f)
+	}
+	user.Favorites = favorites
+	return us.updateFavorites(user)
+}
+
+func (us *userService) UpdateNotificationPrefs(user *User, prefs NotificationPrefs) error {
 	update := struct {
-		Favorites []Favorite `json:":f"`
+		Prefs NotificationPrefs `json:":n"`
 	}{
-		Favorites: user.Favorites,
+		Prefs: prefs,
 	}
-	updateExp := "set favorites = :f"
-	return us.UserDB.Update(user, update, updateExp)
+	updateExp := "set notification_prefs = :n"
+	if err := us.UserDB.Update(user, update, updateExp); err != nil {
+		return err
+	}
+	user.NotificationPrefs = &prefs
+	return nil
 }
 
 func (us *userService) GetBalance(user *User) (float64, error) {
@@ -259,35 +536,23 @@ func (us *userService) ExecutePayment(user *User, amount int) error {
 	return us.stellar.ExecutePayment(user.Wallet.Seed, StoreStellarAddress, amountStr)
 }
 
-func (us *userService) updateToken(user *User) error {
-	token, err := us.session.CreateToken(user.Email)
-	if err != nil {
-		return err
-	}
-	user.AccessToken = token
+func (us *userService) updateFavorites(user *User) error {
 	update := struct {
-		AccessToken string `json:":t"`
+		Favorites []Favorite `json:":f"`
 	}{
-		AccessToken: token,
+		Favorites: user.Favorites,
 	}
-	updateExp := "set access_token = :t"
+	updateExp := "set favorites = :f"
 	return us.UserDB.Update(user, update, updateExp)
 }
 
-func (us *userService) updateTokenAndWallet(user *User) error {
-	token, err := us.session.CreateToken(user.Email)
-	if err != nil {
-		return err
-	}
-	user.AccessToken = token
+func (us *userService) updateWallet(user *User) error {
 	update := struct {
-		AccessToken string `json:":t"`
-		Wallet      Wallet `json:":w"`
+		Wallet Wallet `json:":w"`
 	}{
-		AccessToken: token,
-		Wallet:      user.Wallet,
+		Wallet: user.Wallet,
 	}
-	updateExp := "set access_token = :t, wallet = :w"
+	updateExp := "set wallet = :w"
 	return us.UserDB.Update(user, update, updateExp)
 }
 
@@ -304,16 +569,20 @@ func runUserValFuncs(user *User, fns ...userValFunc) error {
 
 var _ UserDB = &userValidator{}
 
-func newUserValidator(udb UserDB) *userValidator {
+func newUserValidator(udb UserDB, hasher *pwhash.Hasher, policy *pwpolicy.Policy) *userValidator {
 	return &userValidator{
 		UserDB:     udb,
 		emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		hasher:     hasher,
+		policy:     policy,
 	}
 }
 
 type userValidator struct {
 	UserDB
 	emailRegex *regexp.Regexp
+	hasher     *pwhash.Hasher
+	policy     *pwpolicy.Policy
 }
 
 // ByEmail will normalize the email address before calling
@@ -332,8 +601,8 @@ func (uv *userValidator) ByEmail(email string) (*User, error) {
 func (uv *userValidator) Create(user *User) error {
 	err := runUserValFuncs(user,
 		uv.passwordRequired,
-		uv.passwordMinLength,
-		uv.bcryptPassword,
+		uv.passwordPolicy,
+		uv.hashPassword,
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
@@ -341,6 +610,8 @@ func (uv *userValidator) Create(user *User) error {
 		uv.normalizeName,
 		uv.requiredName,
 		uv.setEmptyFavorites,
+		uv.setVerificationPending,
+		uv.setDefaultRole,
 	)
 	if err != nil {
 		return err
@@ -353,19 +624,52 @@ func (uv *userValidator) Update(user *User, update interface{}, updateExp string
 	return uv.UserDB.Update(user, update, updateExp)
 }
 
-// bcryptPassword will hash a user's password with a
-// predefined pepper (userPwPepper) and bcrypt if the
-// Password field is not the empty string
-func (uv *userValidator) bcryptPassword(user *User) error {
+// UpdateName will normalize and require the name before calling
+// UpdateName on the UserDB field.
+func (uv *userValidator) UpdateName(user *User, name string) error {
+	u := User{
+		Name: name,
+	}
+	err := runUserValFuncs(&u,
+		uv.normalizeName,
+		uv.requiredName,
+	)
+	if err != nil {
+		return err
+	}
+	return uv.UserDB.UpdateName(user, u.Name)
+}
+
+// Move will validate the new email and make sure it is available
+// before calling Move on the UserDB field.
+func (uv *userValidator) Move(user *User, email string) error {
+	u := User{
+		Email: email,
+	}
+	err := runUserValFuncs(&u,
+		uv.normalizeEmail,
+		uv.requireEmail,
+		uv.emailFormat,
+		uv.emailIsAvail,
+	)
+	if err != nil {
+		return err
+	}
+	return uv.UserDB.Move(user, u.Email)
+}
+
+// hashPassword will hash a user's password with the
+// configured algorithm and pepper if the Password field
+// is not the empty string
+func (uv *userValidator) hashPassword(user *User) error {
 	if user.Password == "" {
 		return nil
 	}
-	pwBytes := []byte(user.Password + userPwPepper)
-	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes, bcrypt.DefaultCost)
+	hash, err := uv.hasher.Hash(user.Password)
 	if err != nil {
 		return err
 	}
-	user.PasswordHash = string(hashedBytes)
+	user.PasswordHash = hash
 	user.Password = ""
 	return nil
 }
@@ -406,16 +710,6 @@ func (uv *userValidator) emailIsAvail(user *User) error {
 	return ErrEmailTaken
 }
 
-func (uv *userValidator) passwordMinLength(user *User) error {
-	if user.Password == "" {
-		return nil
-	}
-	if len(user.Password) < 8 {
-		return ErrPasswordTooShort
-	}
-	return nil
-}
-
 func (uv *userValidator) passwordRequired(user *User) error {
 	if user.Password == "" {
 		return ErrPasswordRequired
@@ -440,6 +734,16 @@ func (uv *userValidator) setEmptyFavorites(user *User) error {
 	return nil
 }
 
+func (uv *userValidator) setDefaultRole(user *User) error {
+	user.Role = RoleCustomer
+	return nil
+}
+
+func (uv *userValidator) setVerificationPending(user *User) error {
+	user.VerificationPending = true
+	return nil
+}
+
 var _ UserDB = &userDB{}
 
 func newUserDB() *userDB {
@@ -471,6 +775,27 @@ func (udb *userDB) ByEmail(email string) (*User, error) {
 	}
 }
 
+// ByFavorites will look up the users with any of the products in
+// their favorites. The favorites are maps so the users are filtered
+// after the scan.
+func (udb *userDB) ByFavorites(productIDs []string) ([]User, error) {
+	users := []User{}
+	err := udb.db.Scan(dbUsersTableName, "", nil, nil, &users)
+	if err != nil {
+		return nil, err
+	}
+	found := []User{}
+	for _, user := range users {
+		for _, id := range productIDs {
+			if hasFavorite(&user, id) {
+				found = append(found, user)
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
 // Create will create the provided user in the database
 func (udb *userDB) Create(user *User) error {
 	return udb.db.PutItem(dbUsersTableName, user)
@@ -485,6 +810,65 @@ func (udb *userDB) Update(user *User, update interface{}, updateExp string) erro
 	return udb.db.UpdateItem(dbUsersTableName, key, update, updateExp)
 }
 
+// ConditionalUpdate will update the user as long as the condition
+// holds
+func (udb *userDB) ConditionalUpdate(user *User, update interface{}, updateExp, condExp string) error {
+	key := userTableQueryKey{
+		Email: user.Email,
+	}
+	return udb.db.ConditionalUpdateItem(dbUsersTableName, key, update, updateExp, condExp)
+}
+
+// UpdateName will update the name of the user
+func (udb *userDB) UpdateName(user *User, name string) error {
+	key := userTableQueryKey{
+		Email: user.Email,
+	}
+	update := struct {
+		Name string `json:":n"`
+	}{
+		Name: name,
+	}
+	names := map[string]*string{
+		"#n": aws.String("name"),
+	}
+	err := udb.db.UpdateItemWithNames(dbUsersTableName, key, update, "set #n = :n", names)
+	if err != nil {
+		return err
+	}
+	user.Name = name
+	return nil
+}
+
+// Move will create a copy of the user with the new email, as long
+// as no other user has it, and then delete the old one
+func (udb *userDB) Move(user *User, email string) error {
+	moved := *user
+	moved.Email = email
+	key := userTableQueryKey{
+		Email: user.Email,
+	}
+	// Both rows change in one transaction, so a failure never leaves
+	// two users with the same wallet seed
+	err := udb.db.MoveItem(dbUsersTableName, &moved, "attribute_not_exists(email)", key)
+	if err == db.ErrConditionFailed {
+		return ErrEmailTaken
+	}
+	if err != nil {
+		return err
+	}
+	user.Email = email
+	return nil
+}
+
+// Delete will delete the user with the provided email
+func (udb *userDB) Delete(email string) error {
+	key := userTableQueryKey{
+		Email: email,
+	}
+	return udb.db.DeleteItem(dbUsersTableName, key)
+}
+
 type userTableQueryKey struct {
 	Email string `json:"email"`
 }
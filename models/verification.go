@@ -0,0 +1,129 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/jcamilom/ecommerce/notify"
+)
+
+var (
+	// ErrEmailNotVerified is returned when a user that hasn't
+	// confirmed the email tries to do something that requires it.
+	ErrEmailNotVerified = errors.New("models: email address is not verified")
+
+	// ErrEmailAlreadyVerified is returned when asking for a
+	// verification email for a verified user.
+	ErrEmailAlreadyVerified = errors.New("models: email address is already verified")
+
+	// ErrVerificationTooSoon is returned when asking for another
+	// verification email too soon after the last one.
+	ErrVerificationTooSoon = errors.New("models: wait a few minutes before asking for another verification email")
+
+	// ErrVerificationTokenInvalid is returned when a verification
+	// token is invalid, expired or for an unknown user.
+	ErrVerificationTokenInvalid = errors.New("models: verification token is invalid or expired")
+)
+
+// Kind of the verification messages
+const NotificationEmailVerification = "email_verification"
+
+// Verification token expire time
+const verificationExpireTime = 24 * time.Hour
+
+// Minimum time between two verification emails to the same user
+const verificationResendInterval = 2 * time.Minute
+
+// ResendVerification sends the verification email again, as long
+// as the last one wasn't sent too recently.
+func (us *userService) ResendVerification(user *User) error {
+	if !user.VerificationPending {
+		return ErrEmailAlreadyVerified
+	}
+	if time.Since(user.VerificationSentAt) < verificationResendInterval {
+		return ErrVerificationTooSoon
+	}
+	return us.sendVerification(user)
+}
+
+// VerifyEmail confirms the email of the user the token was sent to.
+// The token works only once.
+func (us *userService) VerifyEmail(token string) (*User, error) {
+	verification, err := us.tokens.Valid(tokenPurposeVerification, token)
+	if err == ErrNotFound {
+		return nil, ErrVerificationTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	user, err := us.ByEmail(verification.Email)
+	if err == ErrNotFound {
+		return nil, ErrVerificationTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = us.tokens.MarkUsed(verification)
+	if err == ErrNotFound {
+		return nil, ErrVerificationTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !user.VerificationPending {
+		return user, nil
+	}
+	if err := us.markVerified(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// markVerified confirms the email of the user
+func (us *userService) markVerified(user *User) error {
+	update := struct {
+		Pending bool `json:":v"`
+	}{
+		Pending: false,
+	}
+	updateExp := "set verification_pending = :v"
+	if err := us.UserDB.Update(user, update, updateExp); err != nil {
+		return err
+	}
+	user.VerificationPending = false
+	return nil
+}
+
+// sendVerification marks the email of the user as pending and
+// sends a link with a single-use token to confirm it
+func (us *userService) sendVerification(user *User) error {
+	token, err := us.newOneTimeToken(tokenPurposeVerification, user.Email, verificationExpireTime)
+	if err != nil {
+		return err
+	}
+	update := struct {
+		Pending bool      `json:":v"`
+		SentAt  time.Time `json:":s"`
+	}{
+		Pending: true,
+		SentAt:  time.Now(),
+	}
+	updateExp := "set verification_pending = :v, verification_sent_at = :s"
+	if err := us.UserDB.Update(user, update, updateExp); err != nil {
+		return err
+	}
+	user.VerificationPending = update.Pending
+	user.VerificationSentAt = update.SentAt
+	link := fmt.Sprintf("%v/users/verify?token=%v", us.baseURL, url.QueryEscape(token))
+	return us.notifier.Notify(notify.Message{
+		To:      user.Email,
+		Kind:    NotificationEmailVerification,
+		Subject: "Confirm your email",
+		Body:    fmt.Sprintf("Hi %v, open this link to confirm your email: %v", user.Name, link),
+		Data: map[string]string{
+			"link": link,
+		},
+	})
+}
@@ -0,0 +1,496 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/jcamilom/ecommerce/db"
+)
+
+var (
+	// The DB table name for wishlists
+	dbWishlistsTableName = "Wishlists"
+
+	// The DB global secondary index to look up wishlists by slug
+	dbWishlistsSlugIndexName = "slug-index"
+
+	// ErrWishlistNameRequired is returned when a wishlist is
+	// created or renamed without a name.
+	ErrWishlistNameRequired = errors.New("models: wishlist name is required")
+
+	// ErrIsInWishlist is returned when adding a product that is
+	// already on the wishlist.
+	ErrIsInWishlist = errors.New("models: product is already on the wishlist")
+
+	// ErrNotInWishlist is returned when removing or buying a product
+	// that is not on the wishlist.
+	ErrNotInWishlist = errors.New("models: product is not on the wishlist")
+
+	// ErrWishlistItemPurchased is returned when buying as a gift an
+	// item of a wishlist that someone else already bought.
+	ErrWishlistItemPurchased = errors.New("models: wishlist item was already purchased")
+)
+
+// Length in bytes of the random share slugs
+const wishlistSlugBytes = 18
+
+// Wishlist is a named list of products of a user. Public wishlists
+// can be seen by anyone who knows their Slug, and their items can
+// be bought as gifts for the owner.
+type Wishlist struct {
+	ID        string         `json:"id"`
+	Email     string         `json:"email"`
+	Name      string         `json:"name"`
+	Public    bool           `json:"public"`
+	Slug      string         `json:"slug,omitempty"`
+	Items     []WishlistItem `json:"items"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// WishlistItem is a product on a wishlist. Name and Price are a
+// snapshot taken when the item was added. Purchased is set once
+// someone buys the item as a gift.
+type WishlistItem struct {
+	ID        string `json:"id"`
+	SKU       string `json:"sku"`
+	Name      string `json:"name"`
+	Price     int    `json:"price"`
+	Purchased bool   `json:"purchased"`
+}
+
+// Item returns the item of the wishlist for the product and SKU,
+// or ErrNotInWishlist.
+func (wl *Wishlist) Item(productID, sku string) (*WishlistItem, error) {
+	i := wl.itemIndex(productID, sku)
+	if i < 0 {
+		return nil, ErrNotInWishlist
+	}
+	return &wl.Items[i], nil
+}
+
+// itemIndex returns the index of the item for the product and SKU,
+// or -1 if it isn't on the wishlist
+func (wl *Wishlist) itemIndex(productID, sku string) int {
+	for i, item := range wl.Items {
+		if item.ID == productID && item.SKU == normalizeSKU(sku) {
+			return i
+		}
+	}
+	return -1
+}
+
+// WishlistDB is used to interact with the wishlists database.
+//
+// Private wishlists are never returned by BySlug, ErrNotFound
+// is returned instead.
+type WishlistDB interface {
+	// Methods for querying for single wishlists
+	ByID(email, id string) (*Wishlist, error)
+	BySlug(slug string) (*Wishlist, error)
+	// Methods for querying several wishlists
+	ByEmail(email string) ([]Wishlist, error)
+	// Methods for altering wishlists. Update only changes the name,
+	// visibility and slug, the items are changed one at a time so
+	// concurrent changes to other items aren't overwritten. They
+	// return ErrNotFound if the wishlist was deleted.
+	Create(wishlist *Wishlist) error
+	Update(wishlist *Wishlist) error
+	Delete(email, id string) error
+	// AppendItem adds the item at the end of the wishlist
+	AppendItem(wishlist *Wishlist, item WishlistItem) error
+	// RemoveItemAt removes the item at the index, as long as it is
+	// still there. Otherwise ErrNotInWishlist is returned.
+	RemoveItemAt(wishlist *Wishlist, index int) error
+	// SetItemPurchased sets the Purchased flag of the item at the
+	// index, as long as it had the opposite value. Otherwise
+	// ErrWishlistItemPurchased is returned.
+	SetItemPurchased(wishlist *Wishlist, index int, purchased bool) error
+	// ChangeEmail moves the wishlists of a user to a new email
+	ChangeEmail(oldEmail, newEmail string) error
+}
+
+// WishlistService is a set of methods used to manipulate and
+// work with the wishlist model
+type WishlistService interface {
+	AddItem(wishlist *Wishlist, item WishlistItem) error
+	RemoveItem(wishlist *Wishlist, productID, sku string) error
+	// MarkPurchased flags the item as bought as a gift. Only one
+	// buyer can mark an item, ErrWishlistItemPurchased is returned
+	// to the others.
+	MarkPurchased(wishlist *Wishlist, productID, sku string) error
+	// UnmarkPurchased clears the flag of an item whose gift
+	// purchase failed
+	UnmarkPurchased(wishlist *Wishlist, productID, sku string) error
+	WishlistDB
+}
+
+func NewWishlistService() WishlistService {
+	wdb := newWishlistDB()
+	wv := newWishlistValidator(wdb)
+	return &wishlistService{
+		WishlistDB: wv,
+	}
+}
+
+var _ WishlistService = &wishlistService{}
+
+type wishlistService struct {
+	WishlistDB
+}
+
+func (ws *wishlistService) AddItem(wishlist *Wishlist, item WishlistItem) error {
+	item.SKU = normalizeSKU(item.SKU)
+	if _, err := wishlist.Item(item.ID, item.SKU); err == nil {
+		return ErrIsInWishlist
+	}
+	return ws.WishlistDB.AppendItem(wishlist, item)
+}
+
+func (ws *wishlistService) RemoveItem(wishlist *Wishlist, productID, sku string) error {
+	i := wishlist.itemIndex(productID, sku)
+	if i < 0 {
+		return ErrNotInWishlist
+	}
+	return ws.WishlistDB.RemoveItemAt(wishlist, i)
+}
+
+func (ws *wishlistService) MarkPurchased(wishlist *Wishlist, productID, sku string) error {
+	return ws.setPurchased(wishlist, productID, sku, true)
+}
+
+func (ws *wishlistService) UnmarkPurchased(wishlist *Wishlist, productID, sku string) error {
+	return ws.setPurchased(wishlist, productID, sku, false)
+}
+
+func (ws *wishlistService) setPurchased(wishlist *Wishlist, productID, sku string, purchased bool) error {
+	i := wishlist.itemIndex(productID, sku)
+	if i < 0 {
+		return ErrNotInWishlist
+	}
+	if wishlist.Items[i].Purchased == purchased {
+		return ErrWishlistItemPurchased
+	}
+	if err := ws.WishlistDB.SetItemPurchased(wishlist, i, purchased); err != nil {
+		return err
+	}
+	wishlist.Items[i].Purchased = purchased
+	return nil
+}
+
+type wishlistValFunc func(*Wishlist) error
+
+func runWishlistValFuncs(wishlist *Wishlist, fns ...wishlistValFunc) error {
+	for _, fn := range fns {
+		if err := fn(wishlist); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ WishlistDB = &wishlistValidator{}
+
+func newWishlistValidator(wdb WishlistDB) *wishlistValidator {
+	return &wishlistValidator{
+		WishlistDB: wdb,
+	}
+}
+
+type wishlistValidator struct {
+	WishlistDB
+}
+
+// Create will validate the wishlist and fill its ID, slug and
+// creation time before calling Create on the WishlistDB field.
+func (wv *wishlistValidator) Create(wishlist *Wishlist) error {
+	err := runWishlistValFuncs(wishlist,
+		wv.normalizeName,
+		wv.requireName,
+		wv.setEmptyItems,
+		wv.setCreationTime,
+		wv.setID,
+		wv.setSlug,
+	)
+	if err != nil {
+		return err
+	}
+	return wv.WishlistDB.Create(wishlist)
+}
+
+// Update will validate the wishlist and create its slug the first
+// time it is made public before calling Update on the WishlistDB field.
+func (wv *wishlistValidator) Update(wishlist *Wishlist) error {
+	err := runWishlistValFuncs(wishlist,
+		wv.normalizeName,
+		wv.requireName,
+		wv.setSlug,
+	)
+	if err != nil {
+		return err
+	}
+	return wv.WishlistDB.Update(wishlist)
+}
+
+func (wv *wishlistValidator) normalizeName(wishlist *Wishlist) error {
+	wishlist.Name = strings.TrimSpace(wishlist.Name)
+	return nil
+}
+
+func (wv *wishlistValidator) requireName(wishlist *Wishlist) error {
+	if wishlist.Name == "" {
+		return ErrWishlistNameRequired
+	}
+	return nil
+}
+
+func (wv *wishlistValidator) setEmptyItems(wishlist *Wishlist) error {
+	wishlist.Items = []WishlistItem{}
+	return nil
+}
+
+func (wv *wishlistValidator) setCreationTime(wishlist *Wishlist) error {
+	wishlist.CreatedAt = time.Now()
+	return nil
+}
+
+func (wv *wishlistValidator) setID(wishlist *Wishlist) error {
+	id, err := newRandomID()
+	if err != nil {
+		return err
+	}
+	wishlist.ID = id
+	return nil
+}
+
+// setSlug creates the share slug the first time the wishlist is
+// public. The slug is kept if the wishlist is made private, so old
+// links work again if it is made public once more.
+func (wv *wishlistValidator) setSlug(wishlist *Wishlist) error {
+	if !wishlist.Public || wishlist.Slug != "" {
+		return nil
+	}
+	slug, err := newRandomToken(wishlistSlugBytes)
+	if err != nil {
+		return err
+	}
+	wishlist.Slug = slug
+	return nil
+}
+
+var _ WishlistDB = &wishlistDB{}
+
+func newWishlistDB() *wishlistDB {
+	db := &db.DB{}
+	return &wishlistDB{
+		db: db,
+	}
+}
+
+type wishlistDB struct {
+	db *db.DB
+}
+
+// ByID will look up the wishlist of the user with the provided ID
+func (wdb *wishlistDB) ByID(email, id string) (*Wishlist, error) {
+	wl := new(Wishlist)
+	key := wishlistTableQueryKey{
+		Email: email,
+		ID:    id,
+	}
+	found, err := wdb.db.GetItem(key, dbWishlistsTableName, wl)
+	if err != nil {
+		return nil, err
+	} else if found == false {
+		return nil, ErrNotFound
+	} else {
+		return wl, nil
+	}
+}
+
+// BySlug will look up a public wishlist by its share slug
+func (wdb *wishlistDB) BySlug(slug string) (*Wishlist, error) {
+	wishlists := []Wishlist{}
+	key := struct {
+		Slug string `json:":s"`
+	}{
+		Slug: slug,
+	}
+	err := wdb.db.QueryIndex(dbWishlistsTableName, dbWishlistsSlugIndexName, key, "slug = :s", &wishlists)
+	if err != nil {
+		return nil, err
+	}
+	for _, wl := range wishlists {
+		if wl.Public {
+			return &wl, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// ByEmail will look up the wishlists of the user
+func (wdb *wishlistDB) ByEmail(email string) ([]Wishlist, error) {
+	wishlists := []Wishlist{}
+	key := struct {
+		Email string `json:":e"`
+	}{
+		Email: email,
+	}
+	err := wdb.db.GetItems(dbWishlistsTableName, key, "email = :e", "", nil, &wishlists)
+	if err != nil {
+		return nil, err
+	}
+	return wishlists, nil
+}
+
+// Create will create the provided wishlist in the database
+func (wdb *wishlistDB) Create(wishlist *Wishlist) error {
+	return wdb.db.PutItem(dbWishlistsTableName, wishlist)
+}
+
+// Update will set the name, visibility and slug of the stored
+// wishlist, leaving its items as they are, and then read it back
+func (wdb *wishlistDB) Update(wishlist *Wishlist) error {
+	update := struct {
+		Name   string `json:":n"`
+		Public bool   `json:":p"`
+		Slug   string `json:":s,omitempty"`
+	}{
+		Name:   wishlist.Name,
+		Public: wishlist.Public,
+		Slug:   wishlist.Slug,
+	}
+	updateExp := "set #n = :n, #p = :p"
+	// The slug is a key of the index, it can't be set empty
+	if wishlist.Slug != "" {
+		updateExp += ", slug = :s"
+	}
+	// name and public are reserved words
+	expAttNames := map[string]*string{
+		"#n": aws.String("name"),
+		"#p": aws.String("public"),
+	}
+	return wdb.conditionalUpdate(wishlist, update, updateExp, "attribute_exists(id)", expAttNames, ErrNotFound)
+}
+
+// AppendItem will add the item at the end of the stored wishlist and
+// then read it back
+func (wdb *wishlistDB) AppendItem(wishlist *Wishlist, item WishlistItem) error {
+	update := struct {
+		Items []WishlistItem `json:":i"`
+	}{
+		Items: []WishlistItem{item},
+	}
+	// items is a reserved word
+	expAttNames := map[string]*string{
+		"#i": aws.String("items"),
+	}
+	return wdb.conditionalUpdate(wishlist, update, "set #i = list_append(#i, :i)", "attribute_exists(id)", expAttNames, ErrNotFound)
+}
+
+// RemoveItemAt will remove the item at the index of the stored
+// wishlist, as long as the item is still the one at the index, and
+// then read it back
+func (wdb *wishlistDB) RemoveItemAt(wishlist *Wishlist, index int) error {
+	update := struct {
+		ProductID string `json:":id"`
+		SKU       string `json:":sku"`
+	}{
+		ProductID: wishlist.Items[index].ID,
+		SKU:       wishlist.Items[index].SKU,
+	}
+	item := fmt.Sprintf("#i[%d]", index)
+	updateExp := fmt.Sprintf("remove %v", item)
+	condExp := fmt.Sprintf("%v.id = :id AND %v.sku = :sku", item, item)
+	// items is a reserved word
+	expAttNames := map[string]*string{
+		"#i": aws.String("items"),
+	}
+	return wdb.conditionalUpdate(wishlist, update, updateExp, condExp, expAttNames, ErrNotInWishlist)
+}
+
+// conditionalUpdate runs a conditional update of the wishlist and
+// fills it with the stored one. condErr is returned if the condition
+// fails.
+func (wdb *wishlistDB) conditionalUpdate(wishlist *Wishlist, update interface{}, updateExp, condExp string, expAttNames map[string]*string, condErr error) error {
+	key := wishlistTableQueryKey{
+		Email: wishlist.Email,
+		ID:    wishlist.ID,
+	}
+	updated := new(Wishlist)
+	err := wdb.db.UpdateItemReturning(dbWishlistsTableName, key, update, updateExp, condExp, expAttNames, updated)
+	if err == db.ErrConditionFailed {
+		return condErr
+	}
+	if err != nil {
+		return err
+	}
+	*wishlist = *updated
+	return nil
+}
+
+// SetItemPurchased will set the Purchased flag of the item at the
+// index. The update is conditional so two buyers can't both mark the
+// same item, and the item must still be the one at the index.
+func (wdb *wishlistDB) SetItemPurchased(wishlist *Wishlist, index int, purchased bool) error {
+	key := wishlistTableQueryKey{
+		Email: wishlist.Email,
+		ID:    wishlist.ID,
+	}
+	update := struct {
+		ProductID string `json:":id"`
+		Purchased bool   `json:":p"`
+		Old       bool   `json:":o"`
+	}{
+		ProductID: wishlist.Items[index].ID,
+		Purchased: purchased,
+		Old:       !purchased,
+	}
+	item := fmt.Sprintf("#i[%d]", index)
+	updateExp := fmt.Sprintf("set %v.purchased = :p", item)
+	condExp := fmt.Sprintf("%v.id = :id AND %v.purchased = :o", item, item)
+	// items is a reserved word
+	expAttNames := map[string]*string{
+		"#i": aws.String("items"),
+	}
+	err := wdb.db.UpdateItemReturning(dbWishlistsTableName, key, update, updateExp, condExp, expAttNames, &Wishlist{})
+	if err == db.ErrConditionFailed {
+		return ErrWishlistItemPurchased
+	}
+	return err
+}
+
+// Delete will delete the wishlist of the user with the provided ID
+func (wdb *wishlistDB) Delete(email, id string) error {
+	key := wishlistTableQueryKey{
+		Email: email,
+		ID:    id,
+	}
+	return wdb.db.DeleteItem(dbWishlistsTableName, key)
+}
+
+// ChangeEmail will copy every wishlist of the old email to the new
+// one and then delete the original
+func (wdb *wishlistDB) ChangeEmail(oldEmail, newEmail string) error {
+	wishlists, err := wdb.ByEmail(oldEmail)
+	if err != nil {
+		return err
+	}
+	for _, wl := range wishlists {
+		wl.Email = newEmail
+		if err := wdb.db.PutItem(dbWishlistsTableName, &wl); err != nil {
+			return err
+		}
+		if err := wdb.Delete(oldEmail, wl.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type wishlistTableQueryKey struct {
+	Email string `json:"email"`
+	ID    string `json:"id"`
+}
@@ -0,0 +1,167 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a notification for a user
+type Message struct {
+	// Email of the user notified
+	To      string            `json:"to"`
+	Kind    string            `json:"kind"`
+	Subject string            `json:"subject"`
+	Body    string            `json:"body"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+// Notifier delivers messages to the users
+type Notifier interface {
+	Notify(msg Message) error
+}
+
+// NewSMTPNotifier creates a notifier that emails the messages
+// through the SMTP server at addr ("host:port"). Authentication is
+// skipped when username is empty.
+func NewSMTPNotifier(addr, from, username, password string) *SMTPNotifier {
+	sn := &SMTPNotifier{
+		addr: addr,
+		from: from,
+	}
+	if username != "" {
+		host := strings.Split(addr, ":")[0]
+		sn.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return sn
+}
+
+var _ Notifier = &SMTPNotifier{}
+
+// SMTPNotifier sends the messages by email
+type SMTPNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (sn *SMTPNotifier) Notify(msg Message) error {
+	body := fmt.Sprintf("From: %v\r\nTo: %v\r\nSubject: %v\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%v\r\n",
+		sn.from, headerValue(msg.To), headerValue(msg.Subject), msg.Body)
+	return smtp.SendMail(sn.addr, sn.auth, sn.from, []string{msg.To}, []byte(body))
+}
+
+// headerValue removes the line breaks of a header value, which could
+// add headers of their own. The subjects have product names in them.
+func headerValue(v string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(v)
+}
+
+// NewWebhookNotifier creates a notifier that posts the messages
+// as JSON to the URL
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+var _ Notifier = &WebhookNotifier{}
+
+// WebhookNotifier posts the messages to an HTTP endpoint
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (wn *WebhookNotifier) Notify(msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	resp, err := wn.client.Post(wn.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notify: webhook responded %v", resp.Status)
+	}
+	return nil
+}
+
+var _ Notifier = &LogNotifier{}
+
+// LogNotifier writes the messages to the log. It is meant
+// for development.
+type LogNotifier struct{}
+
+func (ln *LogNotifier) Notify(msg Message) error {
+	log.Printf("Notification to %v [%v]: %v\n%v\n", msg.To, msg.Kind, msg.Subject, msg.Body)
+	return nil
+}
+
+var _ Notifier = &MemoryNotifier{}
+
+// MemoryNotifier keeps the messages in memory so tests can
+// check what was sent
+type MemoryNotifier struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (mn *MemoryNotifier) Notify(msg Message) error {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	mn.messages = append(mn.messages, msg)
+	return nil
+}
+
+// Messages returns the messages sent so far
+func (mn *MemoryNotifier) Messages() []Message {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	return append([]Message{}, mn.messages...)
+}
+
+// NewFileNotifier creates a notifier that appends the messages to
+// the file at path, one JSON object per line
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{
+		path: path,
+	}
+}
+
+var _ Notifier = &FileNotifier{}
+
+// FileNotifier writes the messages to a file. It is meant for
+// development, so emails like the password reset can be read.
+type FileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (fn *FileNotifier) Notify(msg Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	f, err := os.OpenFile(fn.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,342 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+var (
+	// ErrIDTokenInvalid is returned when the ID token of the provider
+	// can't be verified or is for another client or login.
+	ErrIDTokenInvalid = errors.New("oidc: ID token is invalid")
+)
+
+// Clock skew tolerated when checking the times of the ID tokens
+const clockSkew = time.Minute
+
+// The keys of the provider are fetched again at most once per
+// interval when a token has an unknown kid
+const keysRefreshInterval = time.Minute
+
+// Config of an OpenID Connect provider. The provider must support
+// the authorization code flow with PKCE.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback of the API the provider sends the
+	// user back to
+	RedirectURL string
+	// Scopes asked for, openid, email and profile by default
+	Scopes []string
+}
+
+// Provider is an OpenID Connect provider. The endpoints and keys of
+// the provider are discovered from the issuer on first use.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *discovery
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+// New creates a provider with the config
+func New(c Config) *Provider {
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &Provider{
+		config: c,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// Claims are the claims of an ID token used by the API
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// Valid is checked by Exchange, which knows the client and nonce
+func (c *Claims) Valid() error {
+	return nil
+}
+
+// audience is the aud claim, which may be a string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+type discovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// AuthCodeURL returns the address of the provider the user is sent
+// to. The challenge of the PKCE verifier is sent, the verifier itself
+// is sent by Exchange.
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.config.ClientID)
+	v.Set("redirect_uri", p.config.RedirectURL)
+	v.Set("scope", strings.Join(p.config.Scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange trades the authorization code for the ID token of the
+// user and returns its claims, once the signature, issuer, audience,
+// times and nonce are checked.
+func (p *Provider) Exchange(code, verifier, nonce string) (*Claims, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", verifier)
+	basic := p.config.ClientSecret != "" && supportsBasicAuth(d.TokenAuthMethods)
+	if !basic {
+		form.Set("client_id", p.config.ClientID)
+		if p.config.ClientSecret != "" {
+			form.Set("client_secret", p.config.ClientSecret)
+		}
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tr struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("oidc: reading the token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		return nil, fmt.Errorf("oidc: token endpoint responded %v: %v", resp.Status, strings.TrimSpace(tr.Error+" "+tr.ErrorDescription))
+	}
+	return p.verify(tr.IDToken, nonce)
+}
+
+// verify checks the ID token
+func (p *Provider) verify(idToken, nonce string) (*Claims, error) {
+	claims := &Claims{}
+	parser := &jwt.Parser{
+		ValidMethods: []string{"RS256", "ES256"},
+	}
+	_, err := parser.ParseWithClaims(idToken, claims, p.keyFor)
+	if err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+	now := time.Now()
+	if claims.Issuer != p.config.Issuer || !claims.Audience.contains(p.config.ClientID) {
+		return nil, ErrIDTokenInvalid
+	}
+	if claims.ExpiresAt == 0 || now.Add(-clockSkew).Unix() > claims.ExpiresAt {
+		return nil, ErrIDTokenInvalid
+	}
+	if now.Add(clockSkew).Unix() < claims.IssuedAt {
+		return nil, ErrIDTokenInvalid
+	}
+	if claims.Subject == "" || claims.Nonce != nonce {
+		return nil, ErrIDTokenInvalid
+	}
+	return claims, nil
+}
+
+// keyFor returns the public key of the kid of the token, fetching
+// the keys again if it is unknown as the provider may have rotated
+// them
+func (p *Provider) keyFor(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keys[kid]
+	if !ok && time.Since(p.keysFetched) > keysRefreshInterval {
+		if err := p.fetchKeys(); err != nil {
+			return nil, err
+		}
+		key, ok = p.keys[kid]
+	}
+	if !ok {
+		return nil, ErrIDTokenInvalid
+	}
+	return key, nil
+}
+
+// discover fetches the configuration of the provider, once
+func (p *Provider) discover() (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	d := new(discovery)
+	wellKnown := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(wellKnown, d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("oidc: issuer %v doesn't match the configured %v", d.Issuer, p.config.Issuer)
+	}
+	p.discovery = d
+	return d, nil
+}
+
+// fetchKeys reads the JWKS of the provider. p.mu must be held.
+func (p *Provider) fetchKeys() error {
+	if p.discovery == nil {
+		return errors.New("oidc: provider not discovered")
+	}
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			ID      string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(p.discovery.JWKSURI, &jwks); err != nil {
+		return err
+	}
+	keys := map[string]interface{}{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.KeyType == "RSA":
+			n, errN := decodeInt(k.N)
+			e, errE := decodeInt(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.ID] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case k.KeyType == "EC" && k.Curve == "P-256":
+			x, errX := decodeInt(k.X)
+			y, errY := decodeInt(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.ID] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		}
+	}
+	p.keys = keys
+	p.keysFetched = time.Now()
+	return nil
+}
+
+func (p *Provider) getJSON(url string, dst interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %v responded %v", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// supportsBasicAuth tells if the client secret goes in the
+// Authorization header, which is the default of the spec
+func supportsBasicAuth(methods []string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if m == "client_secret_basic" {
+			return true
+		}
+	}
+	return false
+}
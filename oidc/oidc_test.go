@@ -0,0 +1,329 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	testClientID     = "client"
+	testClientSecret = "secret"
+	testCode         = "code"
+	testNonce        = "nonce"
+	testVerifier     = "verifier-with-enough-characters-to-be-valid-pkce"
+)
+
+// mockProvider is a local OpenID Connect provider. It issues an ID
+// token for testCode once the PKCE verifier matches the challenge of
+// the last authorization, signed with the key of signKid.
+type mockProvider struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	signKid string
+	// forgeKey signs the tokens instead of the key of signKid
+	forgeKey  *rsa.PrivateKey
+	challenge string
+	// claims of the next ID token, they may be changed by the tests
+	claims     jwt.MapClaims
+	jwksHits   int
+	tokenForms []url.Values
+	basicAuth  [2]string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	mp := &mockProvider{
+		t:    t,
+		keys: map[string]*rsa.PrivateKey{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", mp.discovery)
+	mux.HandleFunc("/jwks", mp.jwks)
+	mux.HandleFunc("/token", mp.token)
+	mp.server = httptest.NewServer(mux)
+	t.Cleanup(mp.server.Close)
+	mp.addKey("k1")
+	mp.signKid = "k1"
+	now := time.Now()
+	mp.claims = jwt.MapClaims{
+		"iss":            mp.server.URL,
+		"sub":            "subject",
+		"aud":            testClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          testNonce,
+		"email":          "user@example.com",
+		"email_verified": true,
+		"name":           "User",
+	}
+	return mp
+}
+
+func (mp *mockProvider) provider() *Provider {
+	return New(Config{
+		Issuer:       mp.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  "http://api.example.com/auth/mock/callback",
+	})
+}
+
+func (mp *mockProvider) addKey(kid string) {
+	mp.t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		mp.t.Fatal(err)
+	}
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.keys[kid] = key
+}
+
+func (mp *mockProvider) jwksFetches() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.jwksHits
+}
+
+func (mp *mockProvider) setClaim(name string, value interface{}) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if value == nil {
+		delete(mp.claims, name)
+		return
+	}
+	mp.claims[name] = value
+}
+
+// authorize starts a login like the browser would, keeping the PKCE
+// challenge of the address
+func (mp *mockProvider) authorize(p *Provider, verifier string) {
+	mp.t.Helper()
+	authURL, err := p.AuthCodeURL("state", testNonce, verifier)
+	if err != nil {
+		mp.t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		mp.t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("nonce") != testNonce || q.Get("client_id") != testClientID {
+		mp.t.Fatalf("AuthCodeURL returned %v", authURL)
+	}
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.challenge = q.Get("code_challenge")
+}
+
+func (mp *mockProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                 mp.server.URL,
+		"authorization_endpoint": mp.server.URL + "/authorize",
+		"token_endpoint":         mp.server.URL + "/token",
+		"jwks_uri":               mp.server.URL + "/jwks",
+	})
+}
+
+func (mp *mockProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.jwksHits++
+	keys := []map[string]string{}
+	for kid, key := range mp.keys {
+		keys = append(keys, map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (mp *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	r.ParseForm()
+	mp.tokenForms = append(mp.tokenForms, r.PostForm)
+	user, pass, _ := r.BasicAuth()
+	mp.basicAuth = [2]string{user, pass}
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if r.PostForm.Get("code") != testCode || base64.RawURLEncoding.EncodeToString(verifier[:]) != mp.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, mp.claims)
+	token.Header["kid"] = mp.signKid
+	key := mp.keys[mp.signKid]
+	if mp.forgeKey != nil {
+		key = mp.forgeKey
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		mp.t.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": signed})
+}
+
+func TestExchange(t *testing.T) {
+	mp := newMockProvider(t)
+	p := mp.provider()
+	mp.authorize(p, testVerifier)
+	claims, err := p.Exchange(testCode, testVerifier, testNonce)
+	if err != nil {
+		t.Fatalf("Exchange returned %v", err)
+	}
+	if claims.Subject != "subject" || claims.Email != "user@example.com" || !claims.EmailVerified || claims.Name != "User" {
+		t.Errorf("Exchange returned the claims %+v", claims)
+	}
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	form := mp.tokenForms[0]
+	if form.Get("code_verifier") != testVerifier || form.Get("grant_type") != "authorization_code" {
+		t.Errorf("the token request was %v", form)
+	}
+	// Without token_endpoint_auth_methods_supported the secret goes
+	// in the Authorization header
+	if mp.basicAuth != [2]string{testClientID, testClientSecret} || form.Get("client_secret") != "" {
+		t.Errorf("the client authenticated with %v and the form %v", mp.basicAuth, form)
+	}
+}
+
+func TestExchangeWrongVerifier(t *testing.T) {
+	mp := newMockProvider(t)
+	p := mp.provider()
+	mp.authorize(p, testVerifier)
+	if _, err := p.Exchange(testCode, "another-verifier", testNonce); err == nil {
+		t.Error("Exchange accepted a verifier that doesn't match the challenge")
+	}
+}
+
+func TestExchangeRejectsClaims(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		claim string
+		value interface{}
+	}{
+		{"another nonce", "nonce", "another-nonce"},
+		{"no nonce", "nonce", nil},
+		{"another audience", "aud", "another-client"},
+		{"audience list without the client", "aud", []string{"another-client", "third-client"}},
+		{"another issuer", "iss", "https://evil.example.com"},
+		{"expired", "exp", now.Add(-clockSkew - time.Minute).Unix()},
+		{"no expiry", "exp", nil},
+		{"issued in the future", "iat", now.Add(clockSkew + time.Minute).Unix()},
+		{"no subject", "sub", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mp := newMockProvider(t)
+			mp.setClaim(tt.claim, tt.value)
+			p := mp.provider()
+			mp.authorize(p, testVerifier)
+			_, err := p.Exchange(testCode, testVerifier, testNonce)
+			if err != ErrIDTokenInvalid {
+				t.Errorf("Exchange returned %v, want ErrIDTokenInvalid", err)
+			}
+		})
+	}
+}
+
+func TestExchangeAcceptsAudienceList(t *testing.T) {
+	mp := newMockProvider(t)
+	mp.setClaim("aud", []string{"another-client", testClientID})
+	p := mp.provider()
+	mp.authorize(p, testVerifier)
+	if _, err := p.Exchange(testCode, testVerifier, testNonce); err != nil {
+		t.Errorf("Exchange returned %v", err)
+	}
+}
+
+func TestExchangeRejectsForgedSignature(t *testing.T) {
+	mp := newMockProvider(t)
+	forged, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.forgeKey = forged
+	p := mp.provider()
+	mp.authorize(p, testVerifier)
+	if _, err := p.Exchange(testCode, testVerifier, testNonce); err != ErrIDTokenInvalid {
+		t.Errorf("Exchange returned %v, want ErrIDTokenInvalid", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	mp := newMockProvider(t)
+	p := mp.provider()
+	mp.authorize(p, testVerifier)
+	if _, err := p.Exchange(testCode, testVerifier, testNonce); err != nil {
+		t.Fatalf("Exchange returned %v", err)
+	}
+	if mp.jwksFetches() != 1 {
+		t.Fatalf("the keys were fetched %d times, want 1", mp.jwksFetches())
+	}
+
+	// The provider starts signing with a new key. It isn't fetched
+	// until the refresh interval passes, so a flood of unknown kids
+	// doesn't hammer the provider.
+	mp.addKey("k2")
+	mp.mu.Lock()
+	mp.signKid = "k2"
+	mp.mu.Unlock()
+	if _, err := p.Exchange(testCode, testVerifier, testNonce); err != ErrIDTokenInvalid {
+		t.Fatalf("Exchange returned %v, want ErrIDTokenInvalid", err)
+	}
+	if mp.jwksFetches() != 1 {
+		t.Fatalf("the keys were fetched %d times, want 1", mp.jwksFetches())
+	}
+
+	p.mu.Lock()
+	p.keysFetched = time.Now().Add(-keysRefreshInterval - time.Second)
+	p.mu.Unlock()
+	if _, err := p.Exchange(testCode, testVerifier, testNonce); err != nil {
+		t.Fatalf("Exchange returned %v after the refresh interval", err)
+	}
+	if mp.jwksFetches() != 2 {
+		t.Errorf("the keys were fetched %d times, want 2", mp.jwksFetches())
+	}
+
+	// Tokens of the old key still work while it is published
+	mp.mu.Lock()
+	mp.signKid = "k1"
+	mp.mu.Unlock()
+	if _, err := p.Exchange(testCode, testVerifier, testNonce); err != nil {
+		t.Errorf("Exchange returned %v for the old key", err)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	mp := newMockProvider(t)
+	p := New(Config{
+		Issuer:   mp.server.URL + "/",
+		ClientID: testClientID,
+	})
+	if _, err := p.AuthCodeURL("state", testNonce, testVerifier); err == nil {
+		t.Error("AuthCodeURL accepted a provider with another issuer")
+	}
+}
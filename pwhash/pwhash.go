@@ -0,0 +1,248 @@
+package pwhash
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrMismatch is returned when the password doesn't match the
+	// hash.
+	ErrMismatch = errors.New("pwhash: password doesn't match the hash")
+
+	// ErrHashInvalid is returned when a stored hash can't be read,
+	// or uses a pepper that isn't configured.
+	ErrHashInvalid = errors.New("pwhash: hash is invalid")
+)
+
+// Algorithms of the hashes
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+// Length in bytes of the argon2id salts and keys
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// Argon2Params are the cost parameters of argon2id
+type Argon2Params struct {
+	Time uint32
+	// Memory in KiB
+	Memory  uint32
+	Threads uint8
+}
+
+// Config of the hasher. The algorithm and parameters apply to the new
+// hashes, the hashes made with others can still be compared.
+type Config struct {
+	// Algorithm is Bcrypt or Argon2id
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+	// Peppers by version. The highest version is used for the new
+	// hashes, the others are kept to compare the old ones. The
+	// peppers are applied with HMAC-SHA256 and the version is stored
+	// in the hash. The legacy hashes, without a version, have the
+	// pepper of version 0 appended to the password.
+	Peppers map[int]string
+}
+
+// Hasher hashes and compares passwords
+type Hasher struct {
+	config        Config
+	pepperVersion int
+}
+
+// New creates a hasher with the config
+func New(c Config) (*Hasher, error) {
+	switch c.Algorithm {
+	case Bcrypt:
+		if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("pwhash: bcrypt cost must be between %v and %v", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case Argon2id:
+		if c.Argon2.Time == 0 || c.Argon2.Memory == 0 || c.Argon2.Threads == 0 {
+			return nil, errors.New("pwhash: argon2id time, memory and threads must be positive")
+		}
+	default:
+		return nil, fmt.Errorf("pwhash: unknown algorithm %q", c.Algorithm)
+	}
+	if len(c.Peppers) == 0 {
+		return nil, errors.New("pwhash: at least one pepper is required")
+	}
+	version := -1
+	for v := range c.Peppers {
+		if v < 0 {
+			return nil, fmt.Errorf("pwhash: pepper version %v is negative", v)
+		}
+		if v > version {
+			version = v
+		}
+	}
+	return &Hasher{
+		config:        c,
+		pepperVersion: version,
+	}, nil
+}
+
+// ParsePeppers reads a comma separated list of version:pepper pairs
+func ParsePeppers(s string) (map[int]string, error) {
+	peppers := map[int]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("pwhash: pepper %q must be version:pepper", pair)
+		}
+		v, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("pwhash: pepper version %q is not a number", parts[0])
+		}
+		peppers[v] = parts[1]
+	}
+	return peppers, nil
+}
+
+// Hash returns the hash of the password with the configured algorithm
+// and the newest pepper
+func (h *Hasher) Hash(password string) (string, error) {
+	peppered := pepper(h.config.Peppers[h.pepperVersion], false, password)
+	var hash string
+	switch h.config.Algorithm {
+	case Argon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		p := h.config.Argon2
+		key := argon2.IDKey(peppered, salt, p.Time, p.Memory, p.Threads, argon2KeyLen)
+		hash = fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	default:
+		b, err := bcrypt.GenerateFromPassword(peppered, h.config.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		hash = string(b)
+	}
+	return fmt.Sprintf("$pv=%d%s", h.pepperVersion, hash), nil
+}
+
+// Compare checks the password against the hash. ErrMismatch is
+// returned if it doesn't match.
+func (h *Hasher) Compare(hash, password string) error {
+	version, legacy, inner, err := splitPepper(hash)
+	if err != nil {
+		return err
+	}
+	secret, ok := h.config.Peppers[version]
+	if !ok {
+		return ErrHashInvalid
+	}
+	peppered := pepper(secret, legacy, password)
+	if strings.HasPrefix(inner, "$argon2id$") {
+		p, salt, key, err := parseArgon2(inner)
+		if err != nil {
+			return err
+		}
+		other := argon2.IDKey(peppered, salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return ErrMismatch
+		}
+		return nil
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(inner), peppered)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrMismatch
+	}
+	return err
+}
+
+// NeedsRehash tells if the hash was made with another algorithm,
+// parameters or pepper than the configured ones, or is a legacy hash
+func (h *Hasher) NeedsRehash(hash string) bool {
+	version, legacy, inner, err := splitPepper(hash)
+	if err != nil || legacy || version != h.pepperVersion {
+		return true
+	}
+	switch h.config.Algorithm {
+	case Argon2id:
+		p, _, key, err := parseArgon2(inner)
+		return err != nil || p != h.config.Argon2 || len(key) != argon2KeyLen
+	default:
+		cost, err := bcrypt.Cost([]byte(inner))
+		return err != nil || cost != h.config.BcryptCost
+	}
+}
+
+// pepper mixes the pepper into the password. The legacy hashes
+// appended it, so bcrypt ignored it for long passwords.
+func pepper(secret string, legacy bool, password string) []byte {
+	if legacy {
+		return []byte(password + secret)
+	}
+	// The MAC is encoded so bcrypt, which stops at the first 72
+	// bytes and at zero bytes, sees all of it
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// splitPepper returns the pepper version of the hash, whether it is
+// a legacy hash without a version, and the hash of the algorithm
+func splitPepper(hash string) (int, bool, string, error) {
+	if !strings.HasPrefix(hash, "$pv=") {
+		return 0, true, hash, nil
+	}
+	rest := hash[len("$pv="):]
+	i := strings.Index(rest, "$")
+	if i < 0 {
+		return 0, false, "", ErrHashInvalid
+	}
+	version, err := strconv.Atoi(rest[:i])
+	if err != nil || version < 0 {
+		return 0, false, "", ErrHashInvalid
+	}
+	return version, false, rest[i:], nil
+}
+
+// parseArgon2 reads an argon2id hash in the PHC string format
+func parseArgon2(hash string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != Argon2id {
+		return p, nil, nil, ErrHashInvalid
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrHashInvalid
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, ErrHashInvalid
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrHashInvalid
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrHashInvalid
+	}
+	return p, salt, key, nil
+}
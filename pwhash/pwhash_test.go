@@ -0,0 +1,177 @@
+package pwhash
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testArgon2 = Argon2Params{
+	Time:    1,
+	Memory:  64,
+	Threads: 1,
+}
+
+func newTestHasher(t *testing.T, algorithm string, peppers map[int]string) *Hasher {
+	t.Helper()
+	h, err := New(Config{
+		Algorithm:  algorithm,
+		BcryptCost: bcrypt.MinCost,
+		Argon2:     testArgon2,
+		Peppers:    peppers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{Bcrypt, Argon2id} {
+		for _, version := range []int{0, 1} {
+			h := newTestHasher(t, algorithm, map[int]string{version: "pepper"})
+			hash, err := h.Hash("correct horse")
+			if err != nil {
+				t.Fatalf("%v v%v: Hash returned %v", algorithm, version, err)
+			}
+			if err := h.Compare(hash, "correct horse"); err != nil {
+				t.Errorf("%v v%v: Compare of the right password returned %v", algorithm, version, err)
+			}
+			if err := h.Compare(hash, "correct horsf"); err != ErrMismatch {
+				t.Errorf("%v v%v: Compare of a wrong password returned %v, want ErrMismatch", algorithm, version, err)
+			}
+			if h.NeedsRehash(hash) {
+				t.Errorf("%v v%v: a new hash needs a rehash", algorithm, version)
+			}
+		}
+	}
+}
+
+func TestLongPasswords(t *testing.T) {
+	// bcrypt only reads 72 bytes, the pepper must not be lost
+	h := newTestHasher(t, Bcrypt, map[int]string{0: "pepper"})
+	long := strings.Repeat("a", 100)
+	hash, err := h.Hash(long + "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Compare(hash, long+"2"); err != ErrMismatch {
+		t.Errorf("Compare of a password that differs after 72 bytes returned %v, want ErrMismatch", err)
+	}
+}
+
+func TestLegacyHash(t *testing.T) {
+	h := newTestHasher(t, Bcrypt, map[int]string{0: "pepper"})
+	legacy, err := bcrypt.GenerateFromPassword([]byte("secret"+"pepper"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Compare(string(legacy), "secret"); err != nil {
+		t.Errorf("Compare of a legacy hash returned %v", err)
+	}
+	if err := h.Compare(string(legacy), "secreT"); err != ErrMismatch {
+		t.Errorf("Compare of a wrong password with a legacy hash returned %v, want ErrMismatch", err)
+	}
+	if !h.NeedsRehash(string(legacy)) {
+		t.Error("a legacy hash doesn't need a rehash")
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	old := newTestHasher(t, Bcrypt, map[int]string{1: "one"})
+	hash, err := old.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		config Config
+		want   bool
+	}{
+		{"same config", Config{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost, Peppers: map[int]string{1: "one"}}, false},
+		{"other cost", Config{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost + 1, Peppers: map[int]string{1: "one"}}, true},
+		{"other algorithm", Config{Algorithm: Argon2id, Argon2: testArgon2, Peppers: map[int]string{1: "one"}}, true},
+		{"new pepper", Config{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost, Peppers: map[int]string{1: "one", 2: "two"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := New(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := h.NeedsRehash(hash); got != tt.want {
+				t.Errorf("NeedsRehash = %v, want %v", got, tt.want)
+			}
+			// The old hash is still accepted
+			if err := h.Compare(hash, "secret"); err != nil {
+				t.Errorf("Compare returned %v", err)
+			}
+		})
+	}
+}
+
+func TestRemovedPepper(t *testing.T) {
+	old := newTestHasher(t, Bcrypt, map[int]string{1: "one"})
+	hash, err := old.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHasher(t, Bcrypt, map[int]string{2: "two"})
+	if err := h.Compare(hash, "secret"); err != ErrHashInvalid {
+		t.Errorf("Compare with a removed pepper returned %v, want ErrHashInvalid", err)
+	}
+}
+
+func TestInvalidHashes(t *testing.T) {
+	h := newTestHasher(t, Argon2id, map[int]string{0: "pepper"})
+	for _, hash := range []string{
+		"$pv=x$2a$04$abc",
+		"$pv=0",
+		"$pv=-1$argon2id$v=19$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$pv=0$argon2id$v=1$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$pv=0$argon2id$v=19$m=64,t=1,p=1$c2FsdA$",
+	} {
+		if err := h.Compare(hash, "secret"); err != ErrHashInvalid {
+			t.Errorf("Compare(%q) returned %v, want ErrHashInvalid", hash, err)
+		}
+		if !h.NeedsRehash(hash) {
+			t.Errorf("NeedsRehash(%q) = false, want true", hash)
+		}
+	}
+}
+
+func TestNewRejectsConfigs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"unknown algorithm", Config{Algorithm: "md5", Peppers: map[int]string{0: "p"}}},
+		{"low bcrypt cost", Config{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost - 1, Peppers: map[int]string{0: "p"}}},
+		{"zero argon2 params", Config{Algorithm: Argon2id, Peppers: map[int]string{0: "p"}}},
+		{"no peppers", Config{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost}},
+		{"negative pepper version", Config{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost, Peppers: map[int]string{-1: "p"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.config); err == nil {
+				t.Error("New returned no error")
+			}
+		})
+	}
+}
+
+func TestParsePeppers(t *testing.T) {
+	peppers, err := ParsePeppers(" 1:one, 2:t:w:o ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peppers) != 2 || peppers[1] != "one" || peppers[2] != "t:w:o" {
+		t.Errorf("ParsePeppers = %v", peppers)
+	}
+	for _, s := range []string{"one", "x:one", "1:"} {
+		if _, err := ParsePeppers(s); err == nil {
+			t.Errorf("ParsePeppers(%q) returned no error", s)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package pwpolicy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Length of the hash prefix the passwords are looked up by, the same
+// as the range API of Have I Been Pwned
+const rangePrefixLength = 5
+
+// Longest line of the list, a SHA-1 in hex, a colon and the count
+const maxLineLength = 64
+
+// BreachedList is a local copy of the Pwned Passwords list ordered by
+// hash: one SHA-1HASH:COUNT line per password, in uppercase hex.
+// Passwords are looked up like with the range API: the lines with the
+// first characters of the hash are read and only there is the rest of
+// the hash compared.
+type BreachedList struct {
+	file *os.File
+	size int64
+}
+
+// OpenBreachedList opens the list at the path
+func OpenBreachedList(path string) (*BreachedList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &BreachedList{
+		file: f,
+		size: info.Size(),
+	}, nil
+}
+
+// Close closes the file of the list
+func (b *BreachedList) Close() error {
+	return b.file.Close()
+}
+
+// Count returns how many times the password appears in the breaches,
+// 0 if it isn't in the list
+func (b *BreachedList) Count(password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:rangePrefixLength], hash[rangePrefixLength:]
+	start, err := b.rangeStart(prefix)
+	if err != nil {
+		return 0, err
+	}
+	scanner := bufio.NewScanner(io.NewSectionReader(b.file, start, b.size-start))
+	for scanner.Scan() {
+		line := strings.ToUpper(strings.TrimSpace(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, prefix) {
+			break
+		}
+		parts := strings.SplitN(line[rangePrefixLength:], ":", 2)
+		if parts[0] != suffix {
+			continue
+		}
+		if len(parts) < 2 {
+			return 1, nil
+		}
+		count, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, errors.New("pwpolicy: breached passwords list line has an invalid count")
+		}
+		return count, nil
+	}
+	return 0, scanner.Err()
+}
+
+// rangeStart finds the offset of the first line whose hash is not
+// before the prefix, with a binary search over the file
+func (b *BreachedList) rangeStart(prefix string) (int64, error) {
+	lo, hi := int64(0), b.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := b.lineAfter(mid)
+		if err != nil {
+			return 0, err
+		}
+		if start >= b.size || strings.ToUpper(line) >= prefix {
+			hi = mid
+		} else {
+			lo = start + 1
+		}
+	}
+	start, _, err := b.lineAfter(lo)
+	return start, err
+}
+
+// lineAfter returns the first line that starts at the offset or after
+// it, and where it starts. The offset is the size if there is none.
+func (b *BreachedList) lineAfter(offset int64) (int64, string, error) {
+	if offset == 0 {
+		return b.firstLine(0)
+	}
+	// The line of the previous byte is cut unless the byte is the
+	// end of a line
+	buf := make([]byte, 2*maxLineLength)
+	n, err := b.file.ReadAt(buf, offset-1)
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	buf = buf[:n]
+	i := bytes.IndexByte(buf, '\n')
+	if i < 0 {
+		return b.size, "", nil
+	}
+	return b.firstLine(offset + int64(i))
+}
+
+// firstLine returns the line that starts at the offset
+func (b *BreachedList) firstLine(start int64) (int64, string, error) {
+	if start >= b.size {
+		return b.size, "", nil
+	}
+	buf := make([]byte, maxLineLength)
+	n, err := b.file.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	buf = buf[:n]
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		buf = buf[:i]
+	}
+	return start, strings.TrimSpace(string(buf)), nil
+}
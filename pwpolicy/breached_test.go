@@ -0,0 +1,135 @@
+package pwpolicy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// writeBreachedList writes the passwords with their counts, plus
+// filler lines, ordered by hash like the Pwned Passwords list
+func writeBreachedList(t *testing.T, counts map[string]int, newline string) string {
+	t.Helper()
+	lines := []string{}
+	for password, count := range counts {
+		lines = append(lines, fmt.Sprintf("%v:%v", sha1Hex(password), count))
+	}
+	for i := 0; i < 2000; i++ {
+		lines = append(lines, fmt.Sprintf("%v:%v", sha1Hex(fmt.Sprint("filler", i)), i+1))
+	}
+	sort.Strings(lines)
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	data := strings.Join(lines, newline) + newline
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBreachedListCount(t *testing.T) {
+	counts := map[string]int{
+		"password": 9545824,
+		"123456":   37359195,
+		"letmein":  1,
+	}
+	for _, newline := range []string{"\n", "\r\n"} {
+		path := writeBreachedList(t, counts, newline)
+		list, err := OpenBreachedList(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer list.Close()
+		for password, want := range counts {
+			got, err := list.Count(password)
+			if err != nil {
+				t.Fatalf("Count(%q) returned %v", password, err)
+			}
+			if got != want {
+				t.Errorf("Count(%q) = %v, want %v", password, got, want)
+			}
+		}
+		for i := 0; i < 2000; i += 397 {
+			password := fmt.Sprint("filler", i)
+			if got, err := list.Count(password); err != nil || got != i+1 {
+				t.Errorf("Count(%q) = %v, %v, want %v", password, got, err, i+1)
+			}
+		}
+		for _, password := range []string{"not breached", "Password", ""} {
+			if got, err := list.Count(password); err != nil || got != 0 {
+				t.Errorf("Count(%q) = %v, %v, want 0", password, got, err)
+			}
+		}
+	}
+}
+
+func TestBreachedListEdges(t *testing.T) {
+	// The first and the last lines of the file, a file without a
+	// final line break and a hash sharing the prefix of the target
+	first := "0000000000000000000000000000000000000001"
+	last := "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"
+	target := sha1Hex("hunter2")
+	sibling := target[:rangePrefixLength] + "00000000000000000000000000000000000"
+	lines := []string{first + ":1", sibling + ":5", target + ":7", last + ":2"}
+	sort.Strings(lines)
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	list, err := OpenBreachedList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+	if got, err := list.Count("hunter2"); err != nil || got != 7 {
+		t.Errorf("Count(hunter2) = %v, %v, want 7", got, err)
+	}
+	starts := map[string]int64{
+		first[:rangePrefixLength]: 0,
+		last[:rangePrefixLength]:  list.size - int64(len(last+":2")),
+	}
+	for prefix, want := range starts {
+		if got, err := list.rangeStart(prefix); err != nil || got != want {
+			t.Errorf("rangeStart(%v) = %v, %v, want %v", prefix, got, err, want)
+		}
+	}
+}
+
+func TestBreachedListEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	list, err := OpenBreachedList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+	if got, err := list.Count("password"); err != nil || got != 0 {
+		t.Errorf("Count in an empty list = %v, %v, want 0", got, err)
+	}
+}
+
+func TestBreachedListInvalidCount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(sha1Hex("password")+":many\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	list, err := OpenBreachedList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+	if _, err := list.Count("password"); err == nil {
+		t.Error("Count returned no error for an invalid count")
+	}
+}
@@ -0,0 +1,98 @@
+package pwpolicy
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Codes of the problems of a password
+const (
+	CodeTooShort      = "too_short"
+	CodeTooLong       = "too_long"
+	CodeTooWeak       = "too_weak"
+	CodeContainsEmail = "contains_email"
+	CodeContainsName  = "contains_name"
+	CodeBreached      = "breached"
+)
+
+// Parts of the email and name shorter than this may be in the
+// password, like initials
+const minUserWordLength = 3
+
+// Problem is a rule of the policy the password breaks
+type Problem struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Policy is what the passwords of the users must meet. The zero
+// values turn the rules off.
+type Policy struct {
+	MinLength int
+	MaxLength int
+	// MinScore is the lowest strength, from 0 to 4, see Score
+	MinScore int
+	// Breached is the list of leaked passwords, which are rejected
+	Breached *BreachedList
+}
+
+// Check returns every problem of the password of the user with the
+// email and name, or none if it meets the policy
+func (p *Policy) Check(password, email, name string) ([]Problem, error) {
+	var problems []Problem
+	length := utf8.RuneCountInString(password)
+	if p.MinLength > 0 && length < p.MinLength {
+		problems = append(problems, Problem{
+			Code:    CodeTooShort,
+			Message: fmt.Sprintf("password must be at least %v characters long", p.MinLength),
+		})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		problems = append(problems, Problem{
+			Code:    CodeTooLong,
+			Message: fmt.Sprintf("password must be at most %v characters long", p.MaxLength),
+		})
+	}
+	lower := strings.ToLower(password)
+	if containsAny(lower, userWords([]string{email})) {
+		problems = append(problems, Problem{
+			Code:    CodeContainsEmail,
+			Message: "password must not contain the email",
+		})
+	}
+	if containsAny(lower, userWords([]string{name})) {
+		problems = append(problems, Problem{
+			Code:    CodeContainsName,
+			Message: "password must not contain the name",
+		})
+	}
+	if p.MinScore > 0 && Score(password, email, name) < p.MinScore {
+		problems = append(problems, Problem{
+			Code:    CodeTooWeak,
+			Message: "password is too easy to guess, use a longer one or uncommon words",
+		})
+	}
+	if p.Breached != nil {
+		count, err := p.Breached.Count(password)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			problems = append(problems, Problem{
+				Code:    CodeBreached,
+				Message: "password appeared in a data breach, choose another one",
+			})
+		}
+	}
+	return problems, nil
+}
+
+func containsAny(s string, words []string) bool {
+	for _, w := range words {
+		if utf8.RuneCountInString(w) >= minUserWordLength && strings.Contains(s, w) {
+			return true
+		}
+	}
+	return false
+}
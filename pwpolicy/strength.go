@@ -0,0 +1,374 @@
+package pwpolicy
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Passwords longer than this are only estimated up to it, they are
+// strong enough
+const maxEstimatedLength = 64
+
+// Fewest guesses of a part of the password, so splitting it into many
+// small parts isn't cheaper than guessing it whole
+const (
+	minGuessesSingleChar = 10
+	minGuessesMultiChar  = 50
+)
+
+// Guesses of each character that doesn't match a pattern
+const bruteforceCardinality = 10
+
+// Each extra part of the password adds this many guesses, as the
+// attacker has to try the patterns in every order
+const partPenalty = 10000
+
+// Fewest years between a year in the password and the current one
+const minYearSpace = 20
+
+// Keys in a row of the keyboard, shifted and not, and how many keys
+// a keyboard pattern may start with
+var keyboardRows = []string{
+	"`1234567890-=", "~!@#$%^&*()_+",
+	"qwertyuiop[]\\", "QWERTYUIOP{}|",
+	"asdfghjkl;'", "ASDFGHJKL:\"",
+	"zxcvbnm,./", "ZXCVBNM<>?",
+}
+
+const keyboardStarts = 94
+
+// Characters read as letters in l33t speak
+var l33t = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i',
+	'!': 'i', '|': 'l', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't',
+	'2': 'z',
+}
+
+// match is a part of the password that follows a pattern
+type match struct {
+	i, j    int
+	guesses float64
+}
+
+// Score rates the password from 0 to 4 by the guesses it needs: 0 is
+// guessable in under 10^3 tries and 4 needs more than 10^10. The
+// dictionary only has a few hundred passwords and English words, so
+// passwords built on other words, like Tr0ub4dor&3, are overrated;
+// the breached list is what catches the leaked ones. The user
+// inputs, like the name and email, count as known words.
+func Score(password string, userInputs ...string) int {
+	g := Guesses(password, userInputs...)
+	switch {
+	case g < 1e3+5:
+		return 0
+	case g < 1e6+5:
+		return 1
+	case g < 1e8+5:
+		return 2
+	case g < 1e10+5:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// Guesses estimates how many tries an attacker that knows the common
+// passwords and patterns needs to guess the password
+func Guesses(password string, userInputs ...string) float64 {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 1
+	}
+	if len(runes) > maxEstimatedLength {
+		return math.Inf(1)
+	}
+	dict := rankedDictionary(userInputs)
+	return mostGuessable(runes, dict)
+}
+
+// mostGuessable returns the guesses of the cheapest way to split the
+// password into patterns, where the parts that match none are guessed
+// character by character
+func mostGuessable(runes []rune, dict map[string]int) float64 {
+	n := len(runes)
+	matches := findMatches(runes, dict)
+	// best[k][l] is the product of the guesses of the first k
+	// characters split in l parts
+	best := make([][]float64, n+1)
+	for k := range best {
+		best[k] = make([]float64, n+1)
+		for l := range best[k] {
+			best[k][l] = math.Inf(1)
+		}
+	}
+	best[0][0] = 1
+	extend := func(m match) {
+		for l := 0; l < n; l++ {
+			if math.IsInf(best[m.i][l], 1) {
+				continue
+			}
+			if g := best[m.i][l] * m.guesses; g < best[m.j+1][l+1] {
+				best[m.j+1][l+1] = g
+			}
+		}
+	}
+	for k := 0; k < n; k++ {
+		for _, m := range matches {
+			if m.i == k {
+				extend(m)
+			}
+		}
+		for j := k; j < n; j++ {
+			extend(match{i: k, j: j, guesses: bounded(math.Pow(bruteforceCardinality, float64(j-k+1)), j-k+1)})
+		}
+	}
+	guesses := math.Inf(1)
+	for l := 1; l <= n; l++ {
+		if math.IsInf(best[n][l], 1) {
+			continue
+		}
+		g := factorial(l)*best[n][l] + math.Pow(partPenalty, float64(l-1))
+		if g < guesses {
+			guesses = g
+		}
+	}
+	return guesses
+}
+
+func findMatches(runes []rune, dict map[string]int) []match {
+	var matches []match
+	matches = append(matches, dictionaryMatches(runes, dict)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, repeatMatches(runes, dict)...)
+	matches = append(matches, keyboardMatches(runes)...)
+	matches = append(matches, yearMatches(runes)...)
+	return matches
+}
+
+// dictionaryMatches finds the common passwords and words, also
+// capitalized, in l33t speak or reversed
+func dictionaryMatches(runes []rune, dict map[string]int) []match {
+	var matches []match
+	n := len(runes)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			token := runes[i : j+1]
+			lower := strings.ToLower(string(token))
+			unleeted, subs := unleet(lower)
+			variations := upperVariations(token)
+			candidates := []struct {
+				word  string
+				extra float64
+			}{
+				{lower, 1},
+				{reverse(lower), 2},
+			}
+			if subs > 0 {
+				candidates = append(candidates, struct {
+					word  string
+					extra float64
+				}{unleeted, l33tVariations(subs)})
+			}
+			for _, c := range candidates {
+				rank, ok := dict[c.word]
+				if !ok {
+					continue
+				}
+				g := float64(rank) * variations * c.extra
+				matches = append(matches, match{i: i, j: j, guesses: bounded(g, j-i+1)})
+			}
+		}
+	}
+	return matches
+}
+
+// sequenceMatches finds runs like abc, 9876 or ACE
+func sequenceMatches(runes []rune) []match {
+	var matches []match
+	n := len(runes)
+	for i := 0; i < n-2; {
+		delta := runes[i+1] - runes[i]
+		j := i + 1
+		for j+1 < n && runes[j+1]-runes[j] == delta {
+			j++
+		}
+		if j-i >= 2 && (delta == 1 || delta == -1 || delta == 2 || delta == -2) {
+			var base float64
+			switch first := runes[i]; {
+			case strings.ContainsRune("aAzZ019", first):
+				base = 4
+			case unicode.IsDigit(first):
+				base = 10
+			case unicode.IsUpper(first):
+				base = 52
+			default:
+				base = 26
+			}
+			if delta < 0 {
+				base *= 2
+			}
+			matches = append(matches, match{i: i, j: j, guesses: bounded(base*float64(j-i+1), j-i+1)})
+			i = j
+			continue
+		}
+		i++
+	}
+	return matches
+}
+
+// repeatMatches finds a part written twice or more, like aaa or
+// abcabc, which takes the guesses of the part times the repeats
+func repeatMatches(runes []rune, dict map[string]int) []match {
+	var matches []match
+	n := len(runes)
+	for i := 0; i < n-1; i++ {
+		for size := 1; i+2*size <= n; size++ {
+			count := 1
+			for i+(count+1)*size <= n && string(runes[i+count*size:i+(count+1)*size]) == string(runes[i:i+size]) {
+				count++
+			}
+			if count < 2 {
+				continue
+			}
+			base := mostGuessable(runes[i:i+size], dict)
+			j := i + count*size - 1
+			matches = append(matches, match{i: i, j: j, guesses: bounded(base*float64(count), j-i+1)})
+			break
+		}
+	}
+	return matches
+}
+
+// keyboardMatches finds runs of keys next to each other in a row of
+// the keyboard, like qwerty or ;lkj
+func keyboardMatches(runes []rune) []match {
+	var matches []match
+	n := len(runes)
+	for i := 0; i < n-2; i++ {
+		for _, row := range keyboardRows {
+			r := []rune(row)
+			pos := indexRune(r, runes[i])
+			if pos < 0 {
+				continue
+			}
+			for _, dir := range []int{1, -1} {
+				j, p := i, pos
+				for j+1 < n && p+dir >= 0 && p+dir < len(r) && r[p+dir] == runes[j+1] {
+					j, p = j+1, p+dir
+				}
+				if j-i >= 2 {
+					g := keyboardStarts * float64(j-i+1)
+					matches = append(matches, match{i: i, j: j, guesses: bounded(g, j-i+1)})
+				}
+			}
+		}
+	}
+	return matches
+}
+
+// yearMatches finds recent years, which are guessed from the current
+// one
+func yearMatches(runes []rune) []match {
+	var matches []match
+	now := time.Now().Year()
+	for i := 0; i+4 <= len(runes); i++ {
+		year, err := strconv.Atoi(string(runes[i : i+4]))
+		if err != nil || year < 1900 || year > 2099 {
+			continue
+		}
+		space := math.Abs(float64(year - now))
+		if space < minYearSpace {
+			space = minYearSpace
+		}
+		matches = append(matches, match{i: i, j: i + 3, guesses: bounded(space, 4)})
+	}
+	return matches
+}
+
+// upperVariations is how many ways the capitals of a word could have
+// been chosen. The usual ones, like the first letter, count as two.
+func upperVariations(token []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range token {
+		if unicode.IsUpper(r) {
+			upper++
+		} else if unicode.IsLower(r) {
+			lower++
+		}
+	}
+	if upper == 0 {
+		return 1
+	}
+	if lower == 0 || (upper == 1 && (unicode.IsUpper(token[0]) || unicode.IsUpper(token[len(token)-1]))) {
+		return 2
+	}
+	variations := 0.0
+	for k := 1; k <= upper && k <= lower; k++ {
+		variations += binomial(upper+lower, k)
+	}
+	return variations
+}
+
+// l33tVariations is how many ways the substitutions could have been
+// chosen
+func l33tVariations(subs int) float64 {
+	return math.Pow(2, float64(subs))
+}
+
+// unleet reads the l33t characters of the word as letters and
+// returns how many were replaced
+func unleet(word string) (string, int) {
+	subs := 0
+	runes := []rune(word)
+	for i, r := range runes {
+		if l, ok := l33t[r]; ok {
+			runes[i] = l
+			subs++
+		}
+	}
+	return string(runes), subs
+}
+
+func bounded(guesses float64, length int) float64 {
+	min := float64(minGuessesMultiChar)
+	if length == 1 {
+		min = minGuessesSingleChar
+	}
+	return math.Max(guesses, min)
+}
+
+func factorial(n int) float64 {
+	f := 1.0
+	for i := 2; i <= n; i++ {
+		f *= float64(i)
+	}
+	return f
+}
+
+func binomial(n, k int) float64 {
+	r := 1.0
+	for i := 1; i <= k; i++ {
+		r = r * float64(n-k+i) / float64(i)
+	}
+	return r
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+func indexRune(runes []rune, r rune) int {
+	for i, c := range runes {
+		if c == r {
+			return i
+		}
+	}
+	return -1
+}
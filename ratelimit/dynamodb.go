@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/jcamilom/ecommerce/db"
+)
+
+var (
+	// The DB table name for the buckets. The ttl attribute must be
+	// set as the time to live of the table so DynamoDB deletes the
+	// buckets that are full again.
+	dbRateLimitsTableName = "RateLimits"
+)
+
+// Times a take is tried when another instance updates the bucket at
+// the same time
+const dbTakeAttempts = 5
+
+// NewDBStore creates a store backed by the RateLimits table, shared by
+// every instance of the API
+func NewDBStore() *DBStore {
+	return &DBStore{
+		db: &db.DB{},
+	}
+}
+
+var _ Store = &DBStore{}
+
+// DBStore keeps the buckets in DynamoDB
+type DBStore struct {
+	db *db.DB
+}
+
+type dbBucket struct {
+	Key    string  `json:"bucket_key"`
+	Tokens float64 `json:"tokens"`
+	// UpdatedAt is in unix nanoseconds, it is also the version of the
+	// bucket for the conditional updates
+	UpdatedAt int64 `json:"updated_at"`
+	// TTL is the time in unix seconds the bucket is full again
+	TTL int64 `json:"ttl"`
+}
+
+type dbBucketKey struct {
+	Key string `json:"bucket_key"`
+}
+
+// Take reads the bucket and writes it back only if no other instance
+// changed it in between, trying again if one did. If the bucket keeps
+// changing the request is denied, since that only happens when the
+// key gets many requests at once.
+func (s *DBStore) Take(key string, limit Limit) (Result, error) {
+	tableKey := dbBucketKey{
+		Key: key,
+	}
+	// ttl is a reserved word
+	names := map[string]*string{
+		"#t": aws.String("ttl"),
+	}
+	for attempt := 0; attempt < dbTakeAttempts; attempt++ {
+		stored := new(dbBucket)
+		found, err := s.db.GetItem(tableKey, dbRateLimitsTableName, stored)
+		if err != nil {
+			return Result{}, err
+		}
+		now := time.Now()
+		var b bucket
+		if found && stored.TTL > now.Unix() {
+			b = bucket{
+				tokens:  stored.Tokens,
+				updated: time.Unix(0, stored.UpdatedAt),
+			}
+		}
+		b, res := take(b, limit, now)
+		if !res.Allowed {
+			// Nothing was taken, the bucket doesn't change
+			return res, nil
+		}
+		update := struct {
+			Tokens    float64 `json:":k"`
+			UpdatedAt int64   `json:":u"`
+			TTL       int64   `json:":t"`
+			Previous  int64   `json:":p"`
+		}{
+			Tokens:    b.tokens,
+			UpdatedAt: b.updated.UnixNano(),
+			TTL:       now.Add(res.Reset).Unix() + 1,
+			Previous:  stored.UpdatedAt,
+		}
+		updateExp := "set tokens = :k, updated_at = :u, #t = :t"
+		condExp := "attribute_not_exists(bucket_key) OR updated_at = :p"
+		err = s.db.UpdateItemReturning(dbRateLimitsTableName, tableKey, update, updateExp, condExp, names, new(dbBucket))
+		if err == db.ErrConditionFailed {
+			continue
+		}
+		if err != nil {
+			return Result{}, err
+		}
+		return res, nil
+	}
+	return Result{
+		Allowed:    false,
+		Reset:      limit.Period,
+		RetryAfter: seconds(1 / limit.rate()),
+	}, nil
+}
@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// The buckets that are full again are dropped at most once per
+// interval
+const sweepInterval = time.Minute
+
+// NewMemoryStore creates a store that keeps the buckets in memory.
+// Each instance of the API has its own buckets.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: map[string]*memoryBucket{},
+	}
+}
+
+var _ Store = &MemoryStore{}
+
+// MemoryStore keeps the buckets in memory
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	bucket
+	// full is when the bucket is full again and can be dropped
+	full time.Time
+}
+
+func (s *MemoryStore) Take(key string, limit Limit) (Result, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+	mb, ok := s.buckets[key]
+	if !ok {
+		mb = &memoryBucket{}
+		s.buckets[key] = mb
+	}
+	b, res := take(mb.bucket, limit, now)
+	mb.bucket = b
+	mb.full = now.Add(res.Reset)
+	return res, nil
+}
+
+// sweep drops the buckets that are full again, which are the same as
+// no bucket. s.mu must be held.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, mb := range s.buckets {
+		if !now.Before(mb.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
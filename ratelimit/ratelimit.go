@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit lets through Burst requests at once, which are given back
+// at a steady rate over Period
+type Limit struct {
+	Burst  int
+	Period time.Duration
+}
+
+// ParseLimit reads a limit written as requests/period, like 5/1h or
+// 10/1m
+func ParseLimit(s string) (Limit, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("ratelimit: limit %q must be requests/period", s)
+	}
+	burst, err := strconv.Atoi(parts[0])
+	if err != nil || burst < 1 {
+		return Limit{}, fmt.Errorf("ratelimit: requests of limit %q must be a positive number", s)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return Limit{}, fmt.Errorf("ratelimit: period of limit %q must be a positive duration", s)
+	}
+	return Limit{
+		Burst:  burst,
+		Period: period,
+	}, nil
+}
+
+// String returns the limit in the format of ParseLimit
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%v", l.Burst, l.Period)
+}
+
+// rate is the requests given back per second
+func (l Limit) rate() float64 {
+	return float64(l.Burst) / l.Period.Seconds()
+}
+
+// Result of taking a request from a bucket
+type Result struct {
+	Allowed bool
+	// Remaining requests that can be made right away
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, if
+	// this one wasn't
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets of the keys
+type Store interface {
+	// Take takes a request from the bucket of the key
+	Take(key string, limit Limit) (Result, error)
+}
+
+// bucket is the state of a token bucket: the tokens it had at the
+// time it was last updated
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills the bucket for the time since it was updated and takes
+// a token if there is one. A zero bucket is full.
+func take(b bucket, limit Limit, now time.Time) (bucket, Result) {
+	tokens := float64(limit.Burst)
+	if !b.updated.IsZero() {
+		elapsed := now.Sub(b.updated).Seconds()
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.rate())
+	}
+	res := Result{}
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((1 - tokens) / limit.rate())
+	}
+	res.Remaining = int(math.Floor(tokens))
+	res.Reset = seconds((float64(limit.Burst) - tokens) / limit.rate())
+	return bucket{tokens: tokens, updated: now}, res
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ParseLimit(" 5/1h ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit.Burst != 5 || limit.Period != time.Hour {
+		t.Errorf("ParseLimit = %+v", limit)
+	}
+	if limit.String() != "5/1h0m0s" {
+		t.Errorf("String = %v", limit.String())
+	}
+	for _, s := range []string{"", "5", "x/1h", "0/1h", "-1/1h", "5/x", "5/0s", "5/-1m"} {
+		if _, err := ParseLimit(s); err == nil {
+			t.Errorf("ParseLimit(%q) returned no error", s)
+		}
+	}
+}
+
+func TestTakeBurst(t *testing.T) {
+	limit := Limit{Burst: 3, Period: 3 * time.Second}
+	now := time.Unix(1000, 0)
+	b := bucket{}
+	var res Result
+	for i := 0; i < 3; i++ {
+		b, res = take(b, limit, now)
+		if !res.Allowed {
+			t.Fatalf("request %v wasn't allowed", i+1)
+		}
+		if res.Remaining != 2-i {
+			t.Errorf("request %v: Remaining = %v, want %v", i+1, res.Remaining, 2-i)
+		}
+		if want := time.Duration(i+1) * time.Second; res.Reset != want {
+			t.Errorf("request %v: Reset = %v, want %v", i+1, res.Reset, want)
+		}
+	}
+	b, res = take(b, limit, now)
+	if res.Allowed {
+		t.Fatal("a request over the burst was allowed")
+	}
+	if res.RetryAfter != time.Second {
+		t.Errorf("RetryAfter = %v, want 1s", res.RetryAfter)
+	}
+	if res.Remaining != 0 || res.Reset != 3*time.Second {
+		t.Errorf("Remaining = %v, Reset = %v, want 0, 3s", res.Remaining, res.Reset)
+	}
+}
+
+func TestTakeRefill(t *testing.T) {
+	limit := Limit{Burst: 2, Period: 2 * time.Second}
+	now := time.Unix(1000, 0)
+	b := bucket{}
+	b, _ = take(b, limit, now)
+	b, _ = take(b, limit, now)
+
+	// Half a token is back, not enough
+	b, res := take(b, limit, now.Add(500*time.Millisecond))
+	if res.Allowed {
+		t.Fatal("a request was allowed with half a token")
+	}
+	if res.RetryAfter != 500*time.Millisecond {
+		t.Errorf("RetryAfter = %v, want 500ms", res.RetryAfter)
+	}
+
+	// A whole token is back
+	b, res = take(b, limit, now.Add(time.Second))
+	if !res.Allowed {
+		t.Fatal("a request wasn't allowed after a token was given back")
+	}
+
+	// The bucket never holds more than the burst
+	_, res = take(b, limit, now.Add(time.Hour))
+	if !res.Allowed || res.Remaining != 1 {
+		t.Errorf("after a long wait Allowed = %v, Remaining = %v, want true, 1", res.Allowed, res.Remaining)
+	}
+}
+
+func TestTakeClockGoingBack(t *testing.T) {
+	limit := Limit{Burst: 1, Period: time.Minute}
+	now := time.Unix(1000, 0)
+	b, _ := take(bucket{}, limit, now)
+	_, res := take(b, limit, now.Add(-time.Hour))
+	if res.Allowed {
+		t.Error("a request was allowed when the clock went back")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	limit := Limit{Burst: 1, Period: time.Hour}
+	res, err := s.Take("a", limit)
+	if err != nil || !res.Allowed {
+		t.Fatalf("the first request of a returned %+v, %v", res, err)
+	}
+	if res, _ := s.Take("a", limit); res.Allowed {
+		t.Error("the second request of a was allowed")
+	}
+	if res, _ := s.Take("b", limit); !res.Allowed {
+		t.Error("the keys share their buckets")
+	}
+}
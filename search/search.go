@@ -0,0 +1,280 @@
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// Weight of a query token matching an indexed term exactly
+	exactMatchWeight = 1.0
+
+	// Weight of a query token being a prefix of an indexed term
+	prefixMatchWeight = 0.7
+
+	// Weight of a query token matching an indexed term with typos.
+	// It is divided by the edit distance between both.
+	fuzzyMatchWeight = 0.5
+
+	// Min length of a query token to be used as a prefix
+	minPrefixLength = 2
+)
+
+// Field is a piece of text of a document. Matches on fields with
+// a greater boost rank higher.
+type Field struct {
+	Text  string
+	Boost float64
+}
+
+// Hit is a document matching a query
+type Hit struct {
+	ID    string  `json:"id"`
+	Score float64 `json:"score"`
+}
+
+// NewIndex creates an empty index
+func NewIndex() *Index {
+	return &Index{
+		postings: map[string]map[string]float64{},
+		docs:     map[string]map[string]float64{},
+	}
+}
+
+// Index is an embedded inverted index. It lives in memory, so it
+// must be filled when the application starts and kept in sync by
+// calling Put and Remove whenever a document changes. Changes made
+// by other processes are only seen by rebuilding the index and
+// calling Replace.
+//
+// Prefix and typo tolerant lookups walk the whole dictionary, which
+// is fine for catalogs of a few thousand products.
+type Index struct {
+	mu sync.RWMutex
+	// term -> doc id -> weight of the term in the doc
+	postings map[string]map[string]float64
+	// doc id -> term -> weight of the term in the doc
+	docs map[string]map[string]float64
+}
+
+// Put adds a document to the index, replacing the previous
+// version of the document if any.
+func (idx *Index) Put(id string, fields ...Field) {
+	terms := map[string]float64{}
+	for _, f := range fields {
+		boost := f.Boost
+		if boost == 0 {
+			boost = 1
+		}
+		for _, t := range Tokenize(f.Text) {
+			terms[t] += boost
+		}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(id)
+	idx.docs[id] = terms
+	for t, w := range terms {
+		if idx.postings[t] == nil {
+			idx.postings[t] = map[string]float64{}
+		}
+		idx.postings[t][id] = w
+	}
+}
+
+// Remove deletes a document from the index
+func (idx *Index) Remove(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(id)
+}
+
+func (idx *Index) remove(id string) {
+	for t := range idx.docs[id] {
+		delete(idx.postings[t], id)
+		if len(idx.postings[t]) == 0 {
+			delete(idx.postings, t)
+		}
+	}
+	delete(idx.docs, id)
+}
+
+// Replace swaps the documents of the index with the ones of other,
+// which must not be used afterwards.
+func (idx *Index) Replace(other *Index) {
+	other.mu.Lock()
+	postings, docs := other.postings, other.docs
+	other.mu.Unlock()
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.postings, idx.docs = postings, docs
+}
+
+// Len returns the number of documents in the index
+func (idx *Index) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.docs)
+}
+
+// Search returns the documents matching the query sorted by
+// relevance. Every query token is matched against the indexed terms
+// exactly, as a prefix and with a few typos. Documents matching
+// more of the query tokens rank higher.
+func (idx *Index) Search(query string) []Hit {
+	tokens := Tokenize(query)
+	if len(tokens) == 0 {
+		return []Hit{}
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	scores := map[string]float64{}
+	matched := map[string]int{}
+	for _, token := range tokens {
+		// Best score of this token for every document
+		best := map[string]float64{}
+		for term, docs := range idx.postings {
+			weight := matchWeight(token, term)
+			if weight == 0 {
+				continue
+			}
+			idf := math.Log(1 + float64(len(idx.docs))/float64(len(docs)))
+			for id, tf := range docs {
+				score := weight * idf * math.Log(1+tf)
+				if score > best[id] {
+					best[id] = score
+				}
+			}
+		}
+		for id, score := range best {
+			scores[id] += score
+			matched[id]++
+		}
+	}
+
+	hits := make([]Hit, 0, len(scores))
+	for id, score := range scores {
+		coverage := float64(matched[id]) / float64(len(tokens))
+		hits = append(hits, Hit{
+			ID:    id,
+			Score: score * coverage,
+		})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	return hits
+}
+
+// matchWeight returns how well the query token matches the indexed
+// term, or 0 if they don't match at all.
+func matchWeight(token, term string) float64 {
+	if token == term {
+		return exactMatchWeight
+	}
+	if len(token) >= minPrefixLength && strings.HasPrefix(term, token) {
+		return prefixMatchWeight
+	}
+	maxDist := maxEditDistance(token)
+	if maxDist == 0 {
+		return 0
+	}
+	if dist := editDistance(token, term, maxDist); dist <= maxDist {
+		return fuzzyMatchWeight / float64(dist)
+	}
+	return 0
+}
+
+// maxEditDistance returns the number of typos tolerated for the token.
+// Short tokens must be typed correctly.
+func maxEditDistance(token string) int {
+	n := len([]rune(token))
+	switch {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance computes the Levenshtein distance between a and b.
+// It gives up as soon as the distance is known to be greater than limit,
+// returning limit + 1.
+func editDistance(a, b string, limit int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > limit || -d > limit {
+		return limit + 1
+	}
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		rowMin := curr[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+			if curr[j] < rowMin {
+				rowMin = curr[j]
+			}
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// Tokenize splits the text in lower case terms without accents
+func Tokenize(text string) []string {
+	text = strings.Map(foldRune, strings.ToLower(text))
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// foldRune replaces the accented letters used in spanish
+func foldRune(r rune) rune {
+	switch r {
+	case 'á', 'à', 'ä', 'â':
+		return 'a'
+	case 'é', 'è', 'ë', 'ê':
+		return 'e'
+	case 'í', 'ì', 'ï', 'î':
+		return 'i'
+	case 'ó', 'ò', 'ö', 'ô':
+		return 'o'
+	case 'ú', 'ù', 'ü', 'û':
+		return 'u'
+	case 'ñ':
+		return 'n'
+	}
+	return r
+}
@@ -0,0 +1,63 @@
+package session
+
+import (
+	"time"
+
+	"github.com/jcamilom/ecommerce/db"
+)
+
+var (
+	// The DB table name for the revoked tokens. The ttl attribute
+	// must be set as the time to live of the table so DynamoDB
+	// deletes the tokens once they expire.
+	dbRevokedTokensTableName = "RevokedTokens"
+)
+
+// Denylist keeps the IDs of the revoked tokens until they expire
+type Denylist interface {
+	Revoke(id string, expiresAt time.Time) error
+	IsRevoked(id string) (bool, error)
+}
+
+// NewDBDenylist creates a denylist backed by the RevokedTokens table
+func NewDBDenylist() *DBDenylist {
+	return &DBDenylist{
+		db: &db.DB{},
+	}
+}
+
+var _ Denylist = &DBDenylist{}
+
+// DBDenylist stores the revoked tokens in DynamoDB
+type DBDenylist struct {
+	db *db.DB
+}
+
+type revokedToken struct {
+	ID string `json:"jti"`
+	// TTL is the expiry time in unix seconds
+	TTL int64 `json:"ttl"`
+}
+
+func (dl *DBDenylist) Revoke(id string, expiresAt time.Time) error {
+	return dl.db.PutItem(dbRevokedTokensTableName, &revokedToken{
+		ID:  id,
+		TTL: expiresAt.Unix(),
+	})
+}
+
+// IsRevoked checks the expiry too, as DynamoDB may take a while
+// to delete the expired tokens
+func (dl *DBDenylist) IsRevoked(id string) (bool, error) {
+	rt := new(revokedToken)
+	key := struct {
+		ID string `json:"jti"`
+	}{
+		ID: id,
+	}
+	found, err := dl.db.GetItem(key, dbRevokedTokensTableName, rt)
+	if err != nil {
+		return false, err
+	}
+	return found && rt.TTL > time.Now().Unix(), nil
+}
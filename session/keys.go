@@ -0,0 +1,241 @@
+package session
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+var (
+	// ErrNoSigningKey is returned when creating a token while no key
+	// of the set is active.
+	ErrNoSigningKey = errors.New("session: no active signing key")
+)
+
+// Key is a key used to sign and verify the tokens. A key signs the
+// new tokens from ActiveFrom on, while it is the newest active key,
+// and verifies them until RetireAt. A zero RetireAt never retires
+// the key.
+type Key struct {
+	ID         string
+	Algorithm  string
+	ActiveFrom time.Time
+	RetireAt   time.Time
+	signKey    interface{}
+	verifyKey  interface{}
+}
+
+// KeySet is the list of keys of a session service
+type KeySet struct {
+	keys []*Key
+}
+
+// NewHMACKeySet creates a key set with a single HS256 secret. The
+// secret can't be published, so only this API can verify the tokens.
+func NewHMACKeySet(secret string) *KeySet {
+	return &KeySet{
+		keys: []*Key{
+			{
+				Algorithm: jwt.SigningMethodHS256.Alg(),
+				signKey:   []byte(secret),
+				verifyKey: []byte(secret),
+			},
+		},
+	}
+}
+
+// keyConfig is an entry of the keys file
+type keyConfig struct {
+	ID         string    `json:"kid"`
+	File       string    `json:"file"`
+	ActiveFrom time.Time `json:"active_from"`
+	RetireAt   time.Time `json:"retire_at"`
+}
+
+// LoadKeySet reads the keys listed in a JSON file like:
+//
+//	[{"kid": "2024-01", "file": "keys/2024-01.pem", "active_from": "2024-01-01T00:00:00Z", "retire_at": "2024-02-01T00:00:00Z"}]
+//
+// Each file is a PKCS #8 (or PKCS #1 for RSA) private key in PEM
+// format. RSA keys sign with RS256 and Ed25519 keys with EdDSA. The
+// files are relative to the keys file.
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []keyConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("session: reading %v: %v", path, err)
+	}
+	ks := &KeySet{}
+	seen := map[string]bool{}
+	for _, c := range configs {
+		if c.ID == "" {
+			return nil, fmt.Errorf("session: a key of %v has no kid", path)
+		}
+		if seen[c.ID] {
+			return nil, fmt.Errorf("session: kid %v is repeated", c.ID)
+		}
+		seen[c.ID] = true
+		file := c.File
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		key, err := loadKey(file)
+		if err != nil {
+			return nil, fmt.Errorf("session: key %v: %v", c.ID, err)
+		}
+		key.ID = c.ID
+		key.ActiveFrom = c.ActiveFrom
+		key.RetireAt = c.RetireAt
+		ks.keys = append(ks.keys, key)
+	}
+	if len(ks.keys) == 0 {
+		return nil, fmt.Errorf("session: %v has no keys", path)
+	}
+	return ks, nil
+}
+
+// loadKey parses the private key of a PEM file
+func loadKey(file string) (*Key, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	var private interface{}
+	if block.Type == "RSA PRIVATE KEY" {
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		return &Key{
+			Algorithm: jwt.SigningMethodRS256.Alg(),
+			signKey:   k,
+			verifyKey: &k.PublicKey,
+		}, nil
+	case ed25519.PrivateKey:
+		return &Key{
+			Algorithm: SigningMethodEdDSA.Alg(),
+			signKey:   k,
+			verifyKey: k.Public(),
+		}, nil
+	default:
+		return nil, errors.New("only RSA and Ed25519 keys are supported")
+	}
+}
+
+// signingKey returns the newest active key
+func (ks *KeySet) signingKey(now time.Time) (*Key, error) {
+	var current *Key
+	for _, k := range ks.keys {
+		if !k.active(now) {
+			continue
+		}
+		if current == nil || k.ActiveFrom.After(current.ActiveFrom) {
+			current = k
+		}
+	}
+	if current == nil {
+		return nil, ErrNoSigningKey
+	}
+	return current, nil
+}
+
+// verifyingKey returns the key to check the signature of the token,
+// as long as it uses the algorithm of the key
+func (ks *KeySet) verifyingKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	for _, k := range ks.keys {
+		if k.ID != kid || k.retired(time.Now()) {
+			continue
+		}
+		if token.Method.Alg() != k.Algorithm {
+			return nil, ErrTokenInvalid
+		}
+		return k.verifyKey, nil
+	}
+	return nil, ErrTokenInvalid
+}
+
+func (k *Key) active(now time.Time) bool {
+	return !now.Before(k.ActiveFrom) && !k.retired(now)
+}
+
+func (k *Key) retired(now time.Time) bool {
+	return !k.RetireAt.IsZero() && !now.Before(k.RetireAt)
+}
+
+// JWKS is a JSON Web Key Set, as defined by RFC 7517
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is the public part of a signing key
+type JWK struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS returns the public keys of the set that aren't retired,
+// including the ones that aren't active yet so they can be fetched
+// before the first token is signed with them. HMAC secrets are
+// never listed.
+func (ks *KeySet) JWKS() *JWKS {
+	jwks := &JWKS{
+		Keys: []JWK{},
+	}
+	now := time.Now()
+	for _, k := range ks.keys {
+		if k.retired(now) {
+			continue
+		}
+		jwk := JWK{
+			ID:        k.ID,
+			Use:       "sig",
+			Algorithm: k.Algorithm,
+		}
+		switch pub := k.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
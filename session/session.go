@@ -1,6 +1,8 @@
 package session
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"time"
 
@@ -8,76 +10,220 @@ import (
 )
 
 var (
+	// ErrTokenMalformed is returned when the session token isn't a
+	// JWT or is missing required claims.
+	ErrTokenMalformed = errors.New("session: token malformed")
+
 	// ErrTokenExpired is returned when the session token has expired.
 	ErrTokenExpired = errors.New("session: token expired")
 
-	// ErrTokenInvalid is returned when the session token is invalid.
+	// ErrTokenNotValidYet is returned when the session token is used
+	// before its nbf or iat time.
+	ErrTokenNotValidYet = errors.New("session: token not valid yet")
+
+	// ErrTokenSignatureInvalid is returned when the signature of the
+	// session token doesn't match.
+	ErrTokenSignatureInvalid = errors.New("session: token signature invalid")
+
+	// ErrTokenInvalid is returned when the session token is signed
+	// with an unknown key or algorithm, or isn't valid anymore.
 	ErrTokenInvalid = errors.New("session: token invalid")
+
+	// ErrTokenIssuerInvalid is returned when the session token was
+	// issued by someone else.
+	ErrTokenIssuerInvalid = errors.New("session: token issuer invalid")
+
+	// ErrTokenAudienceInvalid is returned when the session token is
+	// meant for someone else.
+	ErrTokenAudienceInvalid = errors.New("session: token audience invalid")
+
+	// ErrTokenRevoked is returned when the session token was revoked
+	// before it expired.
+	ErrTokenRevoked = errors.New("session: token revoked")
 )
 
-func NewSessionService(expireTime int, tokenKey string) *Session {
+// IsTokenError tells if the error is one of the errors of an invalid
+// token, as opposed to an error checking it
+func IsTokenError(err error) bool {
+	switch err {
+	case ErrTokenMalformed, ErrTokenExpired, ErrTokenNotValidYet,
+		ErrTokenSignatureInvalid, ErrTokenInvalid, ErrTokenIssuerInvalid,
+		ErrTokenAudienceInvalid, ErrTokenRevoked:
+		return true
+	}
+	return false
+}
+
+// Config is the configuration of a session service
+type Config struct {
+	// ExpireTime of the tokens in minutes
+	ExpireTime int
+	// Keys the tokens are signed with
+	Keys *KeySet
+	// Denylist of the revoked tokens, nil if the tokens are never
+	// revoked
+	Denylist Denylist
+	// Issuer and Audience are set in the iss and aud claims of the
+	// tokens and checked on verification, unless they are empty
+	Issuer   string
+	Audience string
+	// ClockSkew tolerated between the servers when checking the exp,
+	// nbf and iat claims
+	ClockSkew time.Duration
+}
+
+// NewSessionService creates a session service with the config
+func NewSessionService(c Config) *Session {
 	return &Session{
-		expireTime: expireTime,
-		tokenKey:   []byte(tokenKey),
+		expireTime: c.ExpireTime,
+		keys:       c.Keys,
+		denylist:   c.Denylist,
+		issuer:     c.Issuer,
+		audience:   c.Audience,
+		clockSkew:  c.ClockSkew,
 	}
 }
 
 type Session struct {
 	expireTime int
-	tokenKey   []byte
+	keys       *KeySet
+	denylist   Denylist
+	issuer     string
+	audience   string
+	clockSkew  time.Duration
 }
 
-// CreateToken creates a session token for the provided user
-func (session *Session) CreateToken(username string) (string, error) {
+// CreateToken creates a session token with the provided claims.
+// The expiry time is set from the session expire time.
+func (session *Session) CreateToken(claims *Claims) (string, error) {
+	now := time.Now()
 	// Declare the expiration time of the token
-	expirationTime := time.Now().Add(time.Duration(session.expireTime) * time.Minute)
-	// Create the JWT claims, which includes the username (email) and expiry time
-	claims := &Claims{
-		Username: username,
-		StandardClaims: jwt.StandardClaims{
-			// In JWT, the expiry time is expressed as unix milliseconds
-			ExpiresAt: expirationTime.Unix(),
-		},
+	expirationTime := now.Add(time.Duration(session.expireTime) * time.Minute)
+	// In JWT, the times are expressed as unix seconds
+	claims.ExpiresAt = expirationTime.Unix()
+	claims.IssuedAt = now.Unix()
+	claims.NotBefore = now.Unix()
+	claims.Issuer = session.issuer
+	claims.Audience = session.audience
+	// The token ID (jti) is used to revoke the token
+	id, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	claims.Id = id
+	key, err := session.keys.signingKey(now)
+	if err != nil {
+		return "", err
 	}
 	// Declare the token with the algorithm used for signing, and the claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	// The key ID tells the verifiers which public key to use
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
 	// Create the JWT string
-	tokenString, err := token.SignedString(session.tokenKey)
+	tokenString, err := token.SignedString(key.signKey)
 	if err != nil {
-		// // If there is an error in creating the JWT return an internal server error
-		// w.WriteHeader(http.StatusInternalServerError)
 		return "", err
 	}
 	return tokenString, nil
 }
 
-func (session *Session) VerifyToken(token string) (string, error) {
+// VerifyToken checks the signature and claims of the token and
+// returns them. The error tells why the token isn't valid.
+func (session *Session) VerifyToken(token string) (*Claims, error) {
 	// Initialize a new instance of `Claims`
 	claims := &Claims{}
 
-	// Parse the JWT string and store the result in `claims`.
-	// This method will return an error if the token is invalid
-	// (if it has expired according to the expiry time we set on sign in),
-	// or if the signature does not match
-	tkn, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-		return session.tokenKey, nil
-	})
+	// Parse the JWT string and store the result in `claims`. The
+	// claims are validated below, with the clock skew that jwt-go
+	// doesn't support
+	parser := &jwt.Parser{
+		SkipClaimsValidation: true,
+	}
+	_, err := parser.ParseWithClaims(token, claims, session.keys.verifyingKey)
 	if err != nil {
-		if err == jwt.ErrSignatureInvalid {
-			return "", ErrTokenInvalid
+		return nil, parseError(err)
+	}
+	if err := session.validate(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	if session.denylist != nil && claims.Id != "" {
+		revoked, err := session.denylist.IsRevoked(claims.Id)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
 		}
-		return "", ErrTokenExpired
 	}
-	if !tkn.Valid {
-		return "", ErrTokenExpired
+	// Finally, return the claims
+	return claims, nil
+}
+
+// parseError maps the errors of jwt-go to the errors of the package
+func parseError(err error) error {
+	ve, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return ErrTokenMalformed
+	}
+	switch {
+	case ve.Errors&jwt.ValidationErrorMalformed != 0:
+		return ErrTokenMalformed
+	case ve.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return ErrTokenSignatureInvalid
+	default:
+		// Unknown keys or algorithms
+		return ErrTokenInvalid
+	}
+}
+
+// validate checks the time, issuer and audience claims
+func (session *Session) validate(claims *Claims, now time.Time) error {
+	if claims.ExpiresAt == 0 {
+		return ErrTokenMalformed
+	}
+	skew := int64(session.clockSkew / time.Second)
+	if now.Unix()-skew > claims.ExpiresAt {
+		return ErrTokenExpired
+	}
+	if now.Unix()+skew < claims.NotBefore || now.Unix()+skew < claims.IssuedAt {
+		return ErrTokenNotValidYet
+	}
+	if session.issuer != "" && claims.Issuer != session.issuer {
+		return ErrTokenIssuerInvalid
+	}
+	if session.audience != "" && claims.Audience != session.audience {
+		return ErrTokenAudienceInvalid
+	}
+	return nil
+}
+
+// RevokeToken adds the token of the claims to the denylist until
+// it expires, plus the clock skew it is still accepted for
+func (session *Session) RevokeToken(claims *Claims) error {
+	if session.denylist == nil || claims.Id == "" {
+		return nil
+	}
+	expiresAt := time.Unix(claims.ExpiresAt, 0).Add(session.clockSkew)
+	return session.denylist.Revoke(claims.Id, expiresAt)
+}
+
+// newTokenID returns a random 32 characters hex ID
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	// Finally, return the username
-	return claims.Username, nil
+	return hex.EncodeToString(b), nil
 }
 
 // Claims will help to encoded to a JWT.
 // We add jwt.StandardClaims as an embedded type, to provide fields like expiry time
 type Claims struct {
 	Username string `json:"username"`
+	Role     string `json:"role,omitempty"`
+	// SessionID is the ID of the session the token belongs to
+	SessionID string `json:"sid,omitempty"`
 	jwt.StandardClaims
 }
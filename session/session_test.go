@@ -0,0 +1,186 @@
+package session
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const testSecret = "test-secret"
+
+// memoryDenylist keeps the revoked tokens in a map
+type memoryDenylist struct {
+	revoked map[string]bool
+	expires map[string]time.Time
+	err     error
+}
+
+func (dl *memoryDenylist) Revoke(id string, expiresAt time.Time) error {
+	dl.revoked[id] = true
+	if dl.expires != nil {
+		dl.expires[id] = expiresAt
+	}
+	return nil
+}
+
+func (dl *memoryDenylist) IsRevoked(id string) (bool, error) {
+	return dl.revoked[id], dl.err
+}
+
+func newTestSession(c Config) *Session {
+	if c.Keys == nil {
+		c.Keys = NewHMACKeySet(testSecret)
+	}
+	if c.ExpireTime == 0 {
+		c.ExpireTime = 15
+	}
+	return NewSessionService(c)
+}
+
+// sign signs the claims as they are, so the tests can set any time
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, claims *Claims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func claimsAt(now time.Time, expiresIn time.Duration) *Claims {
+	return &Claims{
+		Username: "user@example.com",
+		StandardClaims: jwt.StandardClaims{
+			Id:        "id",
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(expiresIn).Unix(),
+		},
+	}
+}
+
+func TestCreateAndVerifyToken(t *testing.T) {
+	s := newTestSession(Config{Issuer: "api", Audience: "web"})
+	token, err := s.CreateToken(&Claims{Username: "user@example.com", Role: "admin", SessionID: "s1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.VerifyToken(token)
+	if err != nil {
+		t.Fatalf("VerifyToken returned %v", err)
+	}
+	if claims.Username != "user@example.com" || claims.Role != "admin" || claims.SessionID != "s1" {
+		t.Errorf("VerifyToken returned the claims %+v", claims)
+	}
+	if claims.Id == "" {
+		t.Error("the token has no ID")
+	}
+}
+
+func TestVerifyTokenErrors(t *testing.T) {
+	now := time.Now()
+	hs256 := jwt.SigningMethodHS256
+	key := []byte(testSecret)
+	withIssuer := func(c *Claims, iss, aud string) *Claims {
+		c.Issuer = iss
+		c.Audience = aud
+		return c
+	}
+	noExpiry := claimsAt(now, 0)
+	noExpiry.ExpiresAt = 0
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"not a JWT", "abc", ErrTokenMalformed},
+		{"empty", "", ErrTokenMalformed},
+		{"other secret", sign(t, hs256, []byte("other"), claimsAt(now, time.Minute)), ErrTokenSignatureInvalid},
+		{"other algorithm", sign(t, jwt.SigningMethodHS512, key, claimsAt(now, time.Minute)), ErrTokenInvalid},
+		{"unsigned", sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, claimsAt(now, time.Minute)), ErrTokenInvalid},
+		{"no expiry", sign(t, hs256, key, noExpiry), ErrTokenMalformed},
+		{"expired", sign(t, hs256, key, claimsAt(now.Add(-time.Hour), time.Minute)), ErrTokenExpired},
+		{"not valid yet", sign(t, hs256, key, claimsAt(now.Add(time.Hour), time.Minute)), ErrTokenNotValidYet},
+		{"other issuer", sign(t, hs256, key, withIssuer(claimsAt(now, time.Minute), "other", "web")), ErrTokenIssuerInvalid},
+		{"other audience", sign(t, hs256, key, withIssuer(claimsAt(now, time.Minute), "api", "other")), ErrTokenAudienceInvalid},
+	}
+	s := newTestSession(Config{Issuer: "api", Audience: "web"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.VerifyToken(tt.token)
+			if err != tt.want {
+				t.Fatalf("VerifyToken returned %v, want %v", err, tt.want)
+			}
+			if !IsTokenError(err) {
+				t.Errorf("IsTokenError(%v) = false", err)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenClockSkew(t *testing.T) {
+	now := time.Now()
+	key := []byte(testSecret)
+	s := newTestSession(Config{ClockSkew: time.Minute})
+	expired := sign(t, jwt.SigningMethodHS256, key, claimsAt(now.Add(-time.Hour), time.Hour-30*time.Second))
+	if _, err := s.VerifyToken(expired); err != nil {
+		t.Errorf("a token expired within the clock skew returned %v", err)
+	}
+	early := sign(t, jwt.SigningMethodHS256, key, claimsAt(now.Add(30*time.Second), time.Hour))
+	if _, err := s.VerifyToken(early); err != nil {
+		t.Errorf("a token issued within the clock skew returned %v", err)
+	}
+}
+
+func TestVerifyTokenRevoked(t *testing.T) {
+	dl := &memoryDenylist{revoked: map[string]bool{}}
+	s := newTestSession(Config{Denylist: dl})
+	token, err := s.CreateToken(&Claims{Username: "user@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.VerifyToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeToken(claims); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.VerifyToken(token); err != ErrTokenRevoked {
+		t.Errorf("VerifyToken of a revoked token returned %v, want ErrTokenRevoked", err)
+	}
+}
+
+func TestRevokeTokenKeepsClockSkew(t *testing.T) {
+	dl := &memoryDenylist{revoked: map[string]bool{}, expires: map[string]time.Time{}}
+	s := newTestSession(Config{Denylist: dl, ClockSkew: time.Minute})
+	claims := &Claims{}
+	claims.Id = "id"
+	claims.ExpiresAt = time.Now().Unix()
+	if err := s.RevokeToken(claims); err != nil {
+		t.Fatal(err)
+	}
+	// The token is still accepted for the clock skew after it expires
+	want := time.Unix(claims.ExpiresAt, 0).Add(time.Minute)
+	if got := dl.expires["id"]; !got.Equal(want) {
+		t.Errorf("the token is revoked until %v, want %v", got, want)
+	}
+}
+
+func TestVerifyTokenDenylistError(t *testing.T) {
+	failure := errors.New("denylist down")
+	s := newTestSession(Config{Denylist: &memoryDenylist{revoked: map[string]bool{}, err: failure}})
+	token, err := s.CreateToken(&Claims{Username: "user@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.VerifyToken(token)
+	if err != failure {
+		t.Fatalf("VerifyToken returned %v, want the denylist error", err)
+	}
+	if IsTokenError(err) {
+		t.Error("a denylist error is reported as an invalid token")
+	}
+}
@@ -0,0 +1,80 @@
+package thumbnail
+
+import (
+	"image"
+	"image/color"
+)
+
+// Size is a thumbnail size. Thumbnails fit in a Max x Max square
+// keeping the aspect ratio of the original image.
+type Size struct {
+	Name string
+	Max  int
+}
+
+// Sizes are the thumbnails generated for every image
+var Sizes = []Size{
+	{Name: "small", Max: 150},
+	{Name: "medium", Max: 400},
+	{Name: "large", Max: 800},
+}
+
+// Fit returns the dimensions of src scaled down to fit in a
+// size x size square. Images that already fit are not scaled up.
+func Fit(src image.Rectangle, size int) (int, int) {
+	w, h := src.Dx(), src.Dy()
+	if w <= size && h <= size {
+		return w, h
+	}
+	if w >= h {
+		return size, maxInt(1, h*size/w)
+	}
+	return maxInt(1, w*size/h), size
+}
+
+// Resize scales src down to fit in a size x size square. Every pixel
+// of the thumbnail is the average of the source pixels it covers,
+// which gives good results when shrinking photos.
+func Resize(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := Fit(b, size)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := maxInt(y0+1, b.Min.Y+(y+1)*b.Dy()/h)
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := maxInt(x0+1, b.Min.X+(x+1)*b.Dx()/w)
+			dst.Set(x, y, average(src, x0, y0, x1, y1))
+		}
+	}
+	return dst
+}
+
+// average returns the mean color of the pixels in [x0, x1) x [y0, y1)
+func average(src image.Image, x0, y0, x1, y1 int) color.Color {
+	var r, g, b, a, n uint64
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			pr, pg, pb, pa := src.At(x, y).RGBA()
+			r += uint64(pr)
+			g += uint64(pg)
+			b += uint64(pb)
+			a += uint64(pa)
+			n++
+		}
+	}
+	return color.RGBA64{
+		R: uint16(r / n),
+		G: uint16(g / n),
+		B: uint16(b / n),
+		A: uint16(a / n),
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
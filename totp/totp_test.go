@@ -0,0 +1,119 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// The secret of the SHA-1 test vectors of RFC 6238, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The codes of RFC 6238 are 8 digits long, these are their last 6
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCode(t *testing.T) {
+	for _, v := range rfcVectors {
+		code, err := Code(rfcSecret, time.Unix(v.unix, 0))
+		if err != nil {
+			t.Fatalf("Code(%v) returned %v", v.unix, err)
+		}
+		if code != v.code {
+			t.Errorf("Code(%v) = %v, want %v", v.unix, code, v.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, v := range rfcVectors {
+		now := time.Unix(v.unix, 0)
+		step, ok := Validate(rfcSecret, v.code, now)
+		if !ok || step != v.unix/period {
+			t.Errorf("Validate(%v, %v) = %v, %v, want %v, true", v.code, v.unix, step, ok, v.unix/period)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	code := "005924"
+	issued := time.Unix(1234567890, 0)
+	tests := []struct {
+		name string
+		at   time.Time
+		ok   bool
+	}{
+		{"previous step", issued.Add(-period * time.Second), true},
+		{"next step", issued.Add(period * time.Second), true},
+		{"two steps before", issued.Add(-2 * period * time.Second), false},
+		{"two steps later", issued.Add(2 * period * time.Second), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, code, tt.at)
+			if ok != tt.ok {
+				t.Fatalf("Validate = %v, want %v", ok, tt.ok)
+			}
+			if ok && step != issued.Unix()/period {
+				t.Errorf("step = %v, want the step of the code %v", step, issued.Unix()/period)
+			}
+		})
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	tests := []struct {
+		name, secret, code string
+	}{
+		{"wrong code", rfcSecret, "005925"},
+		{"short code", rfcSecret, "05924"},
+		{"long code", rfcSecret, "0005924"},
+		{"empty code", rfcSecret, ""},
+		{"invalid secret", "not base32!", "005924"},
+		{"empty secret", "", "005924"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := Validate(tt.secret, tt.code, now); ok {
+				t.Errorf("Validate(%q, %q) = true, want false", tt.secret, tt.code)
+			}
+		})
+	}
+}
+
+func TestValidateLowercaseSecretAndSpaces(t *testing.T) {
+	if _, ok := Validate("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", " 005924 ", time.Unix(1234567890, 0)); !ok {
+		t.Error("Validate rejected a lowercase secret or a code with spaces")
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("NewSecret returned %q, not base32: %v", secret, err)
+	}
+	if len(key) != secretBytes {
+		t.Errorf("NewSecret returned %v bytes, want %v", len(key), secretBytes)
+	}
+	now := time.Now()
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(secret, code, now); !ok {
+		t.Error("the code of a new secret isn't valid")
+	}
+}